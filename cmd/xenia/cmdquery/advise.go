@@ -0,0 +1,102 @@
+package cmdquery
+
+import (
+	"encoding/json"
+
+	"github.com/coralproject/xenia/cmd/xenia/web"
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/spf13/cobra"
+)
+
+var adviseLong = `Analyzes the queries of a Set and suggests the indexes they need.
+The variables are used to explain the queries, reporting collection scans
+and sorts done in memory. Declared indexes no query uses are reported.
+
+Example:
+	query advise -n "my_set"
+
+	query advise -n "my_set" -v "key:value,key:value"
+`
+
+// adv contains the state for this command.
+var adv struct {
+	name     string
+	vars     string
+	varsFile string
+}
+
+// addAdvise handles the index advice for queries.
+func addAdvise() {
+	cmd := &cobra.Command{
+		Use:   "advise",
+		Short: "Advises on the indexes of a Set by name.",
+		Long:  adviseLong,
+		Run:   runAdvise,
+	}
+
+	cmd.Flags().StringVarP(&adv.name, "name", "n", "", "Name of Set.")
+	cmd.Flags().StringVarP(&adv.vars, "vars", "v", "", "Variables used to explain the Set.")
+	cmd.Flags().StringVarP(&adv.varsFile, "vars-file", "f", "", "File with a JSON object of variables used to explain the Set.")
+
+	queryCmd.AddCommand(cmd)
+}
+
+// runAdvise is the code that implements the advise command.
+func runAdvise(cmd *cobra.Command, args []string) {
+	cmd.Printf("Advise Set : Name[%s] Vars[%v]\n", adv.name, adv.vars)
+
+	if adv.name == "" {
+		cmd.Help()
+		return
+	}
+
+	vars, err := parseVars(adv.vars, adv.varsFile)
+	if err != nil {
+		cmd.Println("Advise Set : ", err)
+		return
+	}
+
+	if conn == nil {
+		runAdviseWeb(cmd, vars)
+		return
+	}
+
+	runAdviseDB(cmd, vars)
+}
+
+// runAdviseWeb issues the command talking to the web service.
+func runAdviseWeb(cmd *cobra.Command, vars map[string]string) {
+	url := "/1.0/index/" + adv.name + "/advice" + queryString(vars)
+
+	resp, err := web.Request(cmd, "GET", url, nil)
+	if err != nil {
+		cmd.Println("Advise Set : ", err)
+	}
+
+	cmd.Printf("\n%s\n\n", resp)
+}
+
+// runAdviseDB issues the command talking to the DB.
+func runAdviseDB(cmd *cobra.Command, vars map[string]string) {
+	set, err := query.GetByName("", conn, adv.name)
+	if err != nil {
+		cmd.Println("Advise Set : ", err)
+		return
+	}
+
+	advice, err := exec.Advise("", conn, set, vars)
+	if err != nil {
+		cmd.Println("Advise Set : ", err)
+		return
+	}
+
+	data, err := json.MarshalIndent(advice, "", "    ")
+	if err != nil {
+		cmd.Println("Advise Set : ", err)
+		return
+	}
+
+	cmd.Printf("\n%s\n\n", string(data))
+}
@@ -22,7 +22,9 @@ func GetCommands(db *db.DB) *cobra.Command {
 	addGet()
 	addDel()
 	addExec()
+	addRender()
 	addList()
 	addIndex()
+	addAdvise()
 	return queryCmd
 }
@@ -1,7 +1,12 @@
 package cmdquery
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"net/url"
+	"os"
+	"os/signal"
 	"strings"
 
 	"github.com/coralproject/xenia/cmd/xenia/web"
@@ -17,12 +22,23 @@ Example:
 	query exec -n "user_advice"
 
 	query exec -n "my_set" -v "key:value,key:value"
+
+	query exec -n "my_set" -v "ids:value,ids:value"
+
+	query exec -n "my_set" -c "<next cursor from the previous page>"
+
+	query exec -n "my_set" -f vars.json
+
+	query exec -n "my_set" -x canonical
 `
 
 // exe contains the state for this command.
 var exe struct {
-	name string
-	vars string
+	name     string
+	vars     string
+	varsFile string
+	cursor   string
+	extJSON  string
 }
 
 // addExec handles the execution of queries.
@@ -36,30 +52,94 @@ func addExec() {
 
 	cmd.Flags().StringVarP(&exe.name, "name", "n", "", "Name of Set.")
 	cmd.Flags().StringVarP(&exe.vars, "vars", "v", "", "Variables required by Set.")
+	cmd.Flags().StringVarP(&exe.varsFile, "vars-file", "f", "", "File with a JSON object of variables required by Set.")
+	cmd.Flags().StringVarP(&exe.cursor, "cursor", "c", "", "Cursor of the page to return for paginated queries.")
+	cmd.Flags().StringVarP(&exe.extJSON, "extjson", "x", "", "Return the results as relaxed or canonical Mongo Extended JSON.")
 
 	queryCmd.AddCommand(cmd)
 }
 
 // runExec is the code that implements the execute command.
 func runExec(cmd *cobra.Command, args []string) {
+	vars, err := parseVars(exe.vars, exe.varsFile)
+	if err != nil {
+		cmd.Println("Exec Set : ", err)
+		return
+	}
+
+	if conn == nil {
+		runExecWeb(cmd, vars)
+		return
+	}
+
+	runExecDB(cmd, vars)
+}
+
+// parseVars builds the variables from the file and the command line. The
+// variables on the command line replace the ones in the file.
+func parseVars(list string, file string) (map[string]string, error) {
 	vars := make(map[string]string)
-	if exe.vars != "" {
-		vs := strings.Split(exe.vars, ",")
+
+	// Load the variables from the file first so the ones on
+	// the command line can replace them.
+	if file != "" {
+		if err := loadVarsFile(file, vars); err != nil {
+			return nil, err
+		}
+	}
+
+	if list != "" {
+
+		// A key can be repeated to provide multiple values.
+		values := make(map[string][]string)
+
+		vs := strings.Split(list, ",")
 		for _, kvs := range vs {
 			kv := strings.Split(kvs, ":")
 			if len(kv) != 2 {
 				continue
 			}
-			vars[kv[0]] = kv[1]
+			values[kv[0]] = append(values[kv[0]], kv[1])
+		}
+
+		for k, v := range values {
+			vars[k] = exec.EncodeValues(v)
 		}
 	}
 
-	if conn == nil {
-		runExecWeb(cmd, vars)
-		return
+	return vars, nil
+}
+
+// loadVarsFile reads the JSON object of variables in the file into vars.
+func loadVarsFile(path string, vars map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	runExecDB(cmd, vars)
+	// Keep numbers as they were written.
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+
+	var m map[string]interface{}
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+
+	for k, v := range m {
+		if v == nil {
+			continue
+		}
+
+		s, err := exec.EncodeJSON(v)
+		if err != nil {
+			return err
+		}
+		vars[k] = s
+	}
+
+	return nil
 }
 
 // runExecWeb issues the command talking to the web service.
@@ -67,21 +147,22 @@ func runExecWeb(cmd *cobra.Command, vars map[string]string) {
 	verb := "GET"
 	url := "/1.0/exec/" + exe.name
 
-	if len(vars) > 0 {
-		var i int
-		for k, v := range vars {
-			if i == 0 {
-				url += "?"
-			} else {
-				url += "&"
-			}
-			i++
+	// Post the variables in the body when they come from a file
+	// so they are kept out of the url.
+	if exe.varsFile != "" {
+		runExecWebPost(cmd, url, vars)
+		return
+	}
 
-			url += k + "=" + v
-		}
+	if exe.cursor != "" {
+		vars["cursor"] = exe.cursor
+	}
+
+	if exe.extJSON != "" {
+		vars["extjson"] = exe.extJSON
 	}
 
-	resp, err := web.Request(cmd, verb, url, nil)
+	resp, err := web.Request(cmd, verb, url+queryString(vars), nil)
 	if err != nil {
 		cmd.Println("Getting Set List : ", err)
 	}
@@ -89,6 +170,49 @@ func runExecWeb(cmd *cobra.Command, vars map[string]string) {
 	cmd.Printf("\n%s\n\n", resp)
 }
 
+// queryString returns the variables as the query string of a url. The values
+// are escaped since they can hold JSON arrays, dates with offsets and spaces.
+func queryString(vars map[string]string) string {
+	if len(vars) == 0 {
+		return ""
+	}
+
+	values := make(url.Values, len(vars))
+	for k, v := range vars {
+		values.Set(k, v)
+	}
+
+	return "?" + values.Encode()
+}
+
+// runExecWebPost issues the command talking to the web service with the
+// variables posted in the body.
+func runExecWebPost(cmd *cobra.Command, url string, vars map[string]string) {
+	params := make(map[string]string)
+	if exe.cursor != "" {
+		params["cursor"] = exe.cursor
+	}
+
+	if exe.extJSON != "" {
+		params["extjson"] = exe.extJSON
+	}
+
+	url += queryString(params)
+
+	data, err := json.Marshal(vars)
+	if err != nil {
+		cmd.Println("Exec Set : ", err)
+		return
+	}
+
+	resp, err := web.Request(cmd, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		cmd.Println("Exec Set : ", err)
+	}
+
+	cmd.Printf("\n%s\n\n", resp)
+}
+
 // runExecDB issues the command talking to the DB.
 func runExecDB(cmd *cobra.Command, vars map[string]string) {
 	cmd.Printf("Exec Set : Name[%s] Vars[%v]\n", exe.name, exe.vars)
@@ -104,7 +228,14 @@ func runExecDB(cmd *cobra.Command, vars map[string]string) {
 		return
 	}
 
-	result := exec.Exec("", conn, set, vars)
+	// Kill the queries running on the server if the user interrupts us.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result := exec.ExecContext(ctx, "", conn, set, vars, exe.cursor)
+	if exe.extJSON != "" {
+		result = exec.ExtJSON(result, exe.extJSON)
+	}
 
 	data, err := json.MarshalIndent(result, "", "    ")
 	if err != nil {
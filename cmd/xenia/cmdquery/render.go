@@ -0,0 +1,118 @@
+package cmdquery
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/coralproject/xenia/cmd/xenia/web"
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/spf13/cobra"
+)
+
+var renderLong = `Renders the final commands of each query of a Set without executing them.
+The #data lookups are left unresolved since they need the results of other queries.
+
+Example:
+	query render -n "my_set" -v "key:value,key:value"
+
+	query render -n "my_set" -f vars.json
+`
+
+// rnd contains the state for this command.
+var rnd struct {
+	name     string
+	vars     string
+	varsFile string
+}
+
+// addRender handles the rendering of queries.
+func addRender() {
+	cmd := &cobra.Command{
+		Use:   "render",
+		Short: "Renders the final commands of a Set by name.",
+		Long:  renderLong,
+		Run:   runRender,
+	}
+
+	cmd.Flags().StringVarP(&rnd.name, "name", "n", "", "Name of Set.")
+	cmd.Flags().StringVarP(&rnd.vars, "vars", "v", "", "Variables required by Set.")
+	cmd.Flags().StringVarP(&rnd.varsFile, "vars-file", "f", "", "File with a JSON object of variables required by Set.")
+
+	queryCmd.AddCommand(cmd)
+}
+
+// runRender is the code that implements the render command.
+func runRender(cmd *cobra.Command, args []string) {
+	cmd.Printf("Render Set : Name[%s] Vars[%v]\n", rnd.name, rnd.vars)
+
+	if rnd.name == "" {
+		cmd.Help()
+		return
+	}
+
+	vars, err := parseVars(rnd.vars, rnd.varsFile)
+	if err != nil {
+		cmd.Println("Render Set : ", err)
+		return
+	}
+
+	if conn == nil {
+		runRenderWeb(cmd, vars)
+		return
+	}
+
+	runRenderDB(cmd, vars)
+}
+
+// runRenderWeb issues the command talking to the web service.
+func runRenderWeb(cmd *cobra.Command, vars map[string]string) {
+	url := "/1.0/exec/" + rnd.name
+
+	// Post the variables in the body when they come from a file
+	// so they are kept out of the url.
+	if rnd.varsFile != "" {
+		data, err := json.Marshal(vars)
+		if err != nil {
+			cmd.Println("Render Set : ", err)
+			return
+		}
+
+		resp, err := web.Request(cmd, "POST", url+"?render=true", bytes.NewReader(data))
+		if err != nil {
+			cmd.Println("Render Set : ", err)
+		}
+
+		cmd.Printf("\n%s\n\n", resp)
+		return
+	}
+
+	vars["render"] = "true"
+
+	resp, err := web.Request(cmd, "GET", url+queryString(vars), nil)
+	if err != nil {
+		cmd.Println("Render Set : ", err)
+	}
+
+	cmd.Printf("\n%s\n\n", resp)
+}
+
+// runRenderDB issues the command talking to the DB.
+func runRenderDB(cmd *cobra.Command, vars map[string]string) {
+	set, err := query.GetByName("", conn, rnd.name)
+	if err != nil {
+		cmd.Println("Render Set : ", err)
+		return
+	}
+
+	result := exec.Render("", conn, set, vars)
+
+	data, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		cmd.Println("Render Set : ", err)
+		return
+	}
+
+	cmd.Printf("\n%s\n\n", string(data))
+}
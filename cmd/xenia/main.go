@@ -9,6 +9,7 @@ import (
 	"github.com/coralproject/xenia/cmd/xenia/cmdquery"
 	"github.com/coralproject/xenia/cmd/xenia/cmdregex"
 	"github.com/coralproject/xenia/cmd/xenia/cmdscript"
+	"github.com/coralproject/xenia/internal/exec"
 
 	"github.com/ardanlabs/kit/cfg"
 	"github.com/ardanlabs/kit/db"
@@ -27,6 +28,7 @@ const (
 	cfgMongoUser     = "MONGO_USER"
 	cfgMongoPassword = "MONGO_PASS"
 	cfgWebHost       = "WEB_HOST"
+	cfgSaveNS        = "SAVE_NAMESPACE"
 )
 
 var xenia = &cobra.Command{
@@ -78,6 +80,11 @@ func main() {
 		defer conn.CloseMGO("")
 	}
 
+	// Restrict the collections sets can save their results to.
+	if ns, err := cfg.String(cfgSaveNS); err == nil {
+		exec.SetSaveNamespace(ns)
+	}
+
 	xenia.AddCommand(
 		cmddb.GetCommands(conn),
 		cmdquery.GetCommands(conn),
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/coralproject/xenia/internal/alert"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/web/app"
+)
+
+// alertHandle maintains the set of handlers for the alert api.
+type alertHandle struct{}
+
+// Alert fronts the access to the alert service functionality.
+var Alert alertHandle
+
+//==============================================================================
+
+// List returns all the existing alert rules in the system.
+// 200 Success, 404 Not Found, 500 Internal
+func (alertHandle) List(c *app.Context) error {
+	rules, err := alert.GetAll(c.SessionID, c.Ctx["DB"].(*db.DB))
+	if err != nil {
+		if err == alert.ErrNotFound {
+			err = app.ErrNotFound
+		}
+		return err
+	}
+
+	c.Respond(rules, http.StatusOK)
+	return nil
+}
+
+// Retrieve returns the specified alert rule from the system.
+// 200 Success, 400 Bad Request, 404 Not Found, 500 Internal
+func (alertHandle) Retrieve(c *app.Context) error {
+	rule, err := alert.GetByName(c.SessionID, c.Ctx["DB"].(*db.DB), c.Params["name"])
+	if err != nil {
+		if err == alert.ErrNotFound {
+			err = app.ErrNotFound
+		}
+		return err
+	}
+
+	c.Respond(rule, http.StatusOK)
+	return nil
+}
+
+// Deliveries returns the latest deliveries of the alerts of the specified rule.
+// 200 Success, 404 Not Found, 500 Internal
+func (alertHandle) Deliveries(c *app.Context) error {
+	dels, err := alert.Deliveries(c.SessionID, c.Ctx["DB"].(*db.DB), c.Params["name"])
+	if err != nil {
+		if err == alert.ErrNotFound {
+			err = app.ErrNotFound
+		}
+		return err
+	}
+
+	c.Respond(dels, http.StatusOK)
+	return nil
+}
+
+//==============================================================================
+
+// Upsert inserts or updates the posted alert rule into the database.
+// 204 SuccessNoContent, 400 Bad Request, 404 Not Found, 500 Internal
+func (alertHandle) Upsert(c *app.Context) error {
+	var rule alert.Rule
+	if err := json.NewDecoder(c.Request.Body).Decode(&rule); err != nil {
+		return err
+	}
+
+	if err := alert.Upsert(c.SessionID, c.Ctx["DB"].(*db.DB), &rule); err != nil {
+		return err
+	}
+
+	c.Respond(nil, http.StatusNoContent)
+	return nil
+}
+
+//==============================================================================
+
+// Delete removes the specified alert rule from the system.
+// 200 Success, 400 Bad Request, 404 Not Found, 500 Internal
+func (alertHandle) Delete(c *app.Context) error {
+	if err := alert.Delete(c.SessionID, c.Ctx["DB"].(*db.DB), c.Params["name"]); err != nil {
+		if err == alert.ErrNotFound {
+			err = app.ErrNotFound
+		}
+		return err
+	}
+
+	c.Respond(nil, http.StatusNoContent)
+	return nil
+}
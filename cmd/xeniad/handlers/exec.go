@@ -3,16 +3,40 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/coralproject/xenia/internal/exec"
 	"github.com/coralproject/xenia/internal/query"
 
 	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/log"
 	"github.com/ardanlabs/kit/web/app"
+	"gopkg.in/mgo.v2/bson"
 )
 
+// ndjson is the content type for newline delimited JSON.
+const ndjson = "application/x-ndjson"
+
+// Set of content types the results can be exported as.
+const (
+	textCSV = "text/csv"
+	textTSV = "text/tab-separated-values"
+)
+
+// controls are the variables a client uses to choose how a set is executed
+// and returned. They are taken out of the variables before the set runs.
+var controls = []string{"render", "format", "query", "extjson", "stream", "cursor", "compat"}
+
+// execError is the response sent when executing a set fails.
+type execError struct {
+	Error    *exec.Error `json:"error"`
+	Commands interface{} `json:"commands,omitempty"`
+}
+
 // execHandle maintains the set of handlers for the exec api.
 type execHandle struct{}
 
@@ -22,7 +46,7 @@ var Exec execHandle
 //==============================================================================
 
 // Name runs the specified Set and return results.
-// 200 Success, 400 Bad Request, 404 Not Found, 500 Internal
+// 200 Success, 400 Bad Request, 403 Forbidden, 404 Not Found, 500 Internal, 504 Timeout
 func (execHandle) Name(c *app.Context) error {
 	set, err := query.GetByName(c.SessionID, c.Ctx["DB"].(*db.DB), c.Params["name"])
 	if err != nil {
@@ -32,37 +56,278 @@ func (execHandle) Name(c *app.Context) error {
 		return err
 	}
 
-	return execute(c, set)
+	return execute(c, set, nil)
+}
+
+// NameVars runs the specified Set using the JSON object of variables posted
+// in the body and return results. Variables in the body replace the ones in
+// the query string.
+// 200 Success, 400 Bad Request, 403 Forbidden, 404 Not Found, 500 Internal, 504 Timeout
+func (execHandle) NameVars(c *app.Context) error {
+	set, err := query.GetByName(c.SessionID, c.Ctx["DB"].(*db.DB), c.Params["name"])
+	if err != nil {
+		if err == query.ErrNotFound {
+			err = app.ErrNotFound
+		}
+		return err
+	}
+
+	// Keep numbers as they were written.
+	dec := json.NewDecoder(c.Request.Body)
+	dec.UseNumber()
+
+	var body map[string]interface{}
+	if err := dec.Decode(&body); err != nil && err != io.EOF {
+		c.RespondError(err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	posted := make(map[string]string)
+	for k, v := range body {
+		if v == nil {
+			continue
+		}
+
+		s, err := exec.EncodeJSON(v)
+		if err != nil {
+			return err
+		}
+		posted[k] = s
+	}
+
+	return execute(c, set, posted)
 }
 
 // Custom runs the provided Set and return results.
-// 200 Success, 400 Bad Request, 404 Not Found, 500 Internal
+// 200 Success, 400 Bad Request, 403 Forbidden, 404 Not Found, 500 Internal, 504 Timeout
 func (execHandle) Custom(c *app.Context) error {
 	var set *query.Set
 	if err := json.NewDecoder(c.Request.Body).Decode(&set); err != nil {
 		return err
 	}
 
-	return execute(c, set)
+	return execute(c, set, nil)
 }
 
 //==============================================================================
 
 // execute takes a context and Set and executes the set returning
-// any possible response.
-func execute(c *app.Context, set *query.Set) error {
+// any possible response. The posted variables replace the ones
+// in the query string.
+func execute(c *app.Context, set *query.Set, posted map[string]string) error {
+
+	// A param named like a control would never get its value.
+	for _, p := range set.Params {
+		for _, name := range controls {
+			if p.Name == name {
+				c.RespondError(fmt.Sprintf("Param %q is reserved, the name is used to control the request", p.Name), http.StatusBadRequest)
+				return nil
+			}
+		}
+	}
+
 	var vars map[string]string
 	if c.Request.URL.RawQuery != "" {
 		if m, err := url.ParseQuery(c.Request.URL.RawQuery); err == nil {
 			vars = make(map[string]string)
 			for k, v := range m {
-				vars[k] = v[0]
+				vars[k] = exec.EncodeValues(v)
 			}
 		}
 	}
 
-	result := exec.Exec(c.SessionID, c.Ctx["DB"].(*db.DB), set, vars)
+	if len(posted) > 0 {
+		if vars == nil {
+			vars = make(map[string]string)
+		}
+
+		for k, v := range posted {
+			vars[k] = v
+		}
+	}
+
+	// Does the client want the final commands instead of the results.
+	render := vars["render"] == "true"
+	delete(vars, "render")
+
+	// Does the client want the results exported as CSV or TSV. A query
+	// can be selected from the ones the set returns.
+	format := exportFormat(c.Request, vars)
+	delete(vars, "format")
+
+	var selected string
+	if format != "" {
+		selected = vars["query"]
+		delete(vars, "query")
+	}
+
+	// Does the client want the results as Mongo Extended JSON so the
+	// types of the values are kept.
+	extJSON := vars["extjson"]
+	delete(vars, "extjson")
+
+	switch extJSON {
+	case "", exec.ExtJSONRelaxed, exec.ExtJSONCanonical:
+	case "true":
+		extJSON = exec.ExtJSONRelaxed
+	default:
+		c.RespondError(fmt.Sprintf("Invalid extjson %q, expecting %q or %q", extJSON, exec.ExtJSONRelaxed, exec.ExtJSONCanonical), http.StatusBadRequest)
+		return nil
+	}
+
+	// Does the client want the results streamed back as they are read.
+	streamed := vars["stream"] == "true" || strings.Contains(c.Request.Header.Get("Accept"), ndjson)
+	delete(vars, "stream")
+
+	if !render && format == "" && extJSON == "" && streamed {
+		stream(c, set, vars)
+		return nil
+	}
+
+	// Pull the cursor for paginated queries out of the variables.
+	cursor := vars["cursor"]
+	delete(vars, "cursor")
+
+	// Older clients expect errors inside the results with a 200.
+	compat := vars["compat"] == "true"
+	delete(vars, "compat")
+
+	var result *query.Result
+	if render {
 
-	c.Respond(result, http.StatusOK)
+		// Nothing is executed so there is nothing to page through.
+		result = exec.Render(c.SessionID, c.Ctx["DB"].(*db.DB), set, vars)
+	} else {
+
+		// The queries are killed if the client goes away before they complete.
+		result = exec.ExecContext(c.Request.Context(), c.SessionID, c.Ctx["DB"].(*db.DB), set, vars, cursor)
+	}
+
+	// Export the results, errors are still reported as JSON.
+	if format != "" && !render && result.Err == nil {
+		return export(c, set, result, format, selected)
+	}
+
+	// The rendered commands are already Extended JSON.
+	if extJSON != "" && !render {
+		result = exec.ExtJSON(result, extJSON)
+	}
+
+	e, ok := result.Err.(*exec.Error)
+	if !ok || compat {
+		c.Respond(result, http.StatusOK)
+		return nil
+	}
+
+	// Send the error with the commands that were processed.
+	resp := execError{Error: e}
+	if m, ok := result.Results.(bson.M); ok {
+		resp.Commands = m["commands"]
+	}
+
+	c.Respond(resp, errStatus(e.Code))
+	return nil
+}
+
+// exportFormat returns the format the client wants the results exported in
+// from the format variable or the Accept header. An empty format means JSON.
+func exportFormat(r *http.Request, vars map[string]string) string {
+	switch vars["format"] {
+	case exec.FormatCSV, exec.FormatTSV:
+		return vars["format"]
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, textCSV):
+		return exec.FormatCSV
+	case strings.Contains(accept, textTSV):
+		return exec.FormatTSV
+	}
+
+	return ""
+}
+
+// export writes the results of each query as a table in the format. The
+// tables of a set returning several queries are written as a zip archive
+// holding a file per query unless a query is selected.
+func export(c *app.Context, set *query.Set, result *query.Result, format, selected string) error {
+	tables, err := exec.Tables(set, result)
+	if err != nil {
+		return err
+	}
+
+	if selected != "" {
+		var found []exec.Table
+		for _, t := range tables {
+			if t.Name == selected {
+				found = append(found, t)
+			}
+		}
+
+		if len(found) == 0 {
+			c.RespondError(fmt.Sprintf("Query %q is not returned by the set", selected), http.StatusBadRequest)
+			return nil
+		}
+
+		tables = found
+	}
+
+	if len(tables) == 1 {
+		contentType := textCSV
+		if format == exec.FormatTSV {
+			contentType = textTSV
+		}
+
+		c.Header().Set("Content-Type", contentType+"; charset=utf-8")
+		c.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", tables[0].Name+"."+format))
+		c.Status = http.StatusOK
+		c.WriteHeader(http.StatusOK)
+
+		// The status has already been sent so all we can do is log.
+		if err := exec.WriteTable(c.ResponseWriter, tables[0], format); err != nil {
+			log.Error(c.SessionID, "export", err, "Writing table")
+		}
+		return nil
+	}
+
+	c.Header().Set("Content-Type", "application/zip")
+	c.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", set.Name+".zip"))
+	c.Status = http.StatusOK
+	c.WriteHeader(http.StatusOK)
+
+	if err := exec.WriteTables(c.ResponseWriter, tables, format); err != nil {
+		log.Error(c.SessionID, "export", err, "Writing tables")
+	}
 	return nil
 }
+
+// errStatus returns the http status for the code of an exec error.
+func errStatus(code exec.Code) int {
+	switch code {
+	case exec.CodeParamMissing, exec.CodeParamInvalid, exec.CodeSetInvalid, exec.CodeCursorInvalid, exec.CodeCommandInvalid:
+		return http.StatusBadRequest
+	case exec.CodeSetDisabled:
+		return http.StatusForbidden
+	case exec.CodeTimeout:
+		return http.StatusGatewayTimeout
+	case exec.CodeCanceled:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// stream executes the set writing each document back to the client as
+// newline delimited JSON as soon as it is read from the database.
+func stream(c *app.Context, set *query.Set, vars map[string]string) {
+	c.Header().Set("Content-Type", ndjson)
+	c.Status = http.StatusOK
+	c.WriteHeader(http.StatusOK)
+
+	// The status has already been sent so any error is written into the
+	// stream by exec and all we can do here is log it.
+	if err := exec.Stream(c.Request.Context(), c.SessionID, c.Ctx["DB"].(*db.DB), set, vars, c.ResponseWriter); err != nil {
+		log.Error(c.SessionID, "stream", err, "Streaming set")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/coralproject/xenia/internal/exec"
 	"github.com/coralproject/xenia/internal/query"
 
 	"github.com/ardanlabs/kit/db"
@@ -34,7 +35,8 @@ func (queryHandle) List(c *app.Context) error {
 	return nil
 }
 
-// Retrieve returns the specified Set from the system.
+// Retrieve returns the specified Set from the system. With schema=true the
+// JSON Schema of the parameters of the Set is returned instead.
 // 200 Success, 400 Bad Request, 404 Not Found, 500 Internal
 func (queryHandle) Retrieve(c *app.Context) error {
 	set, err := query.GetByName(c.SessionID, c.Ctx["DB"].(*db.DB), c.Params["name"])
@@ -45,6 +47,11 @@ func (queryHandle) Retrieve(c *app.Context) error {
 		return err
 	}
 
+	if c.Request.URL.Query().Get("schema") == "true" {
+		c.Respond(set.ParamSchema(), http.StatusOK)
+		return nil
+	}
+
 	c.Respond(set, http.StatusOK)
 	return nil
 }
@@ -88,6 +95,38 @@ func (queryHandle) EnsureIndexes(c *app.Context) error {
 	return nil
 }
 
+// Advice analyzes the queries of the specified Set and returns the indexes
+// they need. The variables in the query string are used to explain the queries.
+// 200 Success, 400 Bad Request, 404 Not Found, 500 Internal
+func (queryHandle) Advice(c *app.Context) error {
+	db := c.Ctx["DB"].(*db.DB)
+
+	set, err := query.GetByName(c.SessionID, db, c.Params["name"])
+	if err != nil {
+		if err == query.ErrNotFound {
+			err = app.ErrNotFound
+		}
+		return err
+	}
+
+	vars := make(map[string]string)
+	for k, v := range c.Request.URL.Query() {
+		vars[k] = exec.EncodeValues(v)
+	}
+
+	advice, err := exec.Advise(c.SessionID, db, set, vars)
+	if err != nil {
+		if e, ok := err.(*exec.Error); ok {
+			c.Respond(execError{Error: e}, errStatus(e.Code))
+			return nil
+		}
+		return err
+	}
+
+	c.Respond(advice, http.StatusOK)
+	return nil
+}
+
 //==============================================================================
 
 // Delete removes the specified Set from the system.
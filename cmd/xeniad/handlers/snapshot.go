@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/coralproject/xenia/internal/snapshot"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/web/app"
+)
+
+// snapshotHandle maintains the set of handlers for the snapshot api.
+type snapshotHandle struct{}
+
+// Snapshot fronts the access to the snapshot service functionality.
+var Snapshot snapshotHandle
+
+//==============================================================================
+
+// List returns the snapshots of the specified Set without their results.
+// 200 Success, 404 Not Found, 500 Internal
+func (snapshotHandle) List(c *app.Context) error {
+	snaps, err := snapshot.List(c.SessionID, c.Ctx["DB"].(*db.DB), c.Params["name"])
+	if err != nil {
+		if err == snapshot.ErrNotFound {
+			err = app.ErrNotFound
+		}
+		return err
+	}
+
+	c.Respond(snaps, http.StatusOK)
+	return nil
+}
+
+// Latest returns the latest snapshot of the specified Set that completed
+// without an error.
+// 200 Success, 404 Not Found, 500 Internal
+func (snapshotHandle) Latest(c *app.Context) error {
+	snap, err := snapshot.Latest(c.SessionID, c.Ctx["DB"].(*db.DB), c.Params["name"])
+	if err != nil {
+		if err == snapshot.ErrNotFound {
+			err = app.ErrNotFound
+		}
+		return err
+	}
+
+	c.Respond(snap, http.StatusOK)
+	return nil
+}
+
+// Retrieve returns the specified snapshot of the specified Set.
+// 200 Success, 400 Bad Request, 404 Not Found, 500 Internal
+func (snapshotHandle) Retrieve(c *app.Context) error {
+	snap, err := snapshot.GetByID(c.SessionID, c.Ctx["DB"].(*db.DB), c.Params["name"], c.Params["id"])
+	if err != nil {
+		switch err {
+		case snapshot.ErrNotFound:
+			err = app.ErrNotFound
+		case snapshot.ErrInvalidID:
+			err = app.ErrInvalidID
+		}
+		return err
+	}
+
+	c.Respond(snap, http.StatusOK)
+	return nil
+}
@@ -46,5 +46,10 @@ func main() {
 	// to the end of the response write.
 	writeTimeout := 30 * time.Second
 
+	// Execute the sets that have a schedule while serving requests.
+	stop := routes.Scheduler()
+
 	app.Run(":4000", routes.API(), readTimeout, writeTimeout)
+
+	stop()
 }
@@ -16,6 +16,8 @@ import (
 	"github.com/ardanlabs/kit/web/app"
 	"github.com/coralproject/xenia/cmd/xeniad/handlers"
 	"github.com/coralproject/xenia/cmd/xeniad/midware"
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/scheduler"
 )
 
 // Environmental variables.
@@ -26,6 +28,8 @@ const (
 	cfgMongoUser     = "MONGO_USER"
 	cfgMongoPassword = "MONGO_PASS"
 	cfgAnvilHost     = "ANVIL_HOST"
+	cfgSaveNS        = "SAVE_NAMESPACE"
+	cfgScheduler     = "SCHEDULER"
 )
 
 func init() {
@@ -52,6 +56,11 @@ func init() {
 			os.Exit(1)
 		}
 	}
+
+	// Restrict the collections sets can save their results to.
+	if ns, err := cfg.String(cfgSaveNS); err == nil {
+		exec.SetSaveNamespace(ns)
+	}
 }
 
 //==============================================================================
@@ -89,6 +98,27 @@ func API(testing ...bool) http.Handler {
 	return a
 }
 
+// Scheduler starts executing the sets that have a schedule unless MongoDB is
+// not configured or the scheduler is turned off. It returns the function to
+// stop the scheduler.
+func Scheduler() func() {
+	name, err := cfg.String(cfgMongoDB)
+	if err != nil {
+		return func() {}
+	}
+
+	if on, err := cfg.Bool(cfgScheduler); err == nil && !on {
+		log.User("startup", "Scheduler", "Scheduler is turned off")
+		return func() {}
+	}
+
+	// The master session is named after the database by convention.
+	s := scheduler.New(name)
+	s.Start()
+
+	return s.Stop
+}
+
 // routes manages the handling of the API endpoints.
 func routes(a *app.App) {
 	a.Handle("GET", "/1.0/version", handlers.Version.List)
@@ -104,6 +134,17 @@ func routes(a *app.App) {
 	a.Handle("DELETE", "/1.0/query/:name", handlers.Query.Delete)
 
 	a.Handle("PUT", "/1.0/index/:name", handlers.Query.EnsureIndexes)
+	a.Handle("GET", "/1.0/index/:name/advice", handlers.Query.Advice)
+
+	a.Handle("GET", "/1.0/snapshot/:name", handlers.Snapshot.List)
+	a.Handle("GET", "/1.0/snapshot/:name/latest", handlers.Snapshot.Latest)
+	a.Handle("GET", "/1.0/snapshot/:name/:id", handlers.Snapshot.Retrieve)
+
+	a.Handle("GET", "/1.0/alert", handlers.Alert.List)
+	a.Handle("PUT", "/1.0/alert", handlers.Alert.Upsert)
+	a.Handle("GET", "/1.0/alert/:name", handlers.Alert.Retrieve)
+	a.Handle("DELETE", "/1.0/alert/:name", handlers.Alert.Delete)
+	a.Handle("GET", "/1.0/alert/:name/deliveries", handlers.Alert.Deliveries)
 
 	a.Handle("GET", "/1.0/regex", handlers.Regex.List)
 	a.Handle("PUT", "/1.0/regex", handlers.Regex.Upsert)
@@ -118,6 +159,7 @@ func routes(a *app.App) {
 
 	a.Handle("POST", "/1.0/exec", handlers.Exec.Custom)
 	a.Handle("GET", "/1.0/exec/:name", handlers.Exec.Name)
+	a.Handle("POST", "/1.0/exec/:name", handlers.Exec.NameVars)
 }
 
 // website manages the serving of web files for the project.
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/coralproject/xenia/internal/query"
 	"github.com/coralproject/xenia/internal/query/qfix"
 
 	"github.com/ardanlabs/kit/tests"
@@ -46,6 +47,54 @@ func TestExec(t *testing.T) {
 	}
 }
 
+// TestExecPostVars tests the execution of a specific query with the
+// variables posted in the body.
+func TestExecPostVars(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	t.Log("Given the need to execute a specific query with posted variables.")
+	{
+		url := "/1.0/exec/" + qPrefix + "_basic_var?station_id=00000"
+		r := tests.NewRequest("POST", url, strings.NewReader(`{"station_id": "42021"}`))
+		w := httptest.NewRecorder()
+
+		a.ServeHTTP(w, r)
+
+		t.Logf("\tWhen calling url : %s", url)
+		{
+			if w.Code != 200 {
+				t.Fatalf("\t%s\tShould be able to retrieve the query : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould be able to retrieve the query.", tests.Success)
+
+			recv := w.Body.String()
+			resp := `{"results":[{"Name":"BasicVar","Docs":[{"name":"C14 - Pasco County Buoy, FL"}]}]}`
+
+			if resp != recv {
+				t.Log(resp)
+				t.Log(recv)
+				t.Fatalf("\t%s\tShould get the expected result.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould get the expected result.", tests.Success)
+		}
+
+		url = "/1.0/exec/" + qPrefix + "_basic_var"
+		r = tests.NewRequest("POST", url, strings.NewReader(`{"station_id": `))
+		w = httptest.NewRecorder()
+
+		a.ServeHTTP(w, r)
+
+		t.Logf("\tWhen posting malformed variables to url : %s", url)
+		{
+			if w.Code != 400 {
+				t.Fatalf("\t%s\tShould get a bad request : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould get a bad request.", tests.Success)
+		}
+	}
+}
+
 // TestExecCustom tests the execution of a custom query.
 func TestExecCustom(t *testing.T) {
 	tests.ResetLog()
@@ -88,6 +137,26 @@ func TestExecCustom(t *testing.T) {
 			}
 			t.Logf("\t%s\tShould get the expected result.", tests.Success)
 		}
+
+		qs.Params = append(qs.Params, query.Param{Name: "cursor"})
+
+		qsStrData, err = json.Marshal(&qs)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to marshal the fixture : %v", tests.Failed, err)
+		}
+
+		r = tests.NewRequest("POST", url, bytes.NewBuffer(qsStrData))
+		w = httptest.NewRecorder()
+
+		a.ServeHTTP(w, r)
+
+		t.Log("\tWhen calling a set with a param named cursor")
+		{
+			if w.Code != 400 {
+				t.Fatalf("\t%s\tShould get a bad request : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould get a bad request.", tests.Success)
+		}
 	}
 }
 
@@ -124,6 +193,44 @@ func TestExecJSONP(t *testing.T) {
 	}
 }
 
+// TestExecStream tests the execution of a specific query streaming the results.
+func TestExecStream(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	t.Log("Given the need to execute a specific query streaming the results.")
+	{
+		url := "/1.0/exec/" + qPrefix + "_basic?station_id=42021&stream=true"
+		r := tests.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+
+		a.ServeHTTP(w, r)
+
+		t.Logf("\tWhen calling url : %s", url)
+		{
+			if w.Code != 200 {
+				t.Fatalf("\t%s\tShould be able to retrieve the query : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould be able to retrieve the query.", tests.Success)
+
+			if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+				t.Fatalf("\t%s\tShould get the ndjson content type : %s", tests.Failed, ct)
+			}
+			t.Logf("\t%s\tShould get the ndjson content type.", tests.Success)
+
+			recv := w.Body.String()
+			resp := `{"Name":"Basic","Doc":{"name":"C14 - Pasco County Buoy, FL"}}` + "\n"
+
+			if resp != recv {
+				t.Log(resp)
+				t.Log(recv)
+				t.Fatalf("\t%s\tShould get the expected result.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould get the expected result.", tests.Success)
+		}
+	}
+}
+
 // TestExecExplain tests the execution of a custom query with explain.
 func TestExecExplain(t *testing.T) {
 	tests.ResetLog()
@@ -170,3 +277,242 @@ func TestExecExplain(t *testing.T) {
 		}
 	}
 }
+
+// TestExecError tests the status and error returned when a set fails.
+func TestExecError(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	t.Log("Given the need to get back the reason a set failed.")
+	{
+		qs, err := qfix.Get("basic.json")
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to retrieve the fixture : %v", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould be able to retrieve the fixture.", tests.Success)
+
+		qs.Queries[0].Commands[0] = map[string]interface{}{"$match": map[string]interface{}{"station_id": "#number:station_id"}}
+
+		qsStrData, err := json.Marshal(&qs)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to marshal the fixture : %v", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould be able to marshal the fixture.", tests.Success)
+
+		calls := []struct {
+			url  string
+			code int
+			resp string
+		}{
+			{
+				"/1.0/exec?station_id=abc",
+				400,
+				`{"error":{"code":"ParamInvalid","message":"Parameter \"abc\" is not a number","query":"Basic","command":0},"commands":[{"$match":{"station_id":"#number:station_id"}},{"$project":{"_id":0,"name":1}}]}`,
+			},
+			{
+				"/1.0/exec?station_id=abc&compat=true",
+				200,
+				`{"results":{"commands":[{"$match":{"station_id":"#number:station_id"}},{"$project":{"_id":0,"name":1}}],"error":"Parameter \"abc\" is not a number"}}`,
+			},
+		}
+
+		for _, call := range calls {
+			r := tests.NewRequest("POST", call.url, bytes.NewBuffer(qsStrData))
+			w := httptest.NewRecorder()
+
+			a.ServeHTTP(w, r)
+
+			t.Logf("\tWhen calling url : %s", call.url)
+			{
+				if w.Code != call.code {
+					t.Fatalf("\t%s\tShould get back a %d status : %v", tests.Failed, call.code, w.Code)
+				}
+				t.Logf("\t%s\tShould get back a %d status.", tests.Success, call.code)
+
+				recv := w.Body.String()
+				if call.resp != recv {
+					t.Log(call.resp)
+					t.Log(recv)
+					t.Fatalf("\t%s\tShould get the expected result.", tests.Failed)
+				}
+				t.Logf("\t%s\tShould get the expected result.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestExecRender tests the final commands of a set are rendered without
+// executing the set.
+func TestExecRender(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	t.Log("Given the need to see the final commands of a set.")
+	{
+		qs, err := qfix.Get("basic.json")
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to retrieve the fixture : %v", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould be able to retrieve the fixture.", tests.Success)
+
+		qs.Queries[0].Commands[0] = map[string]interface{}{"$match": map[string]interface{}{"station_id": "#number:station_id"}}
+
+		qsStrData, err := json.Marshal(&qs)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to marshal the fixture : %v", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould be able to marshal the fixture.", tests.Success)
+
+		url := "/1.0/exec?station_id=42021&render=true"
+		r := tests.NewRequest("POST", url, bytes.NewBuffer(qsStrData))
+		w := httptest.NewRecorder()
+
+		a.ServeHTTP(w, r)
+
+		t.Logf("\tWhen calling url : %s", url)
+		{
+			if w.Code != 200 {
+				t.Fatalf("\t%s\tShould get back a 200 status : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould get back a 200 status.", tests.Success)
+
+			resp := `{"results":[{"name":"Basic","type":"pipeline","collection":"test_xenia_data","commands":[{"$match":{"station_id":42021}},{"$project":{"_id":0,"name":1}}],"shell":"db.test_xenia_data.aggregate([{\"$match\": {\"station_id\": 42021}}, {\"$project\": {\"_id\": 0, \"name\": 1}}])"}]}`
+
+			recv := w.Body.String()
+			if resp != recv {
+				t.Log(resp)
+				t.Log(recv)
+				t.Fatalf("\t%s\tShould get the expected result.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould get the expected result.", tests.Success)
+		}
+	}
+}
+
+// TestExecExtJSON tests a set can use Extended JSON in its commands and the
+// results can be returned as Extended JSON.
+func TestExecExtJSON(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	t.Log("Given the need to keep the types of values with Extended JSON.")
+	{
+		qs, err := qfix.Get("basic.json")
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to retrieve the fixture : %v", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould be able to retrieve the fixture.", tests.Success)
+
+		qs.Queries[0].Commands = []map[string]interface{}{
+			{"$match": map[string]interface{}{"station_id": map[string]interface{}{"$numberLong": "42021"}}},
+			{"$project": map[string]interface{}{"_id": 0, "name": 1, "since": map[string]interface{}{"$literal": map[string]interface{}{"$date": "2016-06-01T00:00:00Z"}}}},
+		}
+
+		qsStrData, err := json.Marshal(&qs)
+		if err != nil {
+			t.Fatalf("\t%s\tShould be able to marshal the fixture : %v", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould be able to marshal the fixture.", tests.Success)
+
+		url := "/1.0/exec?extjson=canonical"
+		r := tests.NewRequest("POST", url, bytes.NewBuffer(qsStrData))
+		w := httptest.NewRecorder()
+
+		a.ServeHTTP(w, r)
+
+		t.Logf("\tWhen calling url : %s", url)
+		{
+			if w.Code != 200 {
+				t.Fatalf("\t%s\tShould get back a 200 status : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould get back a 200 status.", tests.Success)
+
+			resp := `{"results":[{"Name":"Basic","Docs":[{"name":"C14 - Pasco County Buoy, FL","since":{"$date":{"$numberLong":"1464739200000"}}}]}]}`
+
+			recv := w.Body.String()
+			if resp != recv {
+				t.Log(resp)
+				t.Log(recv)
+				t.Fatalf("\t%s\tShould get the expected result.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould get the expected result.", tests.Success)
+		}
+	}
+}
+
+// TestExecExport tests the results of a set can be exported as CSV and TSV.
+func TestExecExport(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	exports := []struct {
+		url     string
+		accept  string
+		columns []string
+		ctype   string
+		body    string
+	}{
+		{
+			"/1.0/exec?format=csv",
+			"",
+			[]string{"station_id", "name", "location.coordinates.0"},
+			"text/csv; charset=utf-8",
+			"station_id,name,location.coordinates.0\n42021,\"C14 - Pasco County Buoy, FL\",-83.306\n",
+		},
+		{
+			"/1.0/exec",
+			"text/tab-separated-values",
+			nil,
+			"text/tab-separated-values; charset=utf-8",
+			"location.coordinates.0\tlocation.coordinates.1\tlocation.type\tname\tstation_id\n-83.306\t28.311\tPoint\tC14 - Pasco County Buoy, FL\t42021\n",
+		},
+	}
+
+	t.Log("Given the need to export the results of a set.")
+	{
+		for _, ex := range exports {
+			qs, err := qfix.Get("basic.json")
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve the fixture : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to retrieve the fixture.", tests.Success)
+
+			qs.Queries[0].Commands[1] = map[string]interface{}{"$project": map[string]interface{}{"_id": 0, "name": 1, "station_id": 1, "location": 1}}
+			qs.Queries[0].Columns = ex.columns
+
+			qsStrData, err := json.Marshal(&qs)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to marshal the fixture : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to marshal the fixture.", tests.Success)
+
+			r := tests.NewRequest("POST", ex.url, bytes.NewBuffer(qsStrData))
+			if ex.accept != "" {
+				r.Header.Set("Accept", ex.accept)
+			}
+			w := httptest.NewRecorder()
+
+			a.ServeHTTP(w, r)
+
+			t.Logf("\tWhen calling url : %s Accept[%s]", ex.url, ex.accept)
+			{
+				if w.Code != 200 {
+					t.Fatalf("\t%s\tShould get back a 200 status : %v", tests.Failed, w.Code)
+				}
+				t.Logf("\t%s\tShould get back a 200 status.", tests.Success)
+
+				if ctype := w.Header().Get("Content-Type"); ctype != ex.ctype {
+					t.Fatalf("\t%s\tShould get back a %s content type : %s", tests.Failed, ex.ctype, ctype)
+				}
+				t.Logf("\t%s\tShould get back a %s content type.", tests.Success, ex.ctype)
+
+				if recv := w.Body.String(); recv != ex.body {
+					t.Log(ex.body)
+					t.Log(recv)
+					t.Fatalf("\t%s\tShould get the expected rows.", tests.Failed)
+				}
+				t.Logf("\t%s\tShould get the expected rows.", tests.Success)
+			}
+		}
+	}
+}
@@ -92,6 +92,40 @@ func TestQueryByName(t *testing.T) {
 	}
 }
 
+// TestQuerySchema tests the retrieval of the parameter schema of a query.
+func TestQuerySchema(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	t.Log("Given the need to get the parameter schema of a specific query.")
+	{
+		url := "/1.0/query/" + qPrefix + "_basic?schema=true"
+		r := tests.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+
+		a.ServeHTTP(w, r)
+
+		t.Logf("\tWhen calling url : %s", url)
+		{
+			if w.Code != 200 {
+				t.Fatalf("\t%s\tShould be able to retrieve the schema : %v", tests.Failed, w.Code)
+			}
+			t.Logf("\t%s\tShould be able to retrieve the schema.", tests.Success)
+
+			var sch query.Schema
+			if err := json.Unmarshal(w.Body.Bytes(), &sch); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the results : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to unmarshal the results.", tests.Success)
+
+			if sch.Title != qPrefix+"_basic" || sch.Type != "object" {
+				t.Fatalf("\t%s\tShould have the schema of the set : %+v", tests.Failed, sch)
+			}
+			t.Logf("\t%s\tShould have the schema of the set.", tests.Success)
+		}
+	}
+}
+
 // TestQueryUpsert tests the insert and update of a set.
 func TestQueryUpsert(t *testing.T) {
 	tests.ResetLog()
@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/internal/query/qfix"
+	"github.com/coralproject/xenia/internal/scheduler"
+	"github.com/coralproject/xenia/internal/snapshot"
+
+	"github.com/ardanlabs/kit/cfg"
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/tests"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestSnapshots tests the snapshots of a scheduled set can be retrieved.
+func TestSnapshots(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	db, err := db.NewMGO(tests.Context, cfg.MustString("MONGO_DB"))
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	set, err := qfix.Get("basic.json")
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to retrieve the fixture : %v", tests.Failed, err)
+	}
+	set.Schedule = &query.Schedule{Cron: "@daily"}
+
+	defer func() {
+		f := func(c *mgo.Collection) error {
+			_, err := c.RemoveAll(bson.M{"set": set.Name})
+			return err
+		}
+
+		if err := db.ExecuteMGO(tests.Context, snapshot.Collection, f); err != nil {
+			t.Fatalf("\t%s\tShould be able to remove the snapshots : %v", tests.Failed, err)
+		}
+	}()
+
+	snap, err := scheduler.Run(tests.Context, db, set, time.Now().UTC().Truncate(24*time.Hour))
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to execute the set : %v", tests.Failed, err)
+	}
+
+	urls := []struct {
+		url  string
+		code int
+	}{
+		{"/1.0/snapshot/QTEST_O_basic", 200},
+		{"/1.0/snapshot/QTEST_O_basic/latest", 200},
+		{"/1.0/snapshot/QTEST_O_basic/" + snap.ID.Hex(), 200},
+		{"/1.0/snapshot/QTEST_O_basic/12345", 400},
+		{"/1.0/snapshot/QTEST_O_basic/" + bson.NewObjectId().Hex(), 404},
+	}
+
+	t.Log("Given the need to retrieve the snapshots of a set.")
+	{
+		for _, u := range urls {
+			r := tests.NewRequest("GET", u.url, nil)
+			w := httptest.NewRecorder()
+
+			a.ServeHTTP(w, r)
+
+			t.Logf("\tWhen calling url : %s", u.url)
+			{
+				if w.Code != u.code {
+					t.Fatalf("\t%s\tShould get back a %d status : %v", tests.Failed, u.code, w.Code)
+				}
+				t.Logf("\t%s\tShould get back a %d status.", tests.Success, u.code)
+
+				if u.code != 200 {
+					continue
+				}
+
+				var ids []string
+				var snaps []snapshot.Snapshot
+				if err := json.Unmarshal(w.Body.Bytes(), &snaps); err != nil {
+					var s snapshot.Snapshot
+					if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+						t.Fatalf("\t%s\tShould be able to unmarshal the results : %v", tests.Failed, err)
+					}
+					snaps = append(snaps, s)
+				}
+
+				for _, s := range snaps {
+					ids = append(ids, s.ID.Hex())
+				}
+
+				if len(ids) != 1 || ids[0] != snap.ID.Hex() {
+					t.Fatalf("\t%s\tShould get back the snapshot : %v", tests.Failed, ids)
+				}
+				t.Logf("\t%s\tShould get back the snapshot.", tests.Success)
+			}
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Package alert evaluates rules against the results of sets and posts an
+// alert to a webhook when a rule fires.
+package alert
+
+import (
+	"errors"
+	"time"
+
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/db/mongo"
+	"github.com/ardanlabs/kit/log"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Contains the name of Mongo collections.
+const (
+	Collection           = "query_alerts"
+	CollectionDeliveries = "query_alert_deliveries"
+)
+
+// Set of error variables.
+var (
+	ErrNotFound = errors.New("Alert Not found")
+	ErrClaimed  = errors.New("Alert already evaluated")
+)
+
+// maxDeliveries is the number of deliveries returned for a rule.
+const maxDeliveries = 100
+
+// =============================================================================
+
+// Upsert is used to create or update an existing Rule document. When the rule
+// last fired and was evaluated is kept.
+func Upsert(context interface{}, db *db.DB, rule *Rule) error {
+	log.Dev(context, "Upsert", "Started : Name[%s]", rule.Name)
+
+	// Validate the rule that is provided.
+	if err := rule.Validate(); err != nil {
+		log.Error(context, "Upsert", err, "Completed")
+		return err
+	}
+
+	// Keep the state of an existing rule.
+	old, err := GetByName(context, db, rule.Name)
+	switch err {
+	case nil:
+		rule.LastFired = old.LastFired
+		rule.LastChecked = old.LastChecked
+
+	case ErrNotFound:
+		rule.LastFired = time.Time{}
+		rule.LastChecked = time.Time{}
+
+	default:
+		log.Error(context, "Upsert", err, "Completed")
+		return err
+	}
+
+	f := func(c *mgo.Collection) error {
+		q := bson.M{"name": rule.Name}
+		log.Dev(context, "Upsert", "MGO : db.%s.upsert(%s, %s)", c.Name, mongo.Query(q), mongo.Query(rule))
+		_, err := c.Upsert(q, rule)
+		return err
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		log.Error(context, "Upsert", err, "Completed")
+		return err
+	}
+
+	log.Dev(context, "Upsert", "Completed")
+	return nil
+}
+
+// GetAll retrieves the list of rules.
+func GetAll(context interface{}, db *db.DB) ([]Rule, error) {
+	log.Dev(context, "GetAll", "Started")
+
+	var rules []Rule
+	f := func(c *mgo.Collection) error {
+		log.Dev(context, "GetAll", "MGO : db.%s.find({}).sort([\"name\"])", c.Name)
+		return c.Find(nil).Sort("name").All(&rules)
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		log.Error(context, "GetAll", err, "Completed")
+		return nil, err
+	}
+
+	if rules == nil {
+		log.Error(context, "GetAll", ErrNotFound, "Completed")
+		return nil, ErrNotFound
+	}
+
+	log.Dev(context, "GetAll", "Completed : Rules[%d]", len(rules))
+	return rules, nil
+}
+
+// GetByName retrieves the document for the specified Rule.
+func GetByName(context interface{}, db *db.DB, name string) (*Rule, error) {
+	log.Dev(context, "GetByName", "Started : Name[%s]", name)
+
+	var rule Rule
+	f := func(c *mgo.Collection) error {
+		q := bson.M{"name": name}
+		log.Dev(context, "GetByName", "MGO : db.%s.findOne(%s)", c.Name, mongo.Query(q))
+		return c.Find(q).One(&rule)
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			err = ErrNotFound
+		}
+
+		log.Error(context, "GetByName", err, "Completed")
+		return nil, err
+	}
+
+	log.Dev(context, "GetByName", "Completed")
+	return &rule, nil
+}
+
+// Delete is used to remove an existing Rule document.
+func Delete(context interface{}, db *db.DB, name string) error {
+	log.Dev(context, "Delete", "Started : Name[%s]", name)
+
+	f := func(c *mgo.Collection) error {
+		q := bson.M{"name": name}
+		log.Dev(context, "Delete", "MGO : db.%s.remove(%s)", c.Name, mongo.Query(q))
+		return c.Remove(q)
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			err = ErrNotFound
+		}
+
+		log.Error(context, "Delete", err, "Completed")
+		return err
+	}
+
+	log.Dev(context, "Delete", "Completed")
+	return nil
+}
+
+// Deliveries retrieves the latest deliveries of the alerts of the rule, the
+// latest first.
+func Deliveries(context interface{}, db *db.DB, name string) ([]Delivery, error) {
+	log.Dev(context, "Deliveries", "Started : Name[%s]", name)
+
+	var dels []Delivery
+	f := func(c *mgo.Collection) error {
+		q := bson.M{"rule": name}
+		log.Dev(context, "Deliveries", "MGO : db.%s.find(%s).sort({\"fired\": -1}).limit(%d)", c.Name, mongo.Query(q), maxDeliveries)
+		return c.Find(q).Sort("-fired").Limit(maxDeliveries).All(&dels)
+	}
+
+	if err := db.ExecuteMGO(context, CollectionDeliveries, f); err != nil {
+		log.Error(context, "Deliveries", err, "Completed")
+		return nil, err
+	}
+
+	if dels == nil {
+		log.Error(context, "Deliveries", ErrNotFound, "Completed")
+		return nil, ErrNotFound
+	}
+
+	log.Dev(context, "Deliveries", "Completed : Deliveries[%d]", len(dels))
+	return dels, nil
+}
+
+// =============================================================================
+
+// Check evaluates the rule for the minute and posts an alert to its webhook
+// when it fires. The delivery is returned when the rule fired. ErrClaimed is
+// returned when the rule has already been evaluated for the minute. Retrying
+// the delivery stops when done is closed.
+func Check(context interface{}, db *db.DB, rule *Rule, now time.Time, done <-chan struct{}) (*Delivery, error) {
+	log.Dev(context, "Check", "Started : Name[%s]", rule.Name)
+
+	minute := now.UTC().Truncate(time.Minute)
+
+	// Only evaluate the rule once for the minute when there is more
+	// than one scheduler.
+	f := func(c *mgo.Collection) error {
+		q := bson.M{"name": rule.Name, "last_checked": bson.M{"$not": bson.M{"$gte": minute}}}
+		u := bson.M{"$set": bson.M{"last_checked": minute}}
+		log.Dev(context, "Check", "MGO : db.%s.update(%s, %s)", c.Name, mongo.Query(q), mongo.Query(u))
+		return c.Update(q, u)
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			err = ErrClaimed
+		}
+
+		log.Error(context, "Check", err, "Completed : Claiming rule")
+		return nil, err
+	}
+
+	if rule.cooling(now) {
+		log.Dev(context, "Check", "Completed : Cooling down")
+		return nil, nil
+	}
+
+	set, err := query.GetByName(context, db, rule.Set)
+	if err != nil {
+		log.Error(context, "Check", err, "Completed : Loading set")
+		return nil, err
+	}
+
+	// Executing the set adds the default values to the variables.
+	vars := make(map[string]string, len(rule.Vars))
+	for k, v := range rule.Vars {
+		vars[k] = v
+	}
+
+	// Rules are always evaluated against the latest results.
+	result := exec.ExecFresh(context, db, set, vars)
+	if result.Err != nil {
+		log.Error(context, "Check", result.Err, "Completed : Executing set")
+		return nil, result.Err
+	}
+
+	matches := Evaluate(rule, result)
+	if len(matches) == 0 {
+		log.Dev(context, "Check", "Completed : Not fired")
+		return nil, nil
+	}
+
+	f = func(c *mgo.Collection) error {
+		q := bson.M{"name": rule.Name}
+		u := bson.M{"$set": bson.M{"last_fired": now}}
+		log.Dev(context, "Check", "MGO : db.%s.update(%s, %s)", c.Name, mongo.Query(q), mongo.Query(u))
+		return c.Update(q, u)
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		log.Error(context, "Check", err, "Completed : Recording fired")
+		return nil, err
+	}
+
+	p := Payload{
+		Rule:       rule.Name,
+		Set:        rule.Set,
+		Query:      rule.Query,
+		Field:      rule.Field,
+		Comparator: rule.Comparator,
+		Threshold:  rule.Threshold,
+		Fired:      now.UTC(),
+		Matches:    matches,
+	}
+
+	del := Deliver(context, rule, &p, done)
+
+	f = func(c *mgo.Collection) error {
+		log.Dev(context, "Check", "MGO : db.%s.insert(%s)", c.Name, mongo.Query(del))
+		return c.Insert(del)
+	}
+
+	if err := db.ExecuteMGO(context, CollectionDeliveries, f); err != nil {
+		log.Error(context, "Check", err, "Completed : Logging delivery")
+		return del, err
+	}
+
+	log.Dev(context, "Check", "Completed : Delivered[%v] Attempts[%d]", del.Delivered, del.Attempts)
+	return del, nil
+}
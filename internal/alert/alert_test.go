@@ -0,0 +1,175 @@
+package alert_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coralproject/xenia/internal/alert"
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/internal/query/qfix"
+	"github.com/coralproject/xenia/tstdata"
+
+	"github.com/ardanlabs/kit/cfg"
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/db/mongo"
+	"github.com/ardanlabs/kit/tests"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	// Initialize the configuration and logging systems. Plus anything
+	// else the web app layer needs.
+	tests.Init("XENIA")
+
+	// Initialize MongoDB using the `tests.TestSession` as the name of the
+	// master session.
+	cfg := mongo.Config{
+		Host:     cfg.MustString("MONGO_HOST"),
+		AuthDB:   cfg.MustString("MONGO_AUTHDB"),
+		DB:       cfg.MustString("MONGO_DB"),
+		User:     cfg.MustString("MONGO_USER"),
+		Password: cfg.MustString("MONGO_PASS"),
+	}
+	tests.InitMongo(cfg)
+}
+
+//==============================================================================
+
+// TestCheck tests a rule fires once per minute, posts the alert to the webhook
+// and is not evaluated during its cooldown.
+func TestCheck(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	db, err := db.NewMGO(tests.Context, tests.TestSession)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	if err := tstdata.Generate(db); err != nil {
+		t.Fatalf("\t%s\tShould be able to load the test data : %v", tests.Failed, err)
+	}
+	defer tstdata.Drop(db)
+
+	set := query.Set{
+		Name:    "QTEST_O_alert",
+		Enabled: true,
+		Queries: []query.Query{
+			{
+				Name:       "Station",
+				Type:       query.TypePipeline,
+				Collection: tstdata.CollectionExecTest,
+				Return:     true,
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"station_id": "42021"}},
+					{"$project": map[string]interface{}{"_id": 0, "name": 1, "location": 1}},
+				},
+			},
+		},
+	}
+
+	if err := qfix.Add(db, &set); err != nil {
+		t.Fatalf("\t%s\tShould be able to add the set : %v", tests.Failed, err)
+	}
+	defer qfix.Remove(db, set.Name)
+
+	// Stand in for the webhook recording the alerts posted.
+	var mu sync.Mutex
+	var posted []alert.Payload
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p alert.Payload
+		json.NewDecoder(r.Body).Decode(&p)
+
+		mu.Lock()
+		posted = append(posted, p)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	sent := func() []alert.Payload {
+		mu.Lock()
+		defer mu.Unlock()
+		return posted
+	}
+
+	rule := alert.Rule{
+		Name:       "ATEST_latitude",
+		Enabled:    true,
+		Cron:       "* * * * *",
+		Set:        set.Name,
+		Field:      "location.coordinates.1",
+		Comparator: alert.CmpGT,
+		Threshold:  28,
+		Cooldown:   "1h",
+		Webhook:    srv.URL,
+	}
+
+	if err := alert.Upsert(tests.Context, db, &rule); err != nil {
+		t.Fatalf("\t%s\tShould be able to add the rule : %v", tests.Failed, err)
+	}
+
+	defer func() {
+		alert.Delete(tests.Context, db, rule.Name)
+
+		f := func(c *mgo.Collection) error {
+			_, err := c.RemoveAll(bson.M{"rule": rule.Name})
+			return err
+		}
+		db.ExecuteMGO(tests.Context, alert.CollectionDeliveries, f)
+	}()
+
+	now := time.Now().UTC()
+
+	t.Log("Given the need to alert when a field crosses a threshold.")
+	{
+		t.Log("\tWhen the rule is evaluated")
+		{
+			del, err := alert.Check(tests.Context, db, &rule, now, nil)
+			if err != nil || del == nil {
+				t.Fatalf("\t%s\tShould fire the rule : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould fire the rule.", tests.Success)
+
+			got := sent()
+			if !del.Delivered || len(got) != 1 || len(got[0].Matches) != 1 || got[0].Matches[0].Value != 28.311 {
+				t.Fatalf("\t%s\tShould post the alert to the webhook : %+v", tests.Failed, got)
+			}
+			t.Logf("\t%s\tShould post the alert to the webhook.", tests.Success)
+
+			dels, err := alert.Deliveries(tests.Context, db, rule.Name)
+			if err != nil || len(dels) != 1 {
+				t.Fatalf("\t%s\tShould log the delivery : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould log the delivery.", tests.Success)
+		}
+
+		t.Log("\tWhen the rule is evaluated again for the same minute")
+		{
+			if _, err := alert.Check(tests.Context, db, &rule, now, nil); err != alert.ErrClaimed {
+				t.Fatalf("\t%s\tShould find the rule already evaluated : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould find the rule already evaluated.", tests.Success)
+		}
+
+		t.Log("\tWhen the rule is evaluated during its cooldown")
+		{
+			fired, err := alert.GetByName(tests.Context, db, rule.Name)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to retrieve the rule : %v", tests.Failed, err)
+			}
+
+			del, err := alert.Check(tests.Context, db, fired, now.Add(time.Minute), nil)
+			if err != nil || del != nil || len(sent()) != 1 {
+				t.Fatalf("\t%s\tShould not fire the rule : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould not fire the rule.", tests.Success)
+		}
+	}
+}
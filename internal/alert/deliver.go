@@ -0,0 +1,169 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// client posts the alerts to the webhooks.
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// retryWait is how long to wait before the first retry of a failed delivery.
+// The wait doubles for each retry after that up to maxRetryWait.
+var (
+	retryWait    = time.Second
+	maxRetryWait = time.Minute
+)
+
+// =============================================================================
+
+// Evaluate returns the documents of the query in the result whose field
+// crossed the threshold of the rule. Documents without a number in the field
+// never match.
+func Evaluate(rule *Rule, result *query.Result) []Match {
+	docs, ok := exec.QueryDocs(result, rule.Query)
+	if !ok {
+		return nil
+	}
+
+	var matches []Match
+	for _, doc := range docs {
+		v, ok := exec.FieldValue(doc, rule.Field)
+		if !ok {
+			continue
+		}
+
+		n, ok := number(v)
+		if !ok || !compare(n, rule.Comparator, rule.Threshold) {
+			continue
+		}
+
+		matches = append(matches, Match{Value: n, Doc: doc})
+	}
+
+	return matches
+}
+
+// Deliver posts the alert to the webhook of the rule retrying when the post
+// fails or the webhook does not accept it. The retries stop when done is
+// closed.
+func Deliver(context interface{}, rule *Rule, p *Payload, done <-chan struct{}) *Delivery {
+	log.Dev(context, "Deliver", "Started : Name[%s] Webhook[%s]", rule.Name, rule.Webhook)
+
+	del := Delivery{
+		ID:      bson.NewObjectId(),
+		Rule:    rule.Name,
+		Webhook: rule.Webhook,
+		Fired:   p.Fired,
+		Matches: len(p.Matches),
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		del.Error = err.Error()
+		log.Error(context, "Deliver", err, "Completed : Encoding payload")
+		return &del
+	}
+
+	wait := retryWait
+	for {
+		del.Attempts++
+
+		del.Status, err = post(rule.Webhook, data)
+		if err == nil {
+			del.Delivered = true
+			del.Error = ""
+			break
+		}
+
+		del.Error = err.Error()
+		log.Error(context, "Deliver", err, "Attempt[%d]", del.Attempts)
+
+		if del.Attempts > rule.retries() {
+			break
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-done:
+			timer.Stop()
+			log.Dev(context, "Deliver", "Completed : Stopped : Attempts[%d]", del.Attempts)
+			return &del
+
+		case <-timer.C:
+		}
+
+		if wait *= 2; wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+	}
+
+	log.Dev(context, "Deliver", "Completed : Delivered[%v] Attempts[%d]", del.Delivered, del.Attempts)
+	return &del
+}
+
+// post posts the payload to the webhook and returns the status it replied
+// with. Any status other than a 2xx is an error.
+func post(webhook string, data []byte) (int, error) {
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Webhook replied with %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// =============================================================================
+
+// number returns the value of the field as a number.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// compare reports if the value compares to the threshold.
+func compare(v float64, cmp string, threshold float64) bool {
+	switch cmp {
+	case CmpGT:
+		return v > threshold
+	case CmpGTE:
+		return v >= threshold
+	case CmpLT:
+		return v < threshold
+	case CmpLTE:
+		return v <= threshold
+	case CmpEQ:
+		return v == threshold
+	case CmpNE:
+		return v != threshold
+	}
+
+	return false
+}
@@ -0,0 +1,161 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestDeliver tests alerts are posted to the webhook and retried when the
+// webhook fails.
+func TestDeliver(t *testing.T) {
+	retryWait = time.Millisecond
+
+	retries := func(n int) *int {
+		return &n
+	}
+
+	deliveries := []struct {
+		fails     int
+		retries   *int
+		attempts  int
+		delivered bool
+	}{
+		{0, nil, 1, true},
+		{2, nil, 3, true},
+		{4, nil, 4, false},
+		{1, retries(0), 1, false},
+		{3, retries(2), 3, false},
+	}
+
+	t.Log("Given the need to post alerts to a webhook.")
+	{
+		for _, tt := range deliveries {
+			t.Logf("\tWhen the webhook fails %d times and the rule retries %d times", tt.fails, (&Rule{Retries: tt.retries}).retries())
+			{
+				var calls int
+				var got Payload
+
+				// Stand in for the webhook failing the first calls.
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					calls++
+					if calls <= tt.fails {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+
+					json.NewDecoder(r.Body).Decode(&got)
+					w.WriteHeader(http.StatusNoContent)
+				}))
+
+				rule := Rule{Name: "ATEST_deliver", Webhook: srv.URL, Retries: tt.retries}
+				p := Payload{Rule: rule.Name, Field: "count", Matches: []Match{{Value: 5}}}
+
+				del := Deliver(tests.Context, &rule, &p, nil)
+				srv.Close()
+
+				if del.Attempts != tt.attempts || del.Delivered != tt.delivered {
+					t.Fatalf("\t%s\tShould make %d attempts and be delivered[%v] : %d %v %s", tests.Failed, tt.attempts, tt.delivered, del.Attempts, del.Delivered, del.Error)
+				}
+				t.Logf("\t%s\tShould make %d attempts and be delivered[%v].", tests.Success, tt.attempts, tt.delivered)
+
+				if tt.delivered && (got.Rule != rule.Name || len(got.Matches) != 1) {
+					t.Fatalf("\t%s\tShould post the payload : %+v", tests.Failed, got)
+				}
+
+				if !tt.delivered && del.Status != http.StatusServiceUnavailable {
+					t.Fatalf("\t%s\tShould record the status of the last attempt : %d", tests.Failed, del.Status)
+				}
+				t.Logf("\t%s\tShould record the outcome of the last attempt.", tests.Success)
+			}
+		}
+
+		t.Log("\tWhen the retries are stopped")
+		{
+			retryWait = time.Hour
+			defer func() { retryWait = time.Millisecond }()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer srv.Close()
+
+			done := make(chan struct{})
+			time.AfterFunc(10*time.Millisecond, func() { close(done) })
+
+			rule := Rule{Name: "ATEST_deliver", Webhook: srv.URL, Retries: retries(MaxRetries)}
+			p := Payload{Rule: rule.Name, Field: "count", Matches: []Match{{Value: 5}}}
+
+			del := Deliver(tests.Context, &rule, &p, done)
+			if del.Attempts != 1 || del.Delivered {
+				t.Fatalf("\t%s\tShould stop retrying : %d %v", tests.Failed, del.Attempts, del.Delivered)
+			}
+			t.Logf("\t%s\tShould stop retrying.", tests.Success)
+		}
+	}
+}
+
+// TestRetries tests the retries of a rule are limited.
+func TestRetries(t *testing.T) {
+	rules := []struct {
+		retries int
+		valid   bool
+	}{
+		{0, true},
+		{MaxRetries, true},
+		{MaxRetries + 1, false},
+		{-1, false},
+	}
+
+	t.Log("Given the need to limit the retries of a rule.")
+	{
+		for _, tt := range rules {
+			t.Logf("\tWhen the rule retries %d times", tt.retries)
+			{
+				n := tt.retries
+				rule := Rule{Name: "ATEST_retries", Cron: "* * * * *", Set: "set", Field: "count", Comparator: CmpGT, Webhook: "http://localhost/alert", Retries: &n}
+
+				if err := rule.Validate(); (err == nil) != tt.valid {
+					t.Fatalf("\t%s\tShould validate the rule as valid[%v] : %v", tests.Failed, tt.valid, err)
+				}
+				t.Logf("\t%s\tShould validate the rule as valid[%v].", tests.Success, tt.valid)
+			}
+		}
+	}
+}
+
+// TestCompare tests the values of fields are compared to the threshold.
+func TestCompare(t *testing.T) {
+	compares := []struct {
+		value interface{}
+		cmp   string
+		match bool
+	}{
+		{11, CmpGT, true},
+		{int64(10), CmpGT, false},
+		{10.0, CmpGTE, true},
+		{int32(9), CmpLT, true},
+		{10, CmpLTE, true},
+		{json.Number("10"), CmpEQ, true},
+		{10, CmpNE, false},
+		{"11", CmpGT, false},
+	}
+
+	t.Log("Given the need to compare fields to a threshold of 10.")
+	{
+		for _, tt := range compares {
+			t.Logf("\tWhen comparing %v with %s", tt.value, tt.cmp)
+			{
+				n, ok := number(tt.value)
+				if match := ok && compare(n, tt.cmp, 10); match != tt.match {
+					t.Fatalf("\t%s\tShould match[%v] : %v", tests.Failed, tt.match, match)
+				}
+				t.Logf("\t%s\tShould match[%v].", tests.Success, tt.match)
+			}
+		}
+	}
+}
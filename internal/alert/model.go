@@ -0,0 +1,146 @@
+package alert
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"gopkg.in/bluesuncorp/validator.v8"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Set of comparators a rule can use against its threshold.
+const (
+	CmpGT  = "gt"
+	CmpGTE = "gte"
+	CmpLT  = "lt"
+	CmpLTE = "lte"
+	CmpEQ  = "eq"
+	CmpNE  = "ne"
+)
+
+// Set of limits for retrying failed deliveries.
+const (
+	DefaultRetries = 3  // Times a failed delivery is retried when the rule does not say.
+	MaxRetries     = 10 // Most times a rule can retry a failed delivery.
+)
+
+// validate is used to perform model field validation.
+var validate *validator.Validate
+
+func init() {
+	validate = validator.New(&validator.Config{TagName: "validate"})
+}
+
+//==============================================================================
+
+// Rule fires an alert when a field in the results of a set crosses a
+// threshold. The set is executed on the cron schedule of the rule and the
+// alert is posted to the webhook.
+type Rule struct {
+	Name        string            `bson:"name" json:"name" validate:"required,min=3"`   // Unique name per rule.
+	Description string            `bson:"desc,omitempty" json:"desc,omitempty"`         // Description of the rule.
+	Enabled     bool              `bson:"enabled" json:"enabled"`                       // If the rule is evaluated.
+	Cron        string            `bson:"cron" json:"cron" validate:"required"`         // When the rule is evaluated, see query.Schedule.
+	Set         string            `bson:"set" json:"set" validate:"required"`           // Name of the set to execute.
+	Vars        map[string]string `bson:"vars,omitempty" json:"vars,omitempty"`         // Variables to execute the set with.
+	Query       string            `bson:"query,omitempty" json:"query,omitempty"`       // Query whose documents are checked, the first one returned when not set.
+	Field       string            `bson:"field" json:"field" validate:"required"`       // Dot path of the field checked in each document.
+	Comparator  string            `bson:"cmp" json:"cmp" validate:"required"`           // How the field is compared to the threshold, CmpGT...
+	Threshold   float64           `bson:"threshold" json:"threshold"`                   // Value the field is compared to.
+	Cooldown    string            `bson:"cooldown,omitempty" json:"cooldown,omitempty"` // How long after firing the rule is not evaluated, "1h".
+	Webhook     string            `bson:"webhook" json:"webhook" validate:"required"`   // URL the alert is posted to.
+	Retries     *int              `bson:"retries,omitempty" json:"retries,omitempty"`   // Times a failed delivery is retried up to MaxRetries, DefaultRetries when not set and 0 for none.
+	LastFired   time.Time         `bson:"last_fired,omitempty" json:"last_fired"`       // When the rule last fired.
+	LastChecked time.Time         `bson:"last_checked,omitempty" json:"last_checked"`   // Minute the rule was last evaluated.
+}
+
+// Validate checks the rule value for consistency.
+func (r *Rule) Validate() error {
+	if err := validate.Struct(r); err != nil {
+		return err
+	}
+
+	if err := query.ValidateCron(r.Cron); err != nil {
+		return err
+	}
+
+	switch r.Comparator {
+	case CmpGT, CmpGTE, CmpLT, CmpLTE, CmpEQ, CmpNE:
+	default:
+		return fmt.Errorf("Invalid comparator %q", r.Comparator)
+	}
+
+	if r.Cooldown != "" {
+		if d, err := time.ParseDuration(r.Cooldown); err != nil || d < 0 {
+			return fmt.Errorf("Invalid cooldown %q", r.Cooldown)
+		}
+	}
+
+	if u, err := url.Parse(r.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid webhook %q", r.Webhook)
+	}
+
+	if r.Retries != nil && (*r.Retries < 0 || *r.Retries > MaxRetries) {
+		return fmt.Errorf("Invalid retries %d", *r.Retries)
+	}
+
+	return nil
+}
+
+// cooling reports if the rule fired within its cooldown of the time.
+func (r *Rule) cooling(now time.Time) bool {
+	if r.Cooldown == "" || r.LastFired.IsZero() {
+		return false
+	}
+
+	// The cooldown was checked when the rule was validated.
+	d, _ := time.ParseDuration(r.Cooldown)
+
+	return now.Before(r.LastFired.Add(d))
+}
+
+// retries returns the number of times a failed delivery is retried. Retries
+// are turned off by setting them to 0.
+func (r *Rule) retries() int {
+	if r.Retries == nil {
+		return DefaultRetries
+	}
+
+	return *r.Retries
+}
+
+//==============================================================================
+
+// Match is a document whose field crossed the threshold of the rule.
+type Match struct {
+	Value float64 `json:"value"`
+	Doc   bson.M  `json:"doc"`
+}
+
+// Payload is the JSON document posted to the webhook of a rule that fired.
+type Payload struct {
+	Rule       string    `json:"rule"`
+	Set        string    `json:"set"`
+	Query      string    `json:"query,omitempty"`
+	Field      string    `json:"field"`
+	Comparator string    `json:"cmp"`
+	Threshold  float64   `json:"threshold"`
+	Fired      time.Time `json:"fired"`
+	Matches    []Match   `json:"matches"`
+}
+
+// Delivery records the posting of an alert to the webhook of a rule.
+type Delivery struct {
+	ID        bson.ObjectId `bson:"_id" json:"id"`
+	Rule      string        `bson:"rule" json:"rule"`
+	Webhook   string        `bson:"webhook" json:"webhook"`
+	Fired     time.Time     `bson:"fired" json:"fired"`
+	Matches   int           `bson:"matches" json:"matches"`                 // Number of documents that crossed the threshold.
+	Attempts  int           `bson:"attempts" json:"attempts"`               // Number of times the alert was posted.
+	Status    int           `bson:"status,omitempty" json:"status"`         // HTTP status of the last attempt.
+	Delivered bool          `bson:"delivered" json:"delivered"`             // The webhook accepted the alert.
+	Error     string        `bson:"error,omitempty" json:"error,omitempty"` // Why the last attempt failed.
+}
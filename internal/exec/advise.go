@@ -0,0 +1,536 @@
+package exec
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Advice contains the index advice for the queries of a set.
+type Advice struct {
+	Set     string        `json:"set"`
+	Queries []QueryAdvice `json:"queries"`
+	Unused  []UnusedIndex `json:"unused,omitempty"` // Declared indexes no query of the set uses.
+}
+
+// QueryAdvice contains the index advice for a single query.
+type QueryAdvice struct {
+	Name         string       `json:"name"`
+	Collection   string       `json:"collection"`
+	Equality     []string     `json:"equality,omitempty"`  // Fields the leading stages match on a value.
+	Sort         []string     `json:"sort,omitempty"`      // Fields the leading stages sort on, "-field" for descending.
+	Range        []string     `json:"range,omitempty"`     // Fields the leading stages match on a range.
+	Explained    bool         `json:"explained"`           // The advice includes the explain output.
+	CollScan     bool         `json:"collscan"`            // The winning plan scans the whole collection.
+	InMemorySort bool         `json:"in_memory_sort"`      // The documents are sorted without an index.
+	Indexes      []string     `json:"indexes,omitempty"`   // Names of the indexes the winning plan uses.
+	Suggested    *query.Index `json:"suggested,omitempty"` // Index to declare for the query.
+	Notes        []string     `json:"notes,omitempty"`
+}
+
+// UnusedIndex is a declared index no query of the set uses.
+type UnusedIndex struct {
+	Query      string      `json:"query"` // Query declaring the index.
+	Collection string      `json:"collection"`
+	Index      query.Index `json:"index"`
+}
+
+// rangeOps are the match operators that select a range of values.
+var rangeOps = map[string]bool{
+	"$gt": true, "$gte": true, "$lt": true, "$lte": true,
+	"$ne": true, "$nin": true, "$regex": true, "$exists": true, "$not": true,
+}
+
+//==============================================================================
+
+// Advise analyzes the leading $match and $sort stages of each query in the set
+// and suggests the indexes the queries need. When the variables satisfy the
+// parameters, the queries are explained to find collection scans and sorts
+// done in memory. Queries looking up saved data are not explained.
+func Advise(context interface{}, db *db.DB, set *query.Set, vars map[string]string) (*Advice, error) {
+	log.Dev(context, "Advise", "Started : Name[%s]", set.Name)
+
+	// If we have been provided a nil map, make one.
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+
+	// Validate the set that is provided.
+	if err := set.Validate(); err != nil {
+		log.Error(context, "Advise", err, "Completed : Validating set")
+		return nil, newError(CodeSetInvalid, err)
+	}
+
+	// The queries are changed by adding the scripts.
+	set.Queries = append([]query.Query(nil), set.Queries...)
+	if err := loadScripts(context, db, set); err != nil {
+		log.Error(context, "Advise", err, "Completed : Loading scripts")
+		return nil, err
+	}
+
+	if err := decodeExtJSON(set); err != nil {
+		log.Error(context, "Advise", err, "Completed : Decoding Extended JSON")
+		return nil, err
+	}
+
+	// The queries can only be explained with all the parameters.
+	paramErr := processParams(context, db, set, vars)
+
+	adv := Advice{
+		Set:     set.Name,
+		Queries: []QueryAdvice{},
+	}
+
+	for _, q := range set.Queries {
+
+		// Set queries are advised on through their own set.
+		if q.Type == query.TypeSet {
+			continue
+		}
+
+		qa := analyzeQuery(&q)
+
+		switch {
+		case paramErr != nil:
+			qa.Notes = append(qa.Notes, "Not explained : "+paramErr.Error())
+
+		default:
+			if err := explainQuery(context, db, &q, vars, &qa); err != nil {
+				qa.Notes = append(qa.Notes, "Not explained : "+err.Error())
+			}
+		}
+
+		adv.Queries = append(adv.Queries, qa)
+	}
+
+	declared := declaredIndexes(set)
+	for i := range adv.Queries {
+		suggest(&adv.Queries[i], declared)
+	}
+
+	adv.Unused = unusedIndexes(adv.Queries, declared)
+
+	log.Dev(context, "Advise", "Completed")
+	return &adv, nil
+}
+
+//==============================================================================
+
+// analyzeQuery collects the fields the leading $match and $sort stages of the
+// query use. Every $match and $sort command of the other query types is used.
+func analyzeQuery(q *query.Query) QueryAdvice {
+	qa := QueryAdvice{
+		Name:       q.Name,
+		Collection: q.Collection,
+	}
+
+	eq := make(map[string]bool)
+	rng := make(map[string]bool)
+
+leading:
+	for _, command := range q.Commands {
+		for op, v := range command {
+			switch op {
+			case "$match":
+				if doc, ok := document(v); ok {
+					matchFields(doc, eq, rng, &qa)
+				}
+				continue
+
+			case "$sort":
+				qa.Sort = append(qa.Sort, adviseSort(v, q.Type, &qa)...)
+				continue
+
+			case "$save":
+				continue
+			}
+
+			// A pipeline can only use an index for its leading stages.
+			if q.Type == query.TypePipeline {
+				break leading
+			}
+		}
+	}
+
+	qa.Equality = sortedKeys(eq)
+
+	for _, fld := range sortedKeys(rng) {
+		if !eq[fld] {
+			qa.Range = append(qa.Range, fld)
+		}
+	}
+
+	return qa
+}
+
+// matchFields adds the fields of the $match document to the fields matched on
+// a value or a range.
+func matchFields(match map[string]interface{}, eq map[string]bool, rng map[string]bool, qa *QueryAdvice) {
+	for _, fld := range sortedKeys(bson.M(match)) {
+		v := match[fld]
+
+		switch fld {
+		case "$and":
+			if list, ok := v.([]interface{}); ok {
+				for _, item := range list {
+					if doc, ok := document(item); ok {
+						matchFields(doc, eq, rng, qa)
+					}
+				}
+			}
+			continue
+
+		case "$or", "$nor":
+			qa.Notes = append(qa.Notes, fmt.Sprintf("The fields of %s need an index for each branch", fld))
+			continue
+		}
+
+		// Other top level operators like $text can't be advised on.
+		if strings.HasPrefix(fld, "$") {
+			qa.Notes = append(qa.Notes, fmt.Sprintf("The %s operator is not advised on", fld))
+			continue
+		}
+
+		if isRange(v) {
+			rng[fld] = true
+			continue
+		}
+
+		eq[fld] = true
+	}
+}
+
+// isRange reports if the match value selects a range of values.
+func isRange(v interface{}) bool {
+	switch mv := v.(type) {
+	case bson.RegEx:
+		return true
+
+	case string:
+		return strings.HasPrefix(mv, "#regex")
+	}
+
+	doc, ok := document(v)
+	if !ok {
+		return false
+	}
+
+	for op := range doc {
+		if rangeOps[op] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// adviseSort returns the fields of the $sort command, "-field" for descending.
+// Only find queries can sort on an array of fields.
+func adviseSort(v interface{}, typ string, qa *QueryAdvice) []string {
+	if fields, ok := sortFields(v); ok {
+		return fields
+	}
+
+	// The order of the fields in a document is not kept.
+	doc, ok := document(v)
+	if !ok {
+		return nil
+	}
+
+	note := "The order of the fields of a $sort document is not kept"
+	switch typ {
+	case query.TypeFind:
+		note += ", use an array of fields"
+	default:
+		note += ", the suggested index may not match the sort"
+	}
+	qa.Notes = append(qa.Notes, note)
+
+	var fields []string
+	for _, fld := range sortedKeys(doc) {
+		if dir, err := sortDir(doc[fld]); err == nil && dir == -1 {
+			fld = "-" + fld
+		}
+		fields = append(fields, fld)
+	}
+
+	return fields
+}
+
+//==============================================================================
+
+// explainQuery explains the query and adds what the winning plan does to the
+// advice.
+func explainQuery(context interface{}, db *db.DB, q *query.Query, vars map[string]string, qa *QueryAdvice) error {
+	q.Commands = copyCommands(q.Commands)
+
+	// Queries looking up the results of other queries can't be explained.
+	unresolved := make(map[string]bool)
+	for _, command := range q.Commands {
+		markUnresolved(command, unresolved)
+	}
+
+	if len(unresolved) > 0 {
+		return fmt.Errorf("Query looks up %s", strings.Join(sortedKeys(unresolved), ", "))
+	}
+
+	var f func(c *mgo.Collection) ([]bson.M, error)
+	timeout := queryTimeout(context, q)
+
+	switch strings.ToLower(q.Type) {
+	case query.TypePipeline:
+		p, err := buildPipeline(context, q, vars, nil)
+		if err != nil {
+			return err
+		}
+
+		f = func(c *mgo.Collection) ([]bson.M, error) {
+			var m bson.M
+			err := c.Pipe(p.stages).Explain(&m)
+			return []bson.M{m}, err
+		}
+
+	case query.TypeFind, query.TypeCount, query.TypeDistinct:
+		_, fq, err := buildFind(context, q, vars, nil)
+		if err != nil {
+			return err
+		}
+
+		f = func(c *mgo.Collection) ([]bson.M, error) {
+			switch strings.ToLower(q.Type) {
+			case query.TypeCount:
+				return fq.count(c, timeout, true)
+			case query.TypeDistinct:
+				return fq.distinct(c, timeout, true)
+			}
+			return fq.find(c, timeout, opTag(), true)
+		}
+	}
+
+	var explain []bson.M
+	mf := func(c *mgo.Collection) error {
+		var err error
+		explain, err = f(c)
+		return err
+	}
+
+	if err := db.ExecuteMGOTimeout(context, timeout, q.Collection, mf); err != nil {
+		return err
+	}
+
+	for _, m := range explain {
+		readExplain(m, qa)
+	}
+
+	qa.Explained = true
+	return nil
+}
+
+// readExplain walks the explain output looking at the stages of the winning
+// plans and the stages of the pipeline.
+func readExplain(v interface{}, qa *QueryAdvice) {
+	switch ev := v.(type) {
+	case bson.M:
+		for k, sub := range ev {
+			switch k {
+			case "winningPlan":
+				readPlan(sub, qa)
+
+			case "$sort":
+				qa.InMemorySort = true
+
+			default:
+				readExplain(sub, qa)
+			}
+		}
+
+	case map[string]interface{}:
+		readExplain(bson.M(ev), qa)
+
+	case []interface{}:
+		for _, sub := range ev {
+			readExplain(sub, qa)
+		}
+	}
+}
+
+// readPlan walks the stages of a winning plan.
+func readPlan(v interface{}, qa *QueryAdvice) {
+	plan, ok := v.(bson.M)
+	if !ok {
+		return
+	}
+
+	switch plan["stage"] {
+	case "COLLSCAN":
+		qa.CollScan = true
+
+	case "SORT":
+		qa.InMemorySort = true
+
+	case "IXSCAN":
+		if name, ok := plan["indexName"].(string); ok && !inEnum(qa.Indexes, name) {
+			qa.Indexes = append(qa.Indexes, name)
+		}
+	}
+
+	readPlan(plan["inputStage"], qa)
+
+	if stages, ok := plan["inputStages"].([]interface{}); ok {
+		for _, stage := range stages {
+			readPlan(stage, qa)
+		}
+	}
+}
+
+//==============================================================================
+
+// declaredIndex is an index declared by a query of the set.
+type declaredIndex struct {
+	query      string
+	collection string
+	index      query.Index
+}
+
+// declaredIndexes returns the indexes declared by the queries of the set.
+func declaredIndexes(set *query.Set) []declaredIndex {
+	var declared []declaredIndex
+	for _, q := range set.Queries {
+		for _, idx := range q.Indexes {
+			declared = append(declared, declaredIndex{q.Name, q.Collection, idx})
+		}
+	}
+
+	return declared
+}
+
+// suggest adds the index the query needs when it does not use one already.
+// The fields matched on a value come first, then the sort fields and then
+// the fields matched on a range.
+func suggest(qa *QueryAdvice, declared []declaredIndex) {
+	var key []string
+	seen := make(map[string]bool)
+
+	for _, fields := range [][]string{qa.Equality, qa.Sort, qa.Range} {
+		for _, fld := range fields {
+			if name := strings.TrimPrefix(fld, "-"); !seen[name] {
+				seen[name] = true
+				key = append(key, fld)
+			}
+		}
+	}
+
+	if len(key) == 0 {
+		return
+	}
+
+	// When explained, trust the plan. Otherwise look for a declared index
+	// the query could use.
+	if qa.Explained {
+		if !qa.CollScan && !qa.InMemorySort {
+			return
+		}
+	} else {
+		for _, d := range declared {
+			if d.collection == qa.Collection && mayUse(qa, d.index) {
+				return
+			}
+		}
+	}
+
+	idx := query.Index{Key: key}
+	qa.Suggested = &idx
+
+	for _, d := range declared {
+		if d.collection == qa.Collection && indexName(d.index) == indexName(idx) {
+			qa.Notes = append(qa.Notes, fmt.Sprintf("Index %s is declared but not used, make sure it has been created", indexName(idx)))
+		}
+	}
+}
+
+// unusedIndexes returns the declared indexes no query uses.
+func unusedIndexes(queries []QueryAdvice, declared []declaredIndex) []UnusedIndex {
+	var unused []UnusedIndex
+
+next:
+	for _, d := range declared {
+		for i := range queries {
+			qa := &queries[i]
+			if qa.Collection != d.collection {
+				continue
+			}
+
+			if qa.Explained && inEnum(qa.Indexes, indexName(d.index)) {
+				continue next
+			}
+
+			if !qa.Explained && mayUse(qa, d.index) {
+				continue next
+			}
+		}
+
+		unused = append(unused, UnusedIndex{d.query, d.collection, d.index})
+	}
+
+	return unused
+}
+
+// mayUse reports if the query could use the index because the first field of
+// the index is one the query matches or sorts on.
+func mayUse(qa *QueryAdvice, idx query.Index) bool {
+	if len(idx.Key) == 0 {
+		return false
+	}
+
+	first := strings.TrimPrefix(idx.Key[0], "-")
+	for _, fields := range [][]string{qa.Equality, qa.Sort, qa.Range} {
+		for _, fld := range fields {
+			if strings.TrimPrefix(fld, "-") == first {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// indexName returns the name Mongo gives the index, "a_1_b_-1".
+func indexName(idx query.Index) string {
+	parts := make([]string, len(idx.Key))
+	for i, fld := range idx.Key {
+		dir := 1
+		if strings.HasPrefix(fld, "-") {
+			fld, dir = fld[1:], -1
+		}
+		parts[i] = fld + "_" + strconv.Itoa(dir)
+	}
+
+	return strings.Join(parts, "_")
+}
+
+// sortedKeys returns the keys of the map in order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+
+	switch mv := m.(type) {
+	case map[string]bool:
+		for k := range mv {
+			keys = append(keys, k)
+		}
+	case bson.M:
+		for k := range mv {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
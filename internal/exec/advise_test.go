@@ -0,0 +1,150 @@
+package exec
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestAdviseQuery tests the fields of the leading stages are found and the
+// index the query needs is suggested.
+func TestAdviseQuery(t *testing.T) {
+	queries := []struct {
+		q       query.Query
+		explain bson.M
+		key     []string
+	}{
+		{
+			query.Query{
+				Name:       "Pipeline",
+				Type:       query.TypePipeline,
+				Collection: "comments",
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"status": "#string:status", "date": map[string]interface{}{"$gte": "#date:from"}}},
+					{"$sort": map[string]interface{}{"date": -1}},
+					{"$project": map[string]interface{}{"body": 1}},
+					{"$match": map[string]interface{}{"body": "#string:body"}},
+				},
+			},
+			nil,
+			[]string{"status", "-date"},
+		},
+		{
+			query.Query{
+				Name:       "Find",
+				Type:       query.TypeFind,
+				Collection: "comments",
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"$and": []interface{}{
+						map[string]interface{}{"asset_id": "#objid:asset"},
+						map[string]interface{}{"likes": map[string]interface{}{"$gt": 5}},
+					}}},
+					{"$sort": []interface{}{"-date", "user_id"}},
+				},
+			},
+			bson.M{"queryPlanner": bson.M{"winningPlan": bson.M{"stage": "FETCH", "inputStage": bson.M{"stage": "COLLSCAN"}}}},
+			[]string{"asset_id", "-date", "user_id", "likes"},
+		},
+		{
+			query.Query{
+				Name:       "Indexed",
+				Type:       query.TypeFind,
+				Collection: "comments",
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"user_id": "#objid:user"}},
+				},
+			},
+			bson.M{"queryPlanner": bson.M{"winningPlan": bson.M{"stage": "FETCH", "inputStage": bson.M{"stage": "IXSCAN", "indexName": "user_id_1"}}}},
+			nil,
+		},
+	}
+
+	t.Log("Given the need to advise on the indexes of queries.")
+	{
+		for _, tt := range queries {
+			t.Logf("\tWhen advising on the %s query", tt.q.Name)
+			{
+				qa := analyzeQuery(&tt.q)
+				if tt.explain != nil {
+					readExplain(tt.explain, &qa)
+					qa.Explained = true
+				}
+
+				suggest(&qa, nil)
+
+				var key []string
+				if qa.Suggested != nil {
+					key = qa.Suggested.Key
+				}
+
+				if !reflect.DeepEqual(key, tt.key) {
+					t.Fatalf("\t%s\tShould suggest the index %v : %v", tests.Failed, tt.key, key)
+				}
+				t.Logf("\t%s\tShould suggest the index %v.", tests.Success, tt.key)
+			}
+		}
+	}
+}
+
+// TestAdviseSort tests the note on a $sort document with several fields only
+// suggests an array of fields for find queries.
+func TestAdviseSort(t *testing.T) {
+	sorts := []struct {
+		typ  string
+		note string
+	}{
+		{query.TypeFind, "The order of the fields of a $sort document is not kept, use an array of fields"},
+		{query.TypePipeline, "The order of the fields of a $sort document is not kept, the suggested index may not match the sort"},
+	}
+
+	t.Log("Given the need to advise on a $sort document with several fields.")
+	{
+		for _, tt := range sorts {
+			t.Logf("\tWhen advising on a %s query", tt.typ)
+			{
+				var qa QueryAdvice
+				fields := adviseSort(map[string]interface{}{"date": -1, "user_id": 1}, tt.typ, &qa)
+
+				if !reflect.DeepEqual(fields, []string{"-date", "user_id"}) {
+					t.Fatalf("\t%s\tShould get the sort fields : %v", tests.Failed, fields)
+				}
+				t.Logf("\t%s\tShould get the sort fields.", tests.Success)
+
+				if !reflect.DeepEqual(qa.Notes, []string{tt.note}) {
+					t.Fatalf("\t%s\tShould get the note %q : %v", tests.Failed, tt.note, qa.Notes)
+				}
+				t.Logf("\t%s\tShould get the note %q.", tests.Success, tt.note)
+			}
+		}
+	}
+}
+
+// TestUnusedIndexes tests the declared indexes no query uses are found.
+func TestUnusedIndexes(t *testing.T) {
+	declared := []declaredIndex{
+		{"Find", "comments", query.Index{Key: []string{"user_id", "-date"}}},
+		{"Find", "comments", query.Index{Key: []string{"status"}}},
+		{"Other", "users", query.Index{Key: []string{"name"}}},
+	}
+
+	queries := []QueryAdvice{
+		{Name: "Find", Collection: "comments", Explained: true, Indexes: []string{"user_id_1_date_-1"}},
+		{Name: "Other", Collection: "users", Equality: []string{"name"}},
+	}
+
+	t.Log("Given the need to find the declared indexes no query uses.")
+	{
+		t.Log("\tWhen one query is explained and the other is not")
+		{
+			unused := unusedIndexes(queries, declared)
+			if len(unused) != 1 || indexName(unused[0].Index) != "status_1" {
+				t.Fatalf("\t%s\tShould find the status index unused : %v", tests.Failed, unused)
+			}
+			t.Logf("\t%s\tShould find the status index unused.", tests.Success)
+		}
+	}
+}
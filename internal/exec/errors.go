@@ -0,0 +1,100 @@
+package exec
+
+// Code identifies why the execution of a set failed.
+type Code string
+
+// Set of codes for the errors returned when executing a set.
+const (
+	CodeParamMissing   Code = "ParamMissing"   // A parameter of the set was not provided.
+	CodeParamInvalid   Code = "ParamInvalid"   // A parameter value does not match its regex or type.
+	CodeSetInvalid     Code = "SetInvalid"     // The set or one of its scripts is not valid.
+	CodeSetDisabled    Code = "SetDisabled"    // The set is not enabled.
+	CodeCursorInvalid  Code = "CursorInvalid"  // The pagination cursor can't be used with the set.
+	CodeCommandInvalid Code = "CommandInvalid" // A command could not be processed.
+	CodeTimeout        Code = "Timeout"        // The set or query ran out of time.
+	CodeCanceled       Code = "Canceled"       // The caller stopped waiting on the set.
+	CodeMongoError     Code = "MongoError"     // The database failed executing a query.
+	CodeMaskError      Code = "MaskError"      // The masks could not be applied to the results.
+	CodeSaveError      Code = "SaveError"      // The results of a query could not be saved.
+	CodeInternal       Code = "Internal"       // Anything else that went wrong.
+)
+
+// Error is returned when the execution of a set fails. It identifies the query
+// and command that failed when the failure is caused by one, and the path of
+// the field in the command when a variable is missing.
+type Error struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+	Query   string `json:"query,omitempty"`
+	Command *int   `json:"command,omitempty"`
+	Path    string `json:"path,omitempty"`
+	err     error
+}
+
+// newError creates an error with the code for the error.
+func newError(code Code, err error) *Error {
+	return &Error{
+		Code:    code,
+		Message: err.Error(),
+		err:     err,
+	}
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the error the code was given to.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+//==============================================================================
+
+// asError returns the error as an *Error giving it the code if it does not have
+// one already.
+func asError(code Code, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+
+	return newError(code, err)
+}
+
+// paramErr marks the error as caused by the value of a parameter.
+func paramErr(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return asError(CodeParamInvalid, err)
+}
+
+// commandErr ties the error to the command at the index.
+func commandErr(code Code, idx int, err error) error {
+	e := asError(code, err)
+	e.Command = &idx
+	return e
+}
+
+// queryErr ties the error to the query. Errors that don't have a code yet come
+// from the database.
+func queryErr(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	switch err {
+	case ErrTimeout:
+		e = newError(CodeTimeout, err)
+	case ErrCanceled:
+		e = newError(CodeCanceled, err)
+	default:
+		e = asError(CodeMongoError, err)
+	}
+
+	e.Query = name
+	return e
+}
@@ -3,11 +3,15 @@
 package exec
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"strings"
+	"fmt"
+	"time"
 
 	"github.com/coralproject/xenia/internal/query"
-	"github.com/coralproject/xenia/internal/script"
 
 	"github.com/ardanlabs/kit/db"
 	"github.com/ardanlabs/kit/log"
@@ -28,53 +32,87 @@ var emptyResult []docs
 
 // Exec executes the specified query set by name.
 func Exec(context interface{}, db *db.DB, set *query.Set, vars map[string]string) *query.Result {
-	log.Dev(context, "Exec", "Started : Name[%s]", set.Name)
+	return ExecContext(background, context, db, set, vars, "")
+}
 
-	// Validate the set that is provided.
-	if err := set.Validate(); err != nil {
-		return errResult(context, err, "Validated")
-	}
+// ExecFresh executes the specified query set by name without using a cached
+// result, so the queries always run along with their $save commands. The
+// result still replaces any cached result of the set.
+func ExecFresh(context interface{}, db *db.DB, set *query.Set, vars map[string]string) *query.Result {
+	return ExecContext(WithoutCache(background), context, db, set, vars, "")
+}
 
-	// Is the rule enabled.
-	if !set.Enabled {
-		return errResult(context, errors.New("Set disabled"), "Enabled")
-	}
+// noCacheKey is the context key marking executions that skip the cache.
+type noCacheKey struct{}
+
+// WithoutCache returns a context whose set executions, including the sets
+// executed by set queries, never return a cached result.
+func WithoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+// ExecContext executes the specified query set by name continuing any paginated
+// queries from the cursor returned by a previous execution. An empty cursor
+// starts from the first page. Any queries still running on the server are
+// killed when ctx is done or the set timeout passes.
+func ExecContext(ctx context.Context, context interface{}, db *db.DB, set *query.Set, vars map[string]string, token string) *query.Result {
+	log.Dev(context, "ExecContext", "Started : Name[%s] Cursor[%s]", set.Name, token)
 
 	// If we have been provided a nil map, make one.
 	if vars == nil {
 		vars = make(map[string]string)
 	}
 
-	// Did we get everything we need. Also load defaults.
-	if err := processParams(context, db, set, vars); err != nil {
-		return errResult(context, err, "Process parameters")
+	// Use the cached results if the set caches them. The key needs to be
+	// built before preparing the set since that modifies it.
+	var key string
+	if set.CacheTTL != "" {
+		key = cacheKey(set, vars, token)
+
+		skip, _ := ctx.Value(noCacheKey{}).(bool)
+		if r, found := query.CachedResult(set.Name, key); found && !skip {
+			r.Cache = query.CacheHit
+			log.Dev(context, "ExecContext", "Completed : CACHE")
+			return r
+		}
 	}
 
-	// Load the pre/post scripts.
-	if err := loadPrePostScripts(context, db, set); err != nil {
-		return errResult(context, err, "Loading Pre/Post scripts")
+	// Validate the set and get it ready to be executed.
+	if err := prepare(context, db, set, vars); err != nil {
+		return errResult(context, err, "Preparing set")
 	}
 
-	// Hold any data we have been asked to save.
-	data := make(map[string]interface{})
+	// Where the paginated queries left off on the previous call.
+	cur, err := decodeCursor(context, set.Name, token)
+	if err != nil {
+		return errResult(context, newError(CodeCursorInvalid, err), "Decoding cursor")
+	}
+
+	// Bound the execution of all the queries by the set timeout.
+	ctx, cancel := withSetTimeout(ctx, set)
+	defer cancel()
+
+	// Record the set is executing so set queries can't execute it again.
+	ctx = enterSet(ctx, set.Name)
+
+	// Execute the queries, running the ones that don't depend
+	// on each other at the same time.
+	outcomes := execQueries(ctx, context, db, set, vars, &cur)
 
 	// Final results of running the set of queries.
 	var results []docs
 
-	// Iterate over the set of queries.
-	for _, q := range set.Queries {
-		var result docs
-		var commands []map[string]interface{}
-		var err error
-
-		// We only have pipeline right now.
-		switch strings.ToLower(q.Type) {
-		case "pipeline":
-			result, commands, err = execPipeline(context, db, &q, vars, data, set.Explain)
+	// Iterate over the outcomes in the order the queries are defined.
+	for i, q := range set.Queries {
+		o := outcomes[i]
+
+		// Was the query skipped by its condition.
+		if o.skipped {
+			continue
 		}
 
 		// Was there an error processing the query.
-		if err != nil {
+		if o.err != nil {
 
 			// Were we told to continue to the next one.
 			if q.Continue {
@@ -83,73 +121,157 @@ func Exec(context interface{}, db *db.DB, set *query.Set, vars map[string]string
 
 			// We need to return an error result with the commands.
 			r := query.Result{
-				Results: bson.M{"error": err.Error(), "commands": commands},
+				Results: bson.M{"error": o.err.Error(), "commands": o.commands},
+				Err:     o.err,
 			}
 
-			log.Error(context, "errResult", err, "Completed : Executing Result")
+			log.Error(context, "errResult", o.err, "Completed : Executing Result")
 			return &r
 		}
 
 		// Append these results to the final set.
 		if q.Return {
-			results = append(results, result)
+			results = append(results, o.result)
 		}
 	}
 
+	// Build the cursor for the next page.
+	next, err := encodeCursor(context, cur)
+	if err != nil {
+		return errResult(context, err, "Encoding cursor")
+	}
+
 	// Setup the result we will return.
 	r := query.Result{
 		Results: results,
+		Next:    next,
+	}
+
+	// Cache the result for the next caller. The ttl was checked when
+	// the set was validated.
+	if key != "" {
+		r.Cache = query.CacheMiss
+		ttl, _ := time.ParseDuration(set.CacheTTL)
+		query.CacheResult(set.Name, key, &r, ttl)
 	}
 
-	log.Dev(context, "Exec", "Completed")
+	log.Dev(context, "ExecContext", "Completed")
 	return &r
 }
 
-// errResult creates a result value with the error.
-func errResult(context interface{}, err error, msg string) *query.Result {
-	r := query.Result{
-		Results: bson.M{"error": err.Error()},
+// cacheKey builds the key for caching the results of executing the set with
+// the variables and cursor. The set definition is part of the key so a custom
+// set sharing its name with a stored set never receives the wrong results.
+// An empty key is returned if the key can't be built.
+func cacheKey(set *query.Set, vars map[string]string, token string) string {
+	def, err := json.Marshal(set)
+	if err != nil {
+		return ""
 	}
 
-	log.Error(context, "errResult", err, "Completed : %s", msg)
-	return &r
+	// Map keys are marshaled in sorted order so the same
+	// variables always produce the same key.
+	vs, err := json.Marshal(vars)
+	if err != nil {
+		return ""
+	}
+
+	h := sha1.New()
+	h.Write(def)
+	h.Write(vs)
+	h.Write([]byte(token))
+
+	return hex.EncodeToString(h.Sum(nil))
 }
 
-// loadPrePostScripts updates each query script slice with pre/post commands.
-func loadPrePostScripts(context interface{}, db *db.DB, set *query.Set) error {
-	if set.PreScript == "" && set.PstScript == "" {
-		return nil
-	}
+// prepare validates the set can be executed, processes the parameters against
+// the variables, loads any pre/post scripts and decodes the Extended JSON in
+// the commands.
+func prepare(context interface{}, db *db.DB, set *query.Set, vars map[string]string) error {
 
-	// Load the set of scripts we need to fetch.
-	fetchScripts := make([]string, 2)
+	// Validate the set that is provided.
+	if err := set.Validate(); err != nil {
+		return newError(CodeSetInvalid, err)
+	}
 
-	if set.PreScript != "" {
-		fetchScripts[0] = set.PreScript
+	// Is the rule enabled.
+	if !set.Enabled {
+		return newError(CodeSetDisabled, errors.New("Set disabled"))
 	}
 
-	if set.PstScript != "" {
-		fetchScripts[1] = set.PstScript
+	// Did we get everything we need. Also load defaults.
+	if err := processParams(context, db, set, vars); err != nil {
+		return err
 	}
 
-	// Pull all the script documents we need.
-	scripts, err := script.GetByNames(context, db, fetchScripts)
-	if err != nil {
+	// The queries may be shared with a cached copy of the set so they
+	// need to be copied before the scripts are added to them.
+	set.Queries = append([]query.Query(nil), set.Queries...)
+
+	// Add the pre/post scripts and expand the included scripts.
+	if err := loadScripts(context, db, set); err != nil {
 		return err
 	}
 
-	// Add the commands to the query scripts. Since order of the
-	// pre/post scripts is maintained, this is simplified.
-	for i := range set.Queries {
-		if set.PreScript != "" {
-			scripts[0].Commands = append(scripts[0].Commands, set.Queries[i].Commands...)
-			set.Queries[i].Commands = scripts[0].Commands
+	// A cached result skips the queries so the scripts and the sets of
+	// the set queries can't save to collections either.
+	if set.CacheTTL != "" {
+		if err := checkCacheSaves(context, db, set, map[string]bool{set.Name: true}); err != nil {
+			return err
 		}
+	}
 
-		if set.PstScript != "" {
-			set.Queries[i].Commands = append(set.Queries[i].Commands, scripts[1].Commands...)
+	// Replace any Extended JSON in the commands with BSON values.
+	return decodeExtJSON(set)
+}
+
+// checkCacheSaves validates the queries of a set that caches its results, or
+// of a set it executes, don't save to a collection.
+func checkCacheSaves(context interface{}, db *db.DB, set *query.Set, seen map[string]bool) error {
+	for _, q := range set.Queries {
+		if q.SavesToCollection() {
+			err := fmt.Errorf("Query %q of set %q saves to a collection, the results can't be cached", q.Name, set.Name)
+			log.Error(context, "checkCacheSaves", err, "Checking query")
+			return newError(CodeSetInvalid, err)
+		}
+
+		if q.Type != query.TypeSet || seen[q.Set] {
+			continue
+		}
+		seen[q.Set] = true
+
+		// A missing set is reported when the query is executed.
+		inner, err := query.GetByName(context, db, q.Set)
+		if err != nil {
+			if err == query.ErrNotFound {
+				continue
+			}
+
+			log.Error(context, "checkCacheSaves", err, "Loading set %q", q.Set)
+			return newError(CodeMongoError, err)
+		}
+
+		// The queries are shared with the cached copy of the set.
+		inner.Queries = append([]query.Query(nil), inner.Queries...)
+		if err := loadScripts(context, db, inner); err != nil {
+			return err
+		}
+
+		if err := checkCacheSaves(context, db, inner, seen); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
+
+// errResult creates a result value with the error.
+func errResult(context interface{}, err error, msg string) *query.Result {
+	r := query.Result{
+		Results: bson.M{"error": err.Error()},
+		Err:     asError(CodeInternal, err),
+	}
+
+	log.Error(context, "errResult", err, "Completed : %s", msg)
+	return &r
+}
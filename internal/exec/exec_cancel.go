@@ -0,0 +1,199 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Set of errors returned when the execution of a query is stopped.
+var (
+	ErrTimeout  = errors.New("Timed out executing commands")
+	ErrCanceled = errors.New("Canceled executing commands")
+)
+
+// codeExceededTimeLimit is the error code the server returns when an operation
+// runs longer than its maxTimeMS.
+const codeExceededTimeLimit = 50
+
+// socketSlack is the extra time given to the socket over maxTimeMS so the server
+// can report the operation ran out of time before the client gives up.
+const socketSlack = time.Second
+
+// aggregateCmd is the aggregate command with the options the mgo Pipe does not
+// provide.
+type aggregateCmd struct {
+	Aggregate string   `bson:"aggregate"`
+	Pipeline  []bson.M `bson:"pipeline"`
+	Cursor    bson.M   `bson:"cursor"`
+	MaxTimeMS int64    `bson:"maxTimeMS,omitempty"`
+	Comment   string   `bson:"comment,omitempty"`
+}
+
+// background is used when the caller does not provide a context.
+var background = context.Background()
+
+//==============================================================================
+
+// withSetTimeout bounds ctx by the timeout of the set if one is provided. The
+// timeout was checked when the set was validated.
+func withSetTimeout(ctx context.Context, set *query.Set) (context.Context, context.CancelFunc) {
+	d, err := time.ParseDuration(set.Timeout)
+	if set.Timeout == "" || err != nil {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d)
+}
+
+// withTimeout bounds ctx by the timeout and returns how much time is left
+// before the first of the two deadlines passes.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc, time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	if dl, ok := ctx.Deadline(); ok {
+		timeout = time.Until(dl)
+	}
+
+	return ctx, cancel, timeout
+}
+
+// aggregate starts the pipeline on the server and returns an iterator over the
+// results. The server stops the aggregation on its own once the timeout passes
+// and the tag lets it be found and killed if ctx is done before then.
+func aggregate(c *mgo.Collection, stages []bson.M, timeout time.Duration, tag string) *mgo.Iter {
+	var result struct {
+		Cursor struct {
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			ID         int64      `bson:"id"`
+		}
+	}
+
+	cmd := aggregateCmd{
+		Aggregate: c.Name,
+		Pipeline:  stages,
+		Cursor:    bson.M{},
+		MaxTimeMS: maxTimeMS(timeout),
+		Comment:   tag,
+	}
+
+	// Servers before 3.6 don't accept a comment on the aggregate command,
+	// those aggregations are only stopped by maxTimeMS.
+	err := c.Database.Run(cmd, &result)
+	if e, ok := err.(*mgo.QueryError); ok && strings.Contains(e.Message, "comment") {
+		cmd.Comment = ""
+		err = c.Database.Run(cmd, &result)
+	}
+
+	return c.NewIter(nil, result.Cursor.FirstBatch, result.Cursor.ID, err)
+}
+
+// maxTimeMS converts the timeout into milliseconds for the server. A value of
+// zero means no limit so at least one millisecond is always returned.
+func maxTimeMS(timeout time.Duration) int64 {
+	ms := int64(timeout / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+
+	return ms
+}
+
+// opTag returns a unique comment to tag an operation with so it can be found
+// on the server.
+func opTag() string {
+	return "xenia:" + bson.NewObjectId().Hex()
+}
+
+// killOnDone kills the operations tagged with the comment if ctx is done before
+// the returned function is called. The returned function waits for any kill in
+// progress so the session is never used after it is closed.
+func killOnDone(ctx context.Context, context interface{}, ses *mgo.Session, tag string) func() {
+	finished := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		select {
+		case <-finished:
+		case <-ctx.Done():
+			killOp(context, ses, tag)
+		}
+	}()
+
+	return func() {
+		close(finished)
+		wg.Wait()
+	}
+}
+
+// killOp finds the operations on the server tagged with the comment and kills
+// them so abandoned aggregations stop consuming server resources.
+func killOp(context interface{}, ses *mgo.Session, tag string) {
+	log.Dev(context, "killOp", "Started : Tag[%s]", tag)
+
+	// The session in use is blocked waiting on the operation.
+	ses = ses.Copy()
+	defer ses.Close()
+
+	admin := ses.DB("admin")
+
+	var ops struct {
+		Inprog []struct {
+			OpID interface{} `bson:"opid"`
+		} `bson:"inprog"`
+	}
+
+	cmd := bson.D{
+		{Name: "currentOp", Value: 1},
+		{Name: "$or", Value: []bson.M{
+			{"command.comment": tag},
+			{"originatingCommand.comment": tag},
+		}},
+	}
+
+	if err := admin.Run(cmd, &ops); err != nil {
+		log.Error(context, "killOp", err, "Completed : Finding operations")
+		return
+	}
+
+	for _, op := range ops.Inprog {
+		if err := admin.Run(bson.D{{Name: "killOp", Value: 1}, {Name: "op", Value: op.OpID}}, nil); err != nil {
+			log.Error(context, "killOp", err, "Killing Op[%v]", op.OpID)
+		}
+	}
+
+	log.Dev(context, "killOp", "Completed : Killed[%d]", len(ops.Inprog))
+}
+
+// stopErr returns the reason the query was stopped when ctx is done or the
+// time given to the query ran out, otherwise the error is returned as is.
+func stopErr(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	case context.Canceled:
+		return ErrCanceled
+	}
+
+	if e, ok := err.(*mgo.QueryError); ok && e.Code == codeExceededTimeLimit {
+		return ErrTimeout
+	}
+
+	if e, ok := err.(*net.OpError); ok && e.Timeout() {
+		return ErrTimeout
+	}
+
+	return err
+}
@@ -0,0 +1,345 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/db/mongo"
+	"github.com/ardanlabs/kit/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// findQuery contains the parts of a find, count or distinct query after the
+// variables have been substituted.
+type findQuery struct {
+	filter  bson.M   // Documents to select from the $match command.
+	project bson.M   // Fields to return from the $project command.
+	sort    []string // Fields to sort on from the $sort command, "-field" for descending.
+	skip    int      // Documents to skip from the $skip command.
+	limit   int      // Documents to return from the $limit command.
+	field   string   // Field to return the values of from the $distinct command.
+}
+
+// countCmd is the count command with the options the mgo Query does not
+// provide.
+type countCmd struct {
+	Count     string `bson:"count"`
+	Query     bson.M `bson:"query,omitempty"`
+	Skip      int    `bson:"skip,omitempty"`
+	Limit     int    `bson:"limit,omitempty"`
+	MaxTimeMS int64  `bson:"maxTimeMS,omitempty"`
+}
+
+// distinctCmd is the distinct command with the options the mgo Query does not
+// provide.
+type distinctCmd struct {
+	Distinct  string `bson:"distinct"`
+	Key       string `bson:"key"`
+	Query     bson.M `bson:"query,omitempty"`
+	MaxTimeMS int64  `bson:"maxTimeMS,omitempty"`
+}
+
+//==============================================================================
+
+// buildFind performs the variable substitutions on the query commands and
+// collects them into the parts of the query.
+func buildFind(context interface{}, q *query.Query, vars map[string]string, data map[string]interface{}) (pipeline, findQuery, error) {
+	var fq findQuery
+
+	// The commands are processed the same way as a pipeline.
+	p, err := buildPipeline(context, q, vars, data)
+	if err != nil {
+		return p, fq, err
+	}
+
+	for i, command := range p.stages {
+		for op, v := range command {
+			var ok bool
+
+			switch op {
+			case "$match":
+				fq.filter, ok = document(v)
+			case "$project":
+				fq.project, ok = document(v)
+			case "$sort":
+				fq.sort, ok = sortFields(v)
+			case "$skip":
+				fq.skip, ok = toInt(v)
+			case "$limit":
+				fq.limit, ok = toInt(v)
+			case "$distinct":
+				fq.field, ok = v.(string)
+			}
+
+			if !ok {
+				err := fmt.Errorf("Invalid %s command %q", q.Type, op)
+				log.Error(context, "buildFind", err, "Checking commands")
+				return p, fq, commandErr(CodeCommandInvalid, i, err)
+			}
+		}
+	}
+
+	return p, fq, nil
+}
+
+// execFind executes the specified find, count or distinct query.
+func execFind(ctx context.Context, context interface{}, db *db.DB, q *query.Query, vars map[string]string, data map[string]interface{}, explain bool) (docs, []map[string]interface{}, error) {
+	p, fq, err := buildFind(context, q, vars, data)
+	if err != nil {
+		return docs{}, p.commands, err
+	}
+
+	commands := p.commands
+
+	// Stop waiting on the database once the query timeout passes
+	// or the caller is no longer interested in the results.
+	ctx, cancel, timeout := withTimeout(ctx, queryTimeout(context, q))
+	defer cancel()
+	log.Dev(context, "execFind", "MGO Timeout Set[%s]", timeout)
+
+	if err := ctx.Err(); err != nil {
+		err = stopErr(ctx, err)
+		log.Error(context, "execFind", err, "Completed : Before starting")
+		return docs{}, commands, err
+	}
+
+	// Tag the query so it can be found on the server.
+	tag := opTag()
+
+	// Build the function for the execution.
+	var results []bson.M
+	f := func(c *mgo.Collection) error {
+		log.Dev(context, "execFind", "MGO Started : Type[%s]\ndb.%s.find(%s)", q.Type, c.Name, mongo.Query(fq.filter))
+
+		stop := killOnDone(ctx, context, c.Database.Session, tag)
+		defer stop()
+
+		var err error
+		switch strings.ToLower(q.Type) {
+		case query.TypeFind:
+			results, err = fq.find(c, timeout, tag, explain)
+		case query.TypeCount:
+			results, err = fq.count(c, timeout, explain)
+		case query.TypeDistinct:
+			results, err = fq.distinct(c, timeout, explain)
+		}
+
+		return err
+	}
+
+	// Execute the query, the socket timeout is a backstop in case the
+	// server does not stop the query in time.
+	if err := db.ExecuteMGOTimeout(context, timeout+socketSlack, q.Collection, f); err != nil {
+		err = stopErr(ctx, err)
+		log.Error(context, "execFind", err, "Completed")
+		return docs{}, commands, err
+	}
+
+	log.Dev(context, "execFind", "Completed")
+
+	// The explain output is returned as is.
+	if explain {
+		return docs{q.Name, results}, commands, nil
+	}
+
+	// If there were no results, return an empty array. A collection the
+	// results are saved to still needs to reflect there were none.
+	if results == nil {
+		if err := saveNoResults(context, db, p.save); err != nil {
+			return docs{}, commands, commandErr(CodeSaveError, len(q.Commands)-1, err)
+		}
+		return docs{q.Name, []bson.M{}}, commands, nil
+	}
+
+	// Perform any masking that is required.
+	if err := processMasks(context, db, q.Collection, results); err != nil {
+		return docs{}, commands, newError(CodeMaskError, err)
+	}
+
+	// Do we need to save the result.
+	if p.save != nil {
+		if err := saveResult(context, db, p.save, results, data); err != nil {
+			return docs{}, commands, commandErr(CodeSaveError, len(q.Commands)-1, err)
+		}
+	}
+
+	return docs{q.Name, results}, commands, nil
+}
+
+//==============================================================================
+
+// find returns the documents selected by the query.
+func (fq *findQuery) find(c *mgo.Collection, timeout time.Duration, tag string, explain bool) ([]bson.M, error) {
+	mq := c.Find(fq.filter).Comment(tag).SetMaxTime(timeout)
+
+	if fq.project != nil {
+		mq = mq.Select(fq.project)
+	}
+
+	if fq.sort != nil {
+		mq = mq.Sort(fq.sort...)
+	}
+
+	if fq.skip > 0 {
+		mq = mq.Skip(fq.skip)
+	}
+
+	if fq.limit > 0 {
+		mq = mq.Limit(fq.limit)
+	}
+
+	if explain {
+		var m bson.M
+		if err := mq.Explain(&m); err != nil {
+			return nil, err
+		}
+		return []bson.M{m}, nil
+	}
+
+	var results []bson.M
+	if err := mq.All(&results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// count returns a single document with the number of documents selected by
+// the query, {"count": 10}.
+func (fq *findQuery) count(c *mgo.Collection, timeout time.Duration, explain bool) ([]bson.M, error) {
+	cmd := countCmd{
+		Count: c.Name,
+		Query: fq.filter,
+		Skip:  fq.skip,
+		Limit: fq.limit,
+	}
+
+	if explain {
+		return explainCmd(c, cmd)
+	}
+
+	cmd.MaxTimeMS = maxTimeMS(timeout)
+
+	var res struct {
+		N int `bson:"n"`
+	}
+
+	if err := c.Database.Run(cmd, &res); err != nil {
+		return nil, err
+	}
+
+	return []bson.M{{"count": res.N}}, nil
+}
+
+// distinct returns a document for each distinct value of the field selected
+// by the query, {"field": value}, so the values can be saved and looked up
+// like any other results.
+func (fq *findQuery) distinct(c *mgo.Collection, timeout time.Duration, explain bool) ([]bson.M, error) {
+	cmd := distinctCmd{
+		Distinct: c.Name,
+		Key:      fq.field,
+		Query:    fq.filter,
+	}
+
+	if explain {
+		return explainCmd(c, cmd)
+	}
+
+	cmd.MaxTimeMS = maxTimeMS(timeout)
+
+	var res struct {
+		Values []interface{} `bson:"values"`
+	}
+
+	if err := c.Database.Run(cmd, &res); err != nil {
+		return nil, err
+	}
+
+	results := make([]bson.M, len(res.Values))
+	for i, v := range res.Values {
+		results[i] = nestField(fq.field, v)
+	}
+
+	return results, nil
+}
+
+// explainCmd returns the explain output for the command.
+func explainCmd(c *mgo.Collection, cmd interface{}) ([]bson.M, error) {
+	var m bson.M
+	if err := c.Database.Run(bson.D{{Name: "explain", Value: cmd}}, &m); err != nil {
+		return nil, err
+	}
+
+	return []bson.M{m}, nil
+}
+
+//==============================================================================
+
+// document returns the value as a document.
+func document(v interface{}) (bson.M, bool) {
+	switch d := v.(type) {
+	case bson.M:
+		return d, true
+	case map[string]interface{}:
+		return bson.M(d), true
+	}
+
+	return nil, false
+}
+
+// sortFields converts the value of a $sort command into the fields to sort on.
+// A document can only hold a single field since the order of its fields is not
+// kept. An array of fields, "-field" for descending, keeps the order.
+func sortFields(v interface{}) ([]string, bool) {
+	if list, ok := v.([]interface{}); ok {
+		fields := make([]string, len(list))
+		for i, f := range list {
+			s, ok := f.(string)
+			if !ok || s == "" {
+				return nil, false
+			}
+			fields[i] = s
+		}
+
+		return fields, true
+	}
+
+	d, ok := document(v)
+	if !ok || len(d) != 1 {
+		return nil, false
+	}
+
+	var fields []string
+	for fld, value := range d {
+		dir, err := sortDir(value)
+		if err != nil {
+			return nil, false
+		}
+
+		if dir == -1 {
+			fld = "-" + fld
+		}
+		fields = append(fields, fld)
+	}
+
+	return fields, true
+}
+
+// nestField builds a document with the value at the dotted field path,
+// "a.b" becomes {"a": {"b": value}}.
+func nestField(field string, v interface{}) bson.M {
+	parts := strings.Split(field, ".")
+
+	doc := bson.M{parts[len(parts)-1]: v}
+	for i := len(parts) - 2; i >= 0; i-- {
+		doc = bson.M{parts[i]: doc}
+	}
+
+	return doc
+}
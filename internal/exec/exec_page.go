@@ -0,0 +1,244 @@
+package exec
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/ardanlabs/kit/db/mongo"
+	"github.com/ardanlabs/kit/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// position captures where a paginated query left off.
+type position struct {
+	Key  interface{} `bson:"k"`           // Value of the sort field in the last document.
+	ID   interface{} `bson:"i"`           // Value of the _id field in the last document.
+	Done bool        `bson:"d,omitempty"` // There are no more documents to return.
+}
+
+// cursor is the decoded form of the continuation token.
+type cursor struct {
+	Set       string              `bson:"s"` // Name of the set the cursor belongs to.
+	Positions map[string]position `bson:"p"` // Position for each paginated query by name.
+}
+
+// page maintains the pagination state for a query while it is executed.
+type page struct {
+	after *position // Where the previous page left off.
+	field string    // Field the results are sorted by.
+	dir   int       // Direction of the sort, 1 or -1.
+	limit int       // Value of the $limit following the sort, 0 if none.
+}
+
+//==============================================================================
+
+// decodeCursor converts the continuation token back into a cursor. An empty
+// token starts the set from the first page.
+func decodeCursor(context interface{}, set string, token string) (cursor, error) {
+	cur := cursor{Set: set, Positions: make(map[string]position)}
+	if token == "" {
+		return cur, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		err = errors.New("Invalid cursor")
+		log.Error(context, "decodeCursor", err, "Decoding token")
+		return cur, err
+	}
+
+	if err := bson.Unmarshal(raw, &cur); err != nil {
+		err = errors.New("Invalid cursor")
+		log.Error(context, "decodeCursor", err, "Unmarshaling token")
+		return cur, err
+	}
+
+	if cur.Set != set {
+		err := fmt.Errorf("Cursor belongs to set %q", cur.Set)
+		log.Error(context, "decodeCursor", err, "Checking set name")
+		return cur, err
+	}
+
+	if cur.Positions == nil {
+		cur.Positions = make(map[string]position)
+	}
+
+	return cur, nil
+}
+
+// encodeCursor converts the cursor into an opaque continuation token. An empty
+// token is returned when none of the queries have more documents.
+func encodeCursor(context interface{}, cur cursor) (string, error) {
+	var more bool
+	for _, pos := range cur.Positions {
+		if !pos.Done {
+			more = true
+			break
+		}
+	}
+
+	if !more {
+		return "", nil
+	}
+
+	raw, err := bson.Marshal(cur)
+	if err != nil {
+		log.Error(context, "encodeCursor", err, "Marshaling token")
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+//==============================================================================
+
+// apply locates the last $sort stage in the pipeline, makes the order stable
+// with an _id tie breaker and inserts a $match after it to skip everything up
+// to and including the last document of the previous page.
+func (pg *page) apply(context interface{}, p *pipeline) error {
+
+	// Find the last $sort stage, that is the order of the results.
+	idx := -1
+	for i, stage := range p.stages {
+		if _, exists := stage["$sort"]; exists {
+			idx = i
+		}
+	}
+
+	if idx == -1 {
+		err := errors.New("Pagination requires a $sort command")
+		log.Error(context, "apply", err, "Finding $sort")
+		return err
+	}
+
+	sort, ok := p.stages[idx]["$sort"].(map[string]interface{})
+	if !ok || len(sort) != 1 {
+		err := errors.New("Pagination requires a $sort on a single field")
+		log.Error(context, "apply", err, "Checking $sort")
+		return err
+	}
+
+	for fld, v := range sort {
+		dir, err := sortDir(v)
+		if err != nil {
+			log.Error(context, "apply", err, "Checking $sort direction")
+			return err
+		}
+
+		pg.field = fld
+		pg.dir = dir
+	}
+
+	// Capture the page size if the sort is followed by a $limit.
+	if idx+1 < len(p.stages) {
+		if v, exists := p.stages[idx+1]["$limit"]; exists {
+			if limit, ok := toInt(v); ok {
+				pg.limit = limit
+			}
+		}
+	}
+
+	// Sort on _id as well so documents with the same key are always
+	// returned in the same order.
+	order := bson.D{{Name: pg.field, Value: pg.dir}}
+	if pg.field != "_id" {
+		order = append(order, bson.DocElem{Name: "_id", Value: pg.dir})
+	}
+
+	stages := append([]bson.M{}, p.stages[:idx]...)
+	stages = append(stages, bson.M{"$sort": order})
+
+	// Skip past the documents we have already returned.
+	if pg.after != nil {
+		stages = append(stages, bson.M{"$match": pg.match()})
+	}
+
+	p.stages = append(stages, p.stages[idx+1:]...)
+
+	// Rebuild the logable version of the pipeline.
+	p.agg = ""
+	for _, stage := range p.stages {
+		p.agg += mongo.Query(stage) + ",\n"
+	}
+
+	return nil
+}
+
+// match builds the filter that selects the documents after the position.
+func (pg *page) match() bson.M {
+	op := "$gt"
+	if pg.dir == -1 {
+		op = "$lt"
+	}
+
+	if pg.field == "_id" {
+		return bson.M{"_id": bson.M{op: pg.after.Key}}
+	}
+
+	return bson.M{
+		"$or": []bson.M{
+			{pg.field: bson.M{op: pg.after.Key}},
+			{pg.field: pg.after.Key, "_id": bson.M{op: pg.after.ID}},
+		},
+	}
+}
+
+// next returns the position to continue from based on the documents returned
+// for this page.
+func (pg *page) next(context interface{}, results []bson.M) (position, error) {
+
+	// Without a $limit everything was returned and a short
+	// page means we have reached the end.
+	l := len(results)
+	if l == 0 || pg.limit == 0 || l < pg.limit {
+		return position{Done: true}, nil
+	}
+
+	last := results[l-1]
+
+	key, err := docFieldLookup(context, last, pg.field)
+	if err != nil {
+		err = fmt.Errorf("Pagination requires %q in the results", pg.field)
+		log.Error(context, "next", err, "Looking up sort field")
+		return position{}, err
+	}
+
+	id, exists := last["_id"]
+	if !exists {
+		err := errors.New("Pagination requires \"_id\" in the results")
+		log.Error(context, "next", err, "Looking up _id field")
+		return position{}, err
+	}
+
+	return position{Key: key, ID: id}, nil
+}
+
+// sortDir converts the direction of a $sort field into 1 or -1.
+func sortDir(v interface{}) (int, error) {
+	dir, ok := toInt(v)
+	if !ok || (dir != 1 && dir != -1) {
+		return 0, fmt.Errorf("Invalid $sort direction %v", v)
+	}
+
+	return dir, nil
+}
+
+// toInt converts the numeric types we get from JSON and BSON into an int.
+func toInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case float64:
+		if n != float64(int(n)) {
+			return 0, false
+		}
+		return int(n), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,327 @@
+package exec
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxWorkers is the maximum number of queries of a set that are executed at
+// the same time.
+const maxWorkers = 4
+
+// outcome contains the result of executing a single query of a set.
+type outcome struct {
+	result   docs
+	commands []map[string]interface{}
+	pos      *position
+	err      error
+	skipped  bool // The when condition of the query does not hold.
+}
+
+//==============================================================================
+
+// execQueries executes the queries of the set and returns their outcomes in
+// the order the queries are defined. A query is executed as soon as the
+// queries it depends on have completed. Once a query fails without being
+// told to continue, the queries defined after it are not started.
+func execQueries(ctx context.Context, context interface{}, db *db.DB, set *query.Set, vars map[string]string, cur *cursor) []outcome {
+	n := len(set.Queries)
+	deps := dependencies(set.Queries)
+
+	outcomes := make([]outcome, n)
+
+	// Each channel is closed once its query has completed.
+	done := make([]chan struct{}, n)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	// The mutex protects the saved data, the cursor and the index
+	// of the first query that stopped the set.
+	var mu sync.Mutex
+	data := make(map[string]interface{})
+	stopped := n
+
+	// Limit the number of queries executing at the same time.
+	sem := make(chan struct{}, maxWorkers)
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+
+	for i := range set.Queries {
+		go func(i int) {
+			defer wg.Done()
+			defer close(done[i])
+
+			// Wait for the queries this query depends on.
+			for _, d := range deps[i] {
+				<-done[d]
+			}
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			// Each query gets its own copy of the commands so the variable
+			// substitutions don't change commands shared with other queries.
+			q := set.Queries[i]
+			q.Commands = copyCommands(q.Commands)
+
+			// Only the data saved by the queries we depend on is visible,
+			// just like when the queries are executed one at a time.
+			mu.Lock()
+			if stopped < i {
+				mu.Unlock()
+				log.Dev(context, "execQueries", "Skipping Query[%s]", q.Name)
+				return
+			}
+
+			local := make(map[string]interface{})
+			for _, d := range deps[i] {
+				if name := saveName(&set.Queries[d]); name != "" {
+					if v, exists := data[name]; exists {
+						local[name] = v
+					}
+				}
+			}
+
+			// Is this query being paginated.
+			var pg *page
+			if q.Paginate {
+				pg = new(page)
+				if pos, exists := cur.Positions[q.Name]; exists {
+					pg.after = &pos
+				}
+			}
+			mu.Unlock()
+
+			// Is the query only executed under some condition.
+			if !shouldExec(&q, vars, local) {
+				log.Dev(context, "execQueries", "Skipping Query[%s] : Condition", q.Name)
+				outcomes[i] = outcome{skipped: true}
+				return
+			}
+
+			o := execQuery(ctx, context, db, &q, vars, local, set.Explain, pg)
+
+			mu.Lock()
+			{
+				if name := saveName(&q); name != "" {
+					if v, exists := local[name]; exists {
+						data[name] = v
+					}
+				}
+
+				if o.pos != nil {
+					cur.Positions[q.Name] = *o.pos
+				}
+
+				if o.err != nil && !q.Continue && i < stopped {
+					stopped = i
+				}
+			}
+			mu.Unlock()
+
+			outcomes[i] = o
+		}(i)
+	}
+
+	wg.Wait()
+
+	return outcomes
+}
+
+// execQuery executes a single query based on its type.
+func execQuery(ctx context.Context, context interface{}, db *db.DB, q *query.Query, vars map[string]string, data map[string]interface{}, explain bool, pg *page) outcome {
+
+	// A query that has reached the end has nothing more to return.
+	if pg != nil && pg.after != nil && pg.after.Done {
+		return outcome{result: docs{q.Name, []bson.M{}}}
+	}
+
+	var o outcome
+
+	switch strings.ToLower(q.Type) {
+	case query.TypePipeline:
+		o.result, o.commands, o.err = execPipeline(ctx, context, db, q, vars, data, explain, pg)
+
+	case query.TypeFind, query.TypeCount, query.TypeDistinct:
+		o.result, o.commands, o.err = execFind(ctx, context, db, q, vars, data, explain)
+
+	case query.TypeSet:
+		o.result, o.commands, o.err = execSet(ctx, context, db, q, vars, data, explain)
+	}
+
+	// Tie any error to this query.
+	if o.err != nil {
+		o.err = queryErr(q.Name, o.err)
+		return o
+	}
+
+	// Remember where this page ended for the next call.
+	if pg != nil && !explain {
+		pos, err := pg.next(context, o.result.Docs)
+		if err != nil {
+			o.err = queryErr(q.Name, newError(CodeCommandInvalid, err))
+			return o
+		}
+
+		o.pos = &pos
+	}
+
+	return o
+}
+
+//==============================================================================
+
+// dependencies returns the indexes of the earlier queries each query has to
+// wait on. A query depends on an earlier query when it looks up or tests data
+// the earlier query saves or when both save their data under the same name.
+// Queries with side effects, saving to a collection or executing a set, wait
+// on every earlier query and every later query waits on them. So they never
+// run once an earlier query has stopped the set.
+func dependencies(queries []query.Query) [][]int {
+	deps := make([][]int, len(queries))
+
+	for i := range queries {
+		uses := make(map[string]bool)
+		dataNames(queries[i].Commands, uses)
+		dataName(queries[i].Vars, uses)
+
+		if queries[i].When != nil {
+			queries[i].When.SavedNames(uses)
+		}
+
+		saves := saveName(&queries[i])
+		barrier := sideEffects(&queries[i])
+
+		for j := 0; j < i; j++ {
+			if barrier || sideEffects(&queries[j]) {
+				deps[i] = append(deps[i], j)
+				continue
+			}
+
+			if name := saveName(&queries[j]); name != "" && (uses[name] || name == saves) {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+
+	return deps
+}
+
+// saveName returns the name the query saves its results under when it ends
+// with a {"$save": {"$map": "name"}} command.
+func saveName(q *query.Query) string {
+	l := len(q.Commands) - 1
+	if l < 0 {
+		return ""
+	}
+
+	save, ok := q.Commands[l]["$save"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	name, _ := save["$map"].(string)
+	return name
+}
+
+// sideEffects reports if the query saves its results to a collection or
+// executes a set, which may do the same.
+func sideEffects(q *query.Query) bool {
+	return strings.ToLower(q.Type) == query.TypeSet || q.SavesToCollection()
+}
+
+// dataNames walks the commands adding the names of the saved results that
+// are looked up with the #data command.
+func dataNames(commands []map[string]interface{}, names map[string]bool) {
+	for _, command := range commands {
+		for _, value := range command {
+			dataName(value, names)
+		}
+	}
+}
+
+// dataName adds the name of the saved results the value looks up when it is
+// a #data command, or contains one.
+func dataName(value interface{}, names map[string]bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, sub := range v {
+			dataName(sub, names)
+		}
+
+	case []interface{}:
+		for _, sub := range v {
+			dataName(sub, names)
+		}
+
+	case string:
+
+		// "#data.*:list.station_id"
+		if !strings.HasPrefix(v, "#data") {
+			return
+		}
+
+		idx := strings.IndexByte(v, ':')
+		if idx == -1 {
+			return
+		}
+
+		lookup := v[idx+1:]
+		if idx := strings.IndexByte(lookup, '.'); idx != -1 {
+			names[lookup[:idx]] = true
+		}
+	}
+}
+
+//==============================================================================
+
+// copyCommands returns a deep copy of the commands.
+func copyCommands(commands []map[string]interface{}) []map[string]interface{} {
+	cpy := make([]map[string]interface{}, len(commands))
+	for i := range commands {
+		cpy[i] = copyDoc(commands[i])
+	}
+
+	return cpy
+}
+
+// copyDoc returns a deep copy of the document.
+func copyDoc(doc map[string]interface{}) map[string]interface{} {
+	cpy := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		cpy[k] = copyValue(v)
+	}
+
+	return cpy
+}
+
+// copyValue returns a deep copy of documents and arrays. All other values
+// are returned as is.
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyDoc(v)
+
+	case bson.M:
+		return bson.M(copyDoc(v))
+
+	case []interface{}:
+		cpy := make([]interface{}, len(v))
+		for i := range v {
+			cpy[i] = copyValue(v[i])
+		}
+		return cpy
+
+	default:
+		return v
+	}
+}
@@ -0,0 +1,87 @@
+package exec
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestDependencies tests queries only wait on the queries they need.
+func TestDependencies(t *testing.T) {
+	save := func(name string) map[string]interface{} {
+		return map[string]interface{}{"$save": map[string]interface{}{"$map": name}}
+	}
+
+	match := func(value interface{}) map[string]interface{} {
+		return map[string]interface{}{"$match": map[string]interface{}{"station_id": value}}
+	}
+
+	queries := []query.Query{
+		{Name: "list", Commands: []map[string]interface{}{match("42021"), save("list")}},
+		{Name: "other", Commands: []map[string]interface{}{match("44005")}},
+		{Name: "in", Commands: []map[string]interface{}{match(map[string]interface{}{"$in": "#data.*:list.station_id"})}},
+		{Name: "index", Commands: []map[string]interface{}{match([]interface{}{"#data.0:list.station_id"})}},
+		{Name: "resave", Commands: []map[string]interface{}{match("44008"), save("list")}},
+		{Name: "last", Commands: []map[string]interface{}{match("#data.0:list.station_id")}},
+		{Name: "when", Commands: []map[string]interface{}{match("44008")}, When: &query.Condition{Saved: "list"}},
+	}
+
+	exp := [][]int{nil, nil, {0}, {0}, {0}, {0, 4}, {0, 4}}
+
+	t.Logf("Given the need to find the dependencies between queries.")
+	{
+		deps := dependencies(queries)
+
+		for i, q := range queries {
+			t.Logf("\tWhen checking query %q", q.Name)
+			{
+				if !reflect.DeepEqual(deps[i], exp[i]) {
+					t.Errorf("\t%s\tShould depend on queries %v : %v", tests.Failed, exp[i], deps[i])
+					continue
+				}
+				t.Logf("\t%s\tShould depend on queries %v.", tests.Success, exp[i])
+			}
+		}
+	}
+}
+
+// TestCollectionDependencies tests queries saving to collections or executing
+// sets wait on every earlier query and every later query waits on them.
+func TestCollectionDependencies(t *testing.T) {
+	save := func(name string) map[string]interface{} {
+		return map[string]interface{}{"$save": map[string]interface{}{"$collection": name}}
+	}
+
+	match := map[string]interface{}{"$match": map[string]interface{}{}}
+
+	queries := []query.Query{
+		{Name: "fail", Collection: "test_xenia_data", Commands: []map[string]interface{}{{"$limit": "#number:missing"}}},
+		{Name: "write", Collection: "test_xenia_data", Commands: []map[string]interface{}{match, save("saved_daily")}},
+		{Name: "other", Collection: "test_xenia_data", Commands: []map[string]interface{}{match}},
+		{Name: "read", Collection: "saved_daily", Commands: []map[string]interface{}{match}},
+		{Name: "interpolated", Collection: "test_xenia_data", Commands: []map[string]interface{}{match, save("saved_{name}")}},
+		{Name: "set", Type: query.TypeSet, Set: "other_set"},
+		{Name: "last", Collection: "test_xenia_data", Commands: []map[string]interface{}{match}},
+	}
+
+	exp := [][]int{nil, {0}, {1}, {1}, {0, 1, 2, 3}, {0, 1, 2, 3, 4}, {1, 4, 5}}
+
+	t.Logf("Given the need to find the dependencies between queries with side effects.")
+	{
+		deps := dependencies(queries)
+
+		for i, q := range queries {
+			t.Logf("\tWhen checking query %q", q.Name)
+			{
+				if !reflect.DeepEqual(deps[i], exp[i]) {
+					t.Errorf("\t%s\tShould depend on queries %v : %v", tests.Failed, exp[i], deps[i])
+					continue
+				}
+				t.Logf("\t%s\tShould depend on queries %v.", tests.Success, exp[i])
+			}
+		}
+	}
+}
@@ -3,9 +3,10 @@
 package exec
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net"
+	"strings"
 	"time"
 
 	"github.com/coralproject/xenia/internal/query"
@@ -17,61 +18,124 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
-// execPipeline executes the sepcified pipeline query.
-func execPipeline(context interface{}, db *db.DB, q *query.Query, vars map[string]string, data map[string]interface{}, explain bool) (docs, []map[string]interface{}, error) {
+// pipeline contains the commands for a pipeline query after the variables
+// have been substituted.
+type pipeline struct {
+	commands []map[string]interface{} // Commands that make up the pipeline.
+	stages   []bson.M                 // Stages to send to the database.
+	save     map[string]interface{}   // The $save command if one was provided.
+	agg      string                   // Logable version of the pipeline.
+}
 
-	// I am returning commands as the second return value because if there
-	// is an error I need to send how far we got back to the client. If not,
-	// the user will not understand the error message.
+// buildPipeline performs the variable substitutions on the query commands and
+// extracts any $save command from the end of the pipeline.
+func buildPipeline(context interface{}, q *query.Query, vars map[string]string, data map[string]interface{}) (pipeline, error) {
 
 	// We need to check to see if the last command is the extended $save command.
-	commands := q.Commands
+	p := pipeline{commands: q.Commands}
 	l := len(q.Commands) - 1
 
 	// Validate we have scripts to run.
 	if l < 0 {
-		return docs{}, commands, errors.New("Invalid pipeline script")
+		return p, newError(CodeCommandInvalid, errors.New("Invalid pipeline script"))
 	}
 
 	// If the last command is a $save, capture its value and remove
 	// it from the pipeline.
-	var save map[string]interface{}
 	if v, exists := q.Commands[l]["$save"]; exists {
 		if cmd, ok := v.(map[string]interface{}); ok {
-			save = cmd
+			p.save = cmd
 		}
 
-		commands = q.Commands[0:l]
+		p.commands = q.Commands[0:l]
 	}
 
-	var agg string
-	var pipeline []bson.M
+	// The collection can be named with variables, "stats_{month}".
+	if vars != nil {
+		name, err := interpolate(q.Collection, vars, false)
+		if err != nil {
+			return p, err
+		}
+
+		if name != q.Collection && strings.ContainsRune(name, '$') {
+			return p, newError(CodeParamInvalid, fmt.Errorf("Invalid collection name %q", name))
+		}
+
+		q.Collection = name
+	}
 
 	// Iterate over the commands and build the pipeline.
-	for _, command := range commands {
+	for i, command := range p.commands {
 
 		// Do we have variables to be substitued.
 		if vars != nil {
 			if err := ProcessVariables(context, command, vars, data); err != nil {
-				return docs{}, commands, err
+				return p, commandErr(CodeCommandInvalid, i, err)
+			}
+
+			// The fields of the stage were all dropped by missing
+			// optional variables.
+			if len(command) == 0 {
+				continue
 			}
 		}
 
 		// Add the operation to the slice for the pipeline.
-		pipeline = append(pipeline, command)
+		p.stages = append(p.stages, command)
 
 		// Build a logable version of this pipeline.
-		agg += mongo.Query(command) + ",\n"
+		p.agg += mongo.Query(command) + ",\n"
 	}
 
+	return p, nil
+}
+
+// queryTimeout returns the timeout configured for the query or the default
+// timeout if one is not provided or is invalid.
+func queryTimeout(context interface{}, q *query.Query) time.Duration {
+
+	// Set the default timeout for the session.
+	timeout := 25 * time.Second
+	if q.Timeout != "" {
+		if d, err := time.ParseDuration(q.Timeout); err != nil {
+			log.Dev(context, "queryTimeout", "WARNING : Unable to Set Timeout[%s], using default.", q.Timeout)
+		} else {
+			timeout = d
+		}
+	}
+
+	return timeout
+}
+
+// execPipeline executes the sepcified pipeline query.
+func execPipeline(ctx context.Context, context interface{}, db *db.DB, q *query.Query, vars map[string]string, data map[string]interface{}, explain bool, pg *page) (docs, []map[string]interface{}, error) {
+
+	// I am returning commands as the second return value because if there
+	// is an error I need to send how far we got back to the client. If not,
+	// the user will not understand the error message.
+
+	p, err := buildPipeline(context, q, vars, data)
+	if err != nil {
+		return docs{}, p.commands, err
+	}
+
+	// Position the pipeline on the requested page.
+	if pg != nil {
+		if err := pg.apply(context, &p); err != nil {
+			return docs{}, p.commands, newError(CodeCommandInvalid, err)
+		}
+	}
+
+	commands := p.commands
+
 	// Do we want the explain output.
 	if explain {
 
 		// Build the pipeline function for the execution for explain.
 		var m bson.M
 		f := func(c *mgo.Collection) error {
-			log.Dev(context, "executePipeline", "MGO Explain :\ndb.%s.aggregate([\n%s])", c.Name, agg)
-			return c.Pipe(pipeline).Explain(&m)
+			log.Dev(context, "executePipeline", "MGO Explain :\ndb.%s.aggregate([\n%s])", c.Name, p.agg)
+			return c.Pipe(p.stages).Explain(&m)
 		}
 
 		// Execute the pipeline.
@@ -82,80 +146,60 @@ func execPipeline(context interface{}, db *db.DB, q *query.Query, vars map[strin
 		return docs{q.Name, []bson.M{m}}, commands, nil
 	}
 
-	// Set the default timeout for the session.
-	timeout := 25 * time.Second
-	if q.Timeout != "" {
-		if d, err := time.ParseDuration(q.Timeout); err != nil {
-			log.Dev(context, "executePipeline", "WARNING : Unable to Set Timeout[%s], using default.", q.Timeout)
-		} else {
-			timeout = d
-		}
+	// Stop waiting on the database once the query timeout passes
+	// or the caller is no longer interested in the results.
+	ctx, cancel, timeout := withTimeout(ctx, queryTimeout(context, q))
+	defer cancel()
+	log.Dev(context, "executePipeline", "MGO Timeout Set[%s]", timeout)
+
+	if err := ctx.Err(); err != nil {
+		err = stopErr(ctx, err)
+		log.Error(context, "executePipeline", err, "Completed : Before starting")
+		return docs{}, commands, err
 	}
 
-	log.Dev(context, "executePipeline", "MGO Timeout Set[%s]", timeout)
+	// Tag the aggregation so it can be found on the server.
+	tag := opTag()
 
 	// Build the pipeline function for the execution.
 	var results []bson.M
 	f := func(c *mgo.Collection) error {
-		log.Dev(context, "executePipeline", "MGO Started\ndb.%s.aggregate([\n%s])", c.Name, agg)
-		err := c.Pipe(pipeline).All(&results)
-		return err
-	}
-
-	// Set the channel to one because we might not be around
-	// waiting for the result on timeouts.
-	wait := make(chan error, 1)
-
-	// Execute the pipeline.
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Dev(context, "executePipeline", "******> Recovered from timing out")
-			}
-			log.Dev(context, "executePipeline", "MGO Response Complete")
-		}()
+		log.Dev(context, "executePipeline", "MGO Started\ndb.%s.aggregate([\n%s])", c.Name, p.agg)
 
-		wait <- db.ExecuteMGOTimeout(context, timeout, q.Collection, f)
-	}()
-
-	// Did any errors occur.
-	select {
-
-	// Wait for the response from executing the pipeline.
-	case err := <-wait:
-		if err != nil {
-			if _, ok := err.(*net.OpError); ok {
-				log.Error(context, "executePipeline", err, "Timed out Network")
-				return docs{}, commands, errors.New("Completed : Timed out executing commands")
-			}
+		stop := killOnDone(ctx, context, c.Database.Session, tag)
+		defer stop()
 
-			log.Error(context, "executePipeline", err, "Completed")
-			return docs{}, commands, err
-		}
+		return aggregate(c, p.stages, timeout, tag).All(&results)
+	}
 
-	// Wait to timeout the entire operation.
-	case <-time.After(timeout):
-		err := errors.New("Timedout executing commands")
-		log.Error(context, "executePipeline", err, "Completed : Timed out Processing")
+	// Execute the pipeline, the socket timeout is a backstop in case the
+	// server does not stop the aggregation in time.
+	if err := db.ExecuteMGOTimeout(context, timeout+socketSlack, q.Collection, f); err != nil {
+		err = stopErr(ctx, err)
+		log.Error(context, "executePipeline", err, "Completed")
 		return docs{}, commands, err
 	}
 
 	log.Dev(context, "executePipeline", "Completed")
 
-	// If there were no results, return an empty array.
+	// If there were no results, return an empty array. A collection the
+	// results are saved to still needs to reflect there were none.
 	if results == nil {
+		if err := saveNoResults(context, db, p.save); err != nil {
+			return docs{}, commands, commandErr(CodeSaveError, len(q.Commands)-1, err)
+		}
 		return docs{q.Name, []bson.M{}}, commands, nil
 	}
 
 	// Perform any masking that is required.
 	if err := processMasks(context, db, q.Collection, results); err != nil {
-		return docs{}, commands, err
+		return docs{}, commands, newError(CodeMaskError, err)
 	}
 
 	// Do we need to save the result.
-	if save != nil {
-		if err := saveResult(context, save, results, data); err != nil {
-			return docs{}, commands, err
+	if p.save != nil {
+		if err := saveResult(context, db, p.save, results, data); err != nil {
+			return docs{}, commands, commandErr(CodeSaveError, len(q.Commands)-1, err)
 		}
 	}
 
@@ -163,32 +207,50 @@ func execPipeline(context interface{}, db *db.DB, q *query.Query, vars map[strin
 }
 
 // saveResult processes the $save command for this result.
-func saveResult(context interface{}, save map[string]interface{}, results []bson.M, data map[string]interface{}) error {
+func saveResult(context interface{}, db *db.DB, save map[string]interface{}, results []bson.M, data map[string]interface{}) error {
 
 	// {"$map": "list"}
+	// {"$collection": "saved_list", "mode": "replace"}
 
 	// Capture the key and value and process the save.
 	for cmd, value := range save {
-		name, ok := value.(string)
-		if !ok {
+		switch cmd {
+		case "$map", "$collection", "mode":
+		default:
+			err := fmt.Errorf("Invalid save location %q", cmd)
+			log.Error(context, "saveResult", err, "Nothing saved")
+			return err
+		}
+
+		if _, ok := value.(string); !ok {
 			err := fmt.Errorf("Save key \"%v\" is a %T but must be a string", value, value)
 			log.Error(context, "saveResult", err, "Extracting save key")
 			return err
 		}
+	}
 
-		switch cmd {
+	mode, _ := save["mode"].(string)
 
-		// Save the results into the map under the specified key.
-		case "$map":
-			log.Dev(context, "saveResult", "Saving result to map[%s]", name)
-			data[name] = results
-			return nil
+	switch {
 
-		default:
-			err := fmt.Errorf("Invalid save location %q", cmd)
+	// Save the results into the map under the specified key.
+	case save["$map"] != nil:
+		if len(save) != 1 {
+			err := errors.New("Save to a map does not take a mode")
 			log.Error(context, "saveResult", err, "Nothing saved")
 			return err
 		}
+
+		name := save["$map"].(string)
+		log.Dev(context, "saveResult", "Saving result to map[%s]", name)
+		data[name] = results
+		return nil
+
+	// Save the results into the specified collection.
+	case save["$collection"] != nil:
+		name := save["$collection"].(string)
+		log.Dev(context, "saveResult", "Saving result to collection[%s] mode[%s]", name, mode)
+		return writeCollection(context, db, name, mode, results)
 	}
 
 	err := errors.New("Missing save document")
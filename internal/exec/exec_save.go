@@ -0,0 +1,163 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultSaveNamespace is the prefix collections results are saved to must
+// have when no other namespace has been configured.
+const DefaultSaveNamespace = "saved_"
+
+// Set of modes for saving results to a collection.
+const (
+	SaveReplace = "replace"
+	SaveAppend  = "append"
+)
+
+// insertBatch is the number of documents inserted at a time.
+const insertBatch = 1000
+
+// saveNS holds the namespace collections results are saved to must be in.
+var saveNS = struct {
+	sync.RWMutex
+	prefix string
+}{prefix: DefaultSaveNamespace}
+
+// SetSaveNamespace sets the prefix collections results are saved to must have
+// so sets can't overwrite arbitrary data.
+func SetSaveNamespace(prefix string) {
+	saveNS.Lock()
+	{
+		saveNS.prefix = prefix
+	}
+	saveNS.Unlock()
+}
+
+// saveNamespace returns the prefix collections results are saved to must have.
+func saveNamespace() string {
+	saveNS.RLock()
+	defer saveNS.RUnlock()
+
+	return saveNS.prefix
+}
+
+//==============================================================================
+
+// checkSaveCollection validates results can be saved to the collection.
+func checkSaveCollection(name string) error {
+	ns := saveNamespace()
+
+	if ns == "" || !strings.HasPrefix(name, ns) || len(name) == len(ns) {
+		return fmt.Errorf("Collection %q is outside the save namespace %q", name, ns)
+	}
+
+	if strings.ContainsAny(name, "$\x00") {
+		return fmt.Errorf("Invalid save collection %q", name)
+	}
+
+	return nil
+}
+
+// writeCollection writes the results to the collection. In replace mode the
+// results are written to a temporary collection first which then takes the
+// place of the collection, so readers never see a partial set of results.
+func writeCollection(context interface{}, db *db.DB, name string, mode string, results []bson.M) error {
+	log.Dev(context, "writeCollection", "Started : Collection[%s] Mode[%s] Docs[%d]", name, mode, len(results))
+
+	if err := checkSaveCollection(name); err != nil {
+		log.Error(context, "writeCollection", err, "Checking collection")
+		return err
+	}
+
+	var f func(c *mgo.Collection) error
+
+	switch mode {
+	case SaveAppend:
+		f = func(c *mgo.Collection) error {
+			return insertAll(c, results)
+		}
+
+	case "", SaveReplace:
+		f = func(c *mgo.Collection) error {
+
+			// Nothing to write so the collection is emptied.
+			if len(results) == 0 {
+				_, err := c.RemoveAll(nil)
+				return err
+			}
+
+			tmp := c.Database.C(name + ".tmp_" + bson.NewObjectId().Hex())
+			if err := insertAll(tmp, results); err != nil {
+				tmp.DropCollection()
+				return err
+			}
+
+			cmd := bson.D{
+				{Name: "renameCollection", Value: tmp.FullName},
+				{Name: "to", Value: c.FullName},
+				{Name: "dropTarget", Value: true},
+			}
+
+			if err := c.Database.Session.Run(cmd, nil); err != nil {
+				tmp.DropCollection()
+				return err
+			}
+
+			return nil
+		}
+
+	default:
+		err := fmt.Errorf("Invalid save mode %q", mode)
+		log.Error(context, "writeCollection", err, "Checking mode")
+		return err
+	}
+
+	if err := db.ExecuteMGO(context, name, f); err != nil {
+		log.Error(context, "writeCollection", err, "Completed")
+		return err
+	}
+
+	log.Dev(context, "writeCollection", "Completed")
+	return nil
+}
+
+// saveNoResults processes the $save command of a query that returned no
+// results. A collection saved to in replace mode is emptied, while nothing is
+// saved to a map so #data lookups report the missing results.
+func saveNoResults(context interface{}, db *db.DB, save map[string]interface{}) error {
+	if save == nil || save["$collection"] == nil {
+		return nil
+	}
+
+	return saveResult(context, db, save, []bson.M{}, nil)
+}
+
+// insertAll inserts the documents into the collection in batches.
+func insertAll(c *mgo.Collection, results []bson.M) error {
+	for len(results) > 0 {
+		n := insertBatch
+		if n > len(results) {
+			n = len(results)
+		}
+
+		docs := make([]interface{}, n)
+		for i := range docs {
+			docs[i] = results[i]
+		}
+
+		if err := c.Insert(docs...); err != nil {
+			return err
+		}
+
+		results = results[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxSetDepth is the maximum number of sets that can be executing inside each
+// other through set queries.
+const maxSetDepth = 5
+
+// setChainKey is the context key for the names of the sets being executed.
+type setChainKey struct{}
+
+// setChain returns the names of the sets being executed, outermost first.
+func setChain(ctx context.Context) []string {
+	chain, _ := ctx.Value(setChainKey{}).([]string)
+	return chain
+}
+
+// enterSet returns a context recording the set is being executed.
+func enterSet(ctx context.Context, name string) context.Context {
+	chain := setChain(ctx)
+
+	// Copy the names so sets executing side by side don't share them.
+	next := make([]string, len(chain), len(chain)+1)
+	copy(next, chain)
+
+	return context.WithValue(ctx, setChainKey{}, append(next, name))
+}
+
+//==============================================================================
+
+// execSet executes the stored set named by the query with the variables the
+// query maps into it. The documents of the queries the set returns are the
+// documents of the query.
+func execSet(ctx context.Context, context interface{}, db *db.DB, q *query.Query, vars map[string]string, data map[string]interface{}, explain bool) (docs, []map[string]interface{}, error) {
+	log.Dev(context, "execSet", "Started : Set[%s]", q.Set)
+
+	// Don't allow a set to execute itself or sets to nest without end.
+	chain := setChain(ctx)
+	if err := checkSetChain(chain, q.Set); err != nil {
+		log.Error(context, "execSet", err, "Completed : Checking chain")
+		return docs{}, q.Commands, newError(CodeSetInvalid, err)
+	}
+
+	// Build the variables for the set from the variables of this set and
+	// the data saved by the earlier queries.
+	setVars, err := buildSetVars(context, q, vars, data)
+	if err != nil {
+		log.Error(context, "execSet", err, "Completed : Building variables")
+		return docs{}, q.Commands, asError(CodeCommandInvalid, err)
+	}
+
+	set, err := query.GetByName(context, db, q.Set)
+	if err != nil {
+		code := CodeMongoError
+		if err == query.ErrNotFound {
+			code = CodeSetInvalid
+		}
+
+		err = fmt.Errorf("Set %q : %v", q.Set, err)
+		log.Error(context, "execSet", err, "Completed : Loading set")
+		return docs{}, q.Commands, newError(code, err)
+	}
+	set.Explain = explain
+
+	// Bound the execution of the set by the query timeout.
+	ctx, cancel, _ := withTimeout(ctx, queryTimeout(context, q))
+	defer cancel()
+
+	r := ExecContext(ctx, context, db, set, setVars, "")
+	if r.Err != nil {
+		e := asError(CodeInternal, r.Err)
+
+		msg := fmt.Sprintf("Set %q : %s", q.Set, e.Message)
+		if e.Query != "" {
+			msg = fmt.Sprintf("Set %q query %q : %s", q.Set, e.Query, e.Message)
+		}
+
+		err := &Error{Code: e.Code, Message: msg, err: e}
+		log.Error(context, "execSet", err, "Completed")
+		return docs{}, q.Commands, err
+	}
+
+	// Collect the documents of the queries the set returns.
+	results := []bson.M{}
+	if setDocs, ok := r.Results.([]docs); ok {
+		for _, d := range setDocs {
+			results = append(results, d.Docs...)
+		}
+	}
+
+	log.Dev(context, "execSet", "Completed : Docs[%d]", len(results))
+
+	// The explain output is never saved.
+	if explain {
+		return docs{q.Name, results}, q.Commands, nil
+	}
+
+	// Do we need to save the result.
+	if len(q.Commands) == 1 {
+		if save, ok := q.Commands[0]["$save"].(map[string]interface{}); ok {
+			var err error
+			if len(results) == 0 {
+				err = saveNoResults(context, db, save)
+			} else {
+				err = saveResult(context, db, save, results, data)
+			}
+
+			if err != nil {
+				return docs{}, q.Commands, commandErr(CodeSaveError, 0, err)
+			}
+		}
+	}
+
+	return docs{q.Name, results}, q.Commands, nil
+}
+
+// checkSetChain validates the set can be executed by the sets in the chain.
+func checkSetChain(chain []string, name string) error {
+	for _, n := range chain {
+		if n == name {
+			return fmt.Errorf("Set %q executes itself : %s", name, strings.Join(append(chain, name), " -> "))
+		}
+	}
+
+	if len(chain) >= maxSetDepth {
+		return fmt.Errorf("Set %q is nested more than %d sets deep", name, maxSetDepth)
+	}
+
+	return nil
+}
+
+// buildSetVars performs the variable substitutions on the variables the query
+// passes to the set and returns them in the form stored in the variables.
+func buildSetVars(context interface{}, q *query.Query, vars map[string]string, data map[string]interface{}) (map[string]string, error) {
+
+	// Substitute the values in a copy so the query is not changed.
+	doc := copyDoc(q.Vars)
+	if err := ProcessVariables(context, doc, vars, data); err != nil {
+		return nil, err
+	}
+
+	setVars := make(map[string]string, len(doc))
+	for name, v := range doc {
+		value, err := varString(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for variable %q : %v", name, err)
+		}
+		setVars[name] = value
+	}
+
+	return setVars, nil
+}
+
+// varString returns the form of a substituted value stored in the variables.
+// Arrays are stored as multiple values.
+func varString(v interface{}) (string, error) {
+	switch sv := v.(type) {
+	case bson.ObjectId:
+		return sv.Hex(), nil
+
+	case time.Time:
+		return sv.UTC().Format("2006-01-02T15:04:05.000Z"), nil
+
+	case []interface{}:
+		list := make([]string, len(sv))
+		for i, item := range sv {
+			s, err := varString(item)
+			if err != nil {
+				return "", err
+			}
+			list[i] = s
+		}
+
+		return EncodeValues(list), nil
+	}
+
+	return EncodeJSON(v)
+}
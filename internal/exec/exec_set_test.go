@@ -0,0 +1,103 @@
+package exec
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestSetChain tests sets can't execute themselves or nest too deep.
+func TestSetChain(t *testing.T) {
+	t.Log("Given the need to execute sets inside each other.")
+	{
+		ctx := enterSet(context.Background(), "outer")
+		ctx = enterSet(ctx, "users")
+
+		t.Log("\tWhen executing a set not in the chain")
+		{
+			if err := checkSetChain(setChain(ctx), "assets"); err != nil {
+				t.Fatalf("\t%s\tShould be able to execute the set : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to execute the set.", tests.Success)
+		}
+
+		t.Log("\tWhen executing a set already in the chain")
+		{
+			if err := checkSetChain(setChain(ctx), "outer"); err == nil {
+				t.Fatalf("\t%s\tShould not be able to execute the set.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not be able to execute the set.", tests.Success)
+		}
+
+		t.Log("\tWhen executing a set too deep")
+		{
+			deep := ctx
+			for _, name := range []string{"a", "b", "c"} {
+				deep = enterSet(deep, name)
+			}
+
+			if err := checkSetChain(setChain(deep), "assets"); err == nil {
+				t.Fatalf("\t%s\tShould not be able to execute the set.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not be able to execute the set.", tests.Success)
+
+			if exp := []string{"outer", "users"}; !reflect.DeepEqual(setChain(ctx), exp) {
+				t.Fatalf("\t%s\tShould not change the outer chain : %v", tests.Failed, setChain(ctx))
+			}
+			t.Logf("\t%s\tShould not change the outer chain.", tests.Success)
+		}
+	}
+}
+
+// TestSetVars tests the variables passed to a set are substituted and stored
+// in the form of the variables.
+func TestSetVars(t *testing.T) {
+	q := query.Query{
+		Name: "Users",
+		Type: query.TypeSet,
+		Set:  "resolve_users",
+		Vars: map[string]interface{}{
+			"user_id": "#string:id",
+			"ids":     "#data.*:list.id",
+			"limit":   float64(25),
+			"asset":   "#objid:asset",
+		},
+	}
+
+	vars := map[string]string{"id": "123", "asset": "5660bc6e16908cae692e0593"}
+	data := map[string]interface{}{"list": []bson.M{{"id": "a"}, {"id": "b"}}}
+
+	exp := map[string]string{
+		"user_id": "123",
+		"ids":     `["a","b"]`,
+		"limit":   "25",
+		"asset":   "5660bc6e16908cae692e0593",
+	}
+
+	t.Log("Given the need to pass variables to a set.")
+	{
+		t.Log("\tWhen using variable commands and literal values")
+		{
+			setVars, err := buildSetVars(tests.Context, &q, vars, data)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to build the variables : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to build the variables.", tests.Success)
+
+			if !reflect.DeepEqual(setVars, exp) {
+				t.Fatalf("\t%s\tShould get the expected variables : %v", tests.Failed, setVars)
+			}
+			t.Logf("\t%s\tShould get the expected variables.", tests.Success)
+
+			if q.Vars["user_id"] != "#string:id" {
+				t.Fatalf("\t%s\tShould not change the query : %v", tests.Failed, q.Vars)
+			}
+			t.Logf("\t%s\tShould not change the query.", tests.Success)
+		}
+	}
+}
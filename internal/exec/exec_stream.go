@@ -0,0 +1,244 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// streamDoc represents a single document written to the stream.
+type streamDoc struct {
+	Name string
+	Doc  bson.M
+}
+
+// flusher is implemented by writers that buffer, like http.ResponseWriter,
+// and can send what has been buffered on demand.
+type flusher interface {
+	Flush()
+}
+
+//==============================================================================
+
+// Stream executes the specified query set writing each document to the writer
+// as newline delimited JSON as it is read from the database. Documents are only
+// held in memory when a query needs to $save its results for later queries.
+// Any query still running on the server is killed when ctx is done or the set
+// timeout passes.
+func Stream(ctx context.Context, context interface{}, db *db.DB, set *query.Set, vars map[string]string, w io.Writer) error {
+	log.Dev(context, "Stream", "Started : Name[%s]", set.Name)
+
+	enc := json.NewEncoder(w)
+
+	// If we have been provided a nil map, make one.
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+
+	// Validate the set and get it ready to be executed.
+	if err := prepare(context, db, set, vars); err != nil {
+		enc.Encode(bson.M{"error": err.Error()})
+		log.Error(context, "Stream", err, "Completed : Preparing set")
+		return err
+	}
+
+	// Bound the execution of all the queries by the set timeout.
+	ctx, cancel := withSetTimeout(ctx, set)
+	defer cancel()
+
+	// Record the set is executing so set queries can't execute it again.
+	ctx = enterSet(ctx, set.Name)
+
+	// Hold any data we have been asked to save.
+	data := make(map[string]interface{})
+
+	// Iterate over the set of queries.
+	for _, q := range set.Queries {
+		var commands []map[string]interface{}
+		var err error
+
+		// Is the query only executed under some condition.
+		if !shouldExec(&q, vars, data) {
+			log.Dev(context, "Stream", "Skipping Query[%s] : Condition", q.Name)
+			continue
+		}
+
+		// Don't change the commands of the set with the substitutions.
+		q.Commands = copyCommands(q.Commands)
+
+		switch strings.ToLower(q.Type) {
+		case query.TypePipeline:
+			commands, err = streamPipeline(ctx, context, db, &q, vars, data, set.Explain, enc)
+
+		default:
+			commands, err = streamQuery(ctx, context, db, &q, vars, data, set.Explain, enc)
+		}
+
+		// Was there an error processing the query.
+		if err != nil {
+			err = queryErr(q.Name, err)
+
+			// Were we told to continue to the next one.
+			if q.Continue {
+				continue
+			}
+
+			// We need to write the error with the commands.
+			enc.Encode(bson.M{"error": err.Error(), "commands": commands})
+			flush(w)
+
+			log.Error(context, "Stream", err, "Completed : Executing Query[%s]", q.Name)
+			return err
+		}
+
+		// Send the results for this query on their way.
+		flush(w)
+	}
+
+	log.Dev(context, "Stream", "Completed")
+	return nil
+}
+
+// flush sends any buffered data if the writer supports it.
+func flush(w io.Writer) {
+	if f, ok := w.(flusher); ok {
+		f.Flush()
+	}
+}
+
+// streamQuery executes the specified query and writes its documents to the
+// encoder once they have all been read from the database.
+func streamQuery(ctx context.Context, context interface{}, db *db.DB, q *query.Query, vars map[string]string, data map[string]interface{}, explain bool, enc *json.Encoder) ([]map[string]interface{}, error) {
+	o := execQuery(ctx, context, db, q, vars, data, explain, nil)
+	if o.err != nil {
+		return o.commands, o.err
+	}
+
+	if q.Return {
+		for _, doc := range o.result.Docs {
+			if err := enc.Encode(streamDoc{q.Name, doc}); err != nil {
+				return o.commands, err
+			}
+		}
+	}
+
+	return o.commands, nil
+}
+
+// streamPipeline executes the specified pipeline query writing each document
+// to the encoder as it is read from the database.
+func streamPipeline(ctx context.Context, context interface{}, db *db.DB, q *query.Query, vars map[string]string, data map[string]interface{}, explain bool, enc *json.Encoder) ([]map[string]interface{}, error) {
+
+	// The explain output is a single document so there is nothing to stream.
+	if explain {
+		result, commands, err := execPipeline(ctx, context, db, q, vars, data, explain, nil)
+		if err != nil {
+			return commands, err
+		}
+
+		if q.Return {
+			for _, doc := range result.Docs {
+				if err := enc.Encode(streamDoc{q.Name, doc}); err != nil {
+					return commands, err
+				}
+			}
+		}
+
+		return commands, nil
+	}
+
+	p, err := buildPipeline(context, q, vars, data)
+	if err != nil {
+		return p.commands, err
+	}
+
+	// Load the masks once for all the documents we will process.
+	masks := loadMasks(context, db, q.Collection)
+
+	// Stop reading from the database once the query timeout passes
+	// or the client is no longer interested in the results.
+	ctx, cancel, timeout := withTimeout(ctx, queryTimeout(context, q))
+	defer cancel()
+	log.Dev(context, "streamPipeline", "MGO Timeout Set[%s]", timeout)
+
+	if err := ctx.Err(); err != nil {
+		err = stopErr(ctx, err)
+		log.Error(context, "streamPipeline", err, "Completed : Before starting")
+		return p.commands, err
+	}
+
+	// Tag the aggregation so it can be found on the server.
+	tag := opTag()
+
+	// Only keep the documents around if they need to be saved.
+	var results []bson.M
+
+	// Build the pipeline function for the execution.
+	f := func(c *mgo.Collection) error {
+		log.Dev(context, "streamPipeline", "MGO Started\ndb.%s.aggregate([\n%s])", c.Name, p.agg)
+
+		stop := killOnDone(ctx, context, c.Database.Session, tag)
+		defer stop()
+
+		iter := aggregate(c, p.stages, timeout, tag)
+
+		// A new map is needed for every document since saved
+		// documents can't be overwritten by the next one.
+		var doc bson.M
+		for ; iter.Next(&doc); doc = nil {
+
+			// Perform any masking that is required.
+			if masks != nil {
+				if err := matchMaskField(context, masks, doc); err != nil {
+					iter.Close()
+					return newError(CodeMaskError, err)
+				}
+			}
+
+			if p.save != nil {
+				results = append(results, doc)
+			}
+
+			if q.Return {
+				if err := enc.Encode(streamDoc{q.Name, doc}); err != nil {
+					iter.Close()
+					return err
+				}
+			}
+		}
+
+		return iter.Close()
+	}
+
+	if err := db.ExecuteMGOTimeout(context, timeout+socketSlack, q.Collection, f); err != nil {
+		err = stopErr(ctx, err)
+		log.Error(context, "streamPipeline", err, "Completed")
+		return p.commands, err
+	}
+
+	// Do we need to save the result. A collection the results are saved
+	// to still needs to reflect there were none.
+	if p.save != nil {
+		var err error
+		if len(results) == 0 {
+			err = saveNoResults(context, db, p.save)
+		} else {
+			err = saveResult(context, db, p.save, results, data)
+		}
+
+		if err != nil {
+			return p.commands, commandErr(CodeSaveError, len(q.Commands)-1, err)
+		}
+	}
+
+	log.Dev(context, "streamPipeline", "Completed")
+	return p.commands, nil
+}
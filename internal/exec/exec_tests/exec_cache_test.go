@@ -0,0 +1,130 @@
+package exec_test
+
+import (
+	"testing"
+
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/internal/query/qfix"
+	"github.com/coralproject/xenia/tstdata"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestExecCache tests the results of a set are cached based on its ttl.
+func TestExecCache(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	db, err := db.NewMGO(tests.Context, tests.TestSession)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	t.Log("Given the need to load the test data.")
+	{
+		loadTestData(t, db)
+	}
+
+	defer func() {
+		t.Log("Given the need to unload the test data.")
+		{
+			unloadTestData(t, db)
+		}
+	}()
+
+	newSet := func() *query.Set {
+		return &query.Set{
+			Name:     "Cache",
+			Enabled:  true,
+			CacheTTL: "1m",
+			Queries: []query.Query{
+				{
+					Name:       "Cache",
+					Type:       "pipeline",
+					Collection: tstdata.CollectionExecTest,
+					Return:     true,
+					Commands: []map[string]interface{}{
+						{"$match": map[string]interface{}{"station_id": "#string:station_id"}},
+						{"$project": map[string]interface{}{"_id": 0, "name": 1}},
+					},
+				},
+			},
+		}
+	}
+
+	runs := []struct {
+		station string
+		cache   string
+	}{
+		{"42021", query.CacheMiss},
+		{"42021", query.CacheHit},
+		{"44005", query.CacheMiss},
+	}
+
+	t.Log("Given the need to cache the results of a set.")
+	{
+		for _, run := range runs {
+			t.Logf("\tWhen using station %s", run.station)
+			{
+				vars := map[string]string{"station_id": run.station}
+
+				result := exec.Exec(tests.Context, db, newSet(), vars)
+				if result.Cache != run.cache {
+					t.Fatalf("\t%s\tShould get a cache %s : %q : %+v", tests.Failed, run.cache, result.Cache, result.Results)
+				}
+				t.Logf("\t%s\tShould get a cache %s.", tests.Success, run.cache)
+			}
+		}
+
+		t.Log("\tWhen executing the set without the cache")
+		{
+			vars := map[string]string{"station_id": "42021"}
+
+			result := exec.ExecFresh(tests.Context, db, newSet(), vars)
+			if result.Cache != query.CacheMiss {
+				t.Fatalf("\t%s\tShould get a cache %s : %q : %+v", tests.Failed, query.CacheMiss, result.Cache, result.Results)
+			}
+			t.Logf("\t%s\tShould get a cache %s.", tests.Success, query.CacheMiss)
+		}
+
+		t.Log("\tWhen the set executes a set that saves to a collection")
+		{
+			inner := query.Set{
+				Name:    "QTEST_T_cache_inner",
+				Enabled: true,
+				Queries: []query.Query{
+					{
+						Name:       "Save",
+						Type:       query.TypePipeline,
+						Collection: tstdata.CollectionExecTest,
+						Commands: []map[string]interface{}{
+							{"$project": map[string]interface{}{"_id": 0, "station_id": 1}},
+							{"$save": map[string]interface{}{"$collection": exec.DefaultSaveNamespace + "test_xenia_cache"}},
+						},
+					},
+				},
+			}
+
+			if err := qfix.Add(db, &inner); err != nil {
+				t.Fatalf("\t%s\tShould be able to add the inner set : %v", tests.Failed, err)
+			}
+			defer qfix.Remove(db, "QTEST_T_cache")
+
+			set := query.Set{
+				Name:     "QTEST_T_cache_outer",
+				Enabled:  true,
+				CacheTTL: "1m",
+				Queries:  []query.Query{{Name: "Inner", Type: query.TypeSet, Set: inner.Name}},
+			}
+
+			result := exec.Exec(tests.Context, db, &set, map[string]string{})
+			if e, ok := result.Err.(*exec.Error); !ok || e.Code != exec.CodeSetInvalid {
+				t.Fatalf("\t%s\tShould not be able to cache the results : %v", tests.Failed, result.Err)
+			}
+			t.Logf("\t%s\tShould not be able to cache the results.", tests.Success)
+		}
+	}
+}
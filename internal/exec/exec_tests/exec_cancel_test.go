@@ -0,0 +1,88 @@
+package exec_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/tstdata"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/tests"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestExecCancel tests a set stops executing when its context is done or its
+// timeout passes.
+func TestExecCancel(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	db, err := db.NewMGO(tests.Context, tests.TestSession)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	t.Log("Given the need to load the test data.")
+	{
+		loadTestData(t, db)
+	}
+
+	defer func() {
+		t.Log("Given the need to unload the test data.")
+		{
+			unloadTestData(t, db)
+		}
+	}()
+
+	newSet := func(timeout string) *query.Set {
+		return &query.Set{
+			Name:    "Cancel",
+			Enabled: true,
+			Timeout: timeout,
+			Queries: []query.Query{
+				{
+					Name:       "Cancel",
+					Type:       "pipeline",
+					Collection: tstdata.CollectionExecTest,
+					Return:     true,
+					Commands: []map[string]interface{}{
+						{"$match": map[string]interface{}{"station_id": "42021"}},
+						{"$project": map[string]interface{}{"_id": 0, "name": 1}},
+					},
+				},
+			},
+		}
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	runs := []struct {
+		when    string
+		ctx     context.Context
+		timeout string
+		err     error
+	}{
+		{"the context is canceled", canceled, "", exec.ErrCanceled},
+		{"the set timeout passes", context.Background(), "1ns", exec.ErrTimeout},
+	}
+
+	t.Log("Given the need to stop executing a set.")
+	{
+		for _, run := range runs {
+			t.Logf("\tWhen %s", run.when)
+			{
+				result := exec.ExecContext(run.ctx, tests.Context, db, newSet(run.timeout), nil, "")
+
+				m, ok := result.Results.(bson.M)
+				if !ok || m["error"] != run.err.Error() {
+					t.Fatalf("\t%s\tShould get back the error %q : %+v", tests.Failed, run.err, result.Results)
+				}
+				t.Logf("\t%s\tShould get back the error %q.", tests.Success, run.err)
+			}
+		}
+	}
+}
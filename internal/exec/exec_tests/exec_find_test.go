@@ -0,0 +1,144 @@
+package exec_test
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/tstdata"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestExecFind tests the execution of find, count and distinct queries.
+func TestExecFind(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	db, err := db.NewMGO(tests.Context, tests.TestSession)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	t.Log("Given the need to load the test data.")
+	{
+		loadTestData(t, db)
+	}
+
+	defer func() {
+		t.Log("Given the need to unload the test data.")
+		{
+			unloadTestData(t, db)
+		}
+	}()
+
+	match := map[string]interface{}{"$match": map[string]interface{}{"station_id": map[string]interface{}{"$in": "#strings:stations"}}}
+
+	set := query.Set{
+		Name:    "Find",
+		Enabled: true,
+		Queries: []query.Query{
+			{
+				Name:       "Find",
+				Type:       query.TypeFind,
+				Collection: tstdata.CollectionExecTest,
+				Return:     true,
+				Commands: []map[string]interface{}{
+					match,
+					{"$project": map[string]interface{}{"_id": 0, "station_id": 1}},
+					{"$sort": []interface{}{"-station_id"}},
+					{"$limit": 2},
+				},
+			},
+			{
+				Name:       "Count",
+				Type:       query.TypeCount,
+				Collection: tstdata.CollectionExecTest,
+				Return:     true,
+				Commands: []map[string]interface{}{
+					match,
+				},
+			},
+			{
+				Name:       "Distinct",
+				Type:       query.TypeDistinct,
+				Collection: tstdata.CollectionExecTest,
+				Return:     true,
+				Commands: []map[string]interface{}{
+					match,
+					{"$distinct": "station_id"},
+				},
+			},
+		},
+	}
+
+	vars := map[string]string{"stations": exec.EncodeValues([]string{"42021", "44005", "44008"})}
+
+	t.Log("Given the need to execute find, count and distinct queries.")
+	{
+		t.Log("\tWhen using a set with one query of each type")
+		{
+			result := exec.Exec(tests.Context, db, &set, vars)
+
+			data, err := json.Marshal(result)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to marshal the result : %s", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to marshal the result.", tests.Success)
+
+			var res struct {
+				Results []docs
+			}
+			if err := json.Unmarshal(data, &res); err != nil || len(res.Results) != 3 {
+				t.Fatalf("\t%s\tShould get back three results : %s", tests.Failed, data)
+			}
+			t.Logf("\t%s\tShould get back three results.", tests.Success)
+
+			var found []string
+			for _, doc := range res.Results[0].Docs {
+				found = append(found, doc["station_id"].(string))
+			}
+			if len(found) != 2 || found[0] != "44008" || found[1] != "44005" {
+				t.Fatalf("\t%s\tShould find the last two stations in order : %v", tests.Failed, found)
+			}
+			t.Logf("\t%s\tShould find the last two stations in order.", tests.Success)
+
+			count := res.Results[1].Docs
+			if len(count) != 1 || count[0]["count"] != float64(3) {
+				t.Fatalf("\t%s\tShould count three stations : %v", tests.Failed, count)
+			}
+			t.Logf("\t%s\tShould count three stations.", tests.Success)
+
+			var distinct []string
+			for _, doc := range res.Results[2].Docs {
+				distinct = append(distinct, doc["station_id"].(string))
+			}
+			sort.Strings(distinct)
+			if len(distinct) != 3 || distinct[0] != "42021" || distinct[2] != "44008" {
+				t.Fatalf("\t%s\tShould get the three distinct stations : %v", tests.Failed, distinct)
+			}
+			t.Logf("\t%s\tShould get the three distinct stations.", tests.Success)
+		}
+
+		t.Log("\tWhen using a find query with a pipeline command")
+		{
+			bad := query.Query{
+				Name:       "Bad",
+				Type:       query.TypeFind,
+				Collection: tstdata.CollectionExecTest,
+				Commands: []map[string]interface{}{
+					{"$group": map[string]interface{}{"_id": "$station_id"}},
+				},
+			}
+
+			if err := bad.Validate(); err == nil {
+				t.Fatalf("\t%s\tShould not be able to validate the query.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not be able to validate the query.", tests.Success)
+		}
+	}
+}
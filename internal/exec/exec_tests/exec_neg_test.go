@@ -356,7 +356,8 @@ func dataInMalformed() execSet {
 	}
 }
 
-// mongoRegexMalformed1 performs a Mongo malformed regex inside the pipeline.
+// mongoRegexMalformed1 performs a Mongo regex naming a missing variable inside
+// the pipeline.
 func mongoRegexMalformed1() execSet {
 	return execSet{
 		fail: true,
@@ -377,7 +378,7 @@ func mongoRegexMalformed1() execSet {
 			},
 		},
 		results: []string{
-			`{"results":{"commands":[{"$match":{"name":"#regex:east"}},{"$group":{"_id":"station_id","count":{"$sum":1}}}],"error":"Parameter \"east\" is not a regular expression"}}`,
+			`{"results":{"commands":[{"$match":{"name":"#regex:east"}},{"$group":{"_id":"station_id","count":{"$sum":1}}}],"error":"Variable \"east\" is missing at $match.name"}}`,
 		},
 	}
 }
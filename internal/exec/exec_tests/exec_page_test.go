@@ -0,0 +1,113 @@
+package exec_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/tstdata"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestExecPaginate tests the ability to page through the results of a set.
+func TestExecPaginate(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	db, err := db.NewMGO(tests.Context, tests.TestSession)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	t.Log("Given the need to load the test data.")
+	{
+		loadTestData(t, db)
+	}
+
+	defer func() {
+		t.Log("Given the need to unload the test data.")
+		{
+			unloadTestData(t, db)
+		}
+	}()
+
+	set := query.Set{
+		Name:    "Paginate",
+		Enabled: true,
+		Queries: []query.Query{
+			{
+				Name:       "Paginate",
+				Type:       "pipeline",
+				Collection: tstdata.CollectionExecTest,
+				Return:     true,
+				Paginate:   true,
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"station_id": map[string]interface{}{"$in": []interface{}{"42021", "44005", "44008"}}}},
+					{"$project": map[string]interface{}{"station_id": 1}},
+					{"$sort": map[string]interface{}{"station_id": 1}},
+					{"$limit": 2},
+				},
+			},
+		},
+	}
+
+	pages := []struct {
+		stations []string
+		more     bool
+	}{
+		{[]string{"42021", "44005"}, true},
+		{[]string{"44008"}, false},
+	}
+
+	t.Log("Given the need to page through the results of a set.")
+	{
+		var cursor string
+		for i, pg := range pages {
+			t.Logf("\tWhen requesting page %d", i+1)
+			{
+				result := exec.ExecContext(context.Background(), tests.Context, db, &set, nil, cursor)
+
+				data, err := json.Marshal(result)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to marshal the result : %s", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to marshal the result.", tests.Success)
+
+				var res struct {
+					Results []docs
+					Next    string
+				}
+				if err := json.Unmarshal(data, &res); err != nil {
+					t.Fatalf("\t%s\tShould get back documents : %s : %s", tests.Failed, err, data)
+				}
+				t.Logf("\t%s\tShould get back documents.", tests.Success)
+
+				rslts := res.Results
+
+				if len(rslts) != 1 || len(rslts[0].Docs) != len(pg.stations) {
+					t.Fatalf("\t%s\tShould get back %d documents : %+v", tests.Failed, len(pg.stations), rslts)
+				}
+				t.Logf("\t%s\tShould get back %d documents.", tests.Success, len(pg.stations))
+
+				for j, doc := range rslts[0].Docs {
+					if doc["station_id"] != pg.stations[j] {
+						t.Fatalf("\t%s\tShould get back station %q : %+v", tests.Failed, pg.stations[j], doc)
+					}
+				}
+				t.Logf("\t%s\tShould get back the stations in order.", tests.Success)
+
+				if (res.Next != "") != pg.more {
+					t.Fatalf("\t%s\tShould get back a cursor only when there are more pages : %q", tests.Failed, res.Next)
+				}
+				t.Logf("\t%s\tShould get back a cursor only when there are more pages.", tests.Success)
+
+				cursor = res.Next
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package exec_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/tstdata"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/tests"
+	"gopkg.in/mgo.v2"
+)
+
+// savedCollection is the collection the test saves results to.
+const savedCollection = exec.DefaultSaveNamespace + "test_xenia_data"
+
+// TestExecSaveCollection tests results can be saved to a collection within
+// the save namespace.
+func TestExecSaveCollection(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	db, err := db.NewMGO(tests.Context, tests.TestSession)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	t.Log("Given the need to load the test data.")
+	{
+		loadTestData(t, db)
+	}
+
+	defer func() {
+		t.Log("Given the need to unload the test data.")
+		{
+			unloadTestData(t, db)
+
+			f := func(c *mgo.Collection) error {
+				return c.DropCollection()
+			}
+			db.ExecuteMGO(tests.Context, savedCollection, f)
+		}
+	}()
+
+	save := func(name string, mode string, station string) query.Set {
+		return query.Set{
+			Name:    "Save",
+			Enabled: true,
+			Queries: []query.Query{
+				{
+					Name:       "Save",
+					Type:       query.TypePipeline,
+					Collection: tstdata.CollectionExecTest,
+					Return:     true,
+					Commands: []map[string]interface{}{
+						{"$match": map[string]interface{}{"station_id": station}},
+						{"$project": map[string]interface{}{"_id": 0, "station_id": 1}},
+						{"$save": map[string]interface{}{"$collection": name, "mode": mode}},
+					},
+				},
+			},
+		}
+	}
+
+	count := func() int {
+		var n int
+		f := func(c *mgo.Collection) error {
+			var err error
+			n, err = c.Count()
+			return err
+		}
+
+		if err := db.ExecuteMGO(tests.Context, savedCollection, f); err != nil {
+			t.Fatalf("\t%s\tShould be able to count the saved documents : %v", tests.Failed, err)
+		}
+
+		return n
+	}
+
+	t.Log("Given the need to save results to a collection.")
+	{
+		t.Log("\tWhen saving to a collection in the save namespace")
+		{
+			set := save(savedCollection, exec.SaveReplace, "42021")
+
+			for i := 0; i < 2; i++ {
+				if result := exec.Exec(tests.Context, db, &set, map[string]string{}); result.Err != nil {
+					t.Fatalf("\t%s\tShould be able to execute the set : %v", tests.Failed, result.Results)
+				}
+			}
+			t.Logf("\t%s\tShould be able to execute the set.", tests.Success)
+
+			if n := count(); n != 1 {
+				t.Fatalf("\t%s\tShould replace the saved documents : %d", tests.Failed, n)
+			}
+			t.Logf("\t%s\tShould replace the saved documents.", tests.Success)
+
+			set = save(savedCollection, exec.SaveAppend, "42021")
+			if result := exec.Exec(tests.Context, db, &set, map[string]string{}); result.Err != nil {
+				t.Fatalf("\t%s\tShould be able to execute the set : %v", tests.Failed, result.Results)
+			}
+
+			if n := count(); n != 2 {
+				t.Fatalf("\t%s\tShould append to the saved documents : %d", tests.Failed, n)
+			}
+			t.Logf("\t%s\tShould append to the saved documents.", tests.Success)
+		}
+
+		t.Log("\tWhen replacing the saved documents with no results")
+		{
+			set := save(savedCollection, exec.SaveReplace, "00000")
+			if result := exec.Exec(tests.Context, db, &set, map[string]string{}); result.Err != nil {
+				t.Fatalf("\t%s\tShould be able to execute the set : %v", tests.Failed, result.Results)
+			}
+			t.Logf("\t%s\tShould be able to execute the set.", tests.Success)
+
+			if n := count(); n != 0 {
+				t.Fatalf("\t%s\tShould empty the saved documents : %d", tests.Failed, n)
+			}
+			t.Logf("\t%s\tShould empty the saved documents.", tests.Success)
+		}
+
+		t.Log("\tWhen streaming no results over the saved documents")
+		{
+			set := save(savedCollection, exec.SaveReplace, "42021")
+			if result := exec.Exec(tests.Context, db, &set, map[string]string{}); result.Err != nil {
+				t.Fatalf("\t%s\tShould be able to execute the set : %v", tests.Failed, result.Results)
+			}
+
+			if n := count(); n != 1 {
+				t.Fatalf("\t%s\tShould save the documents : %d", tests.Failed, n)
+			}
+
+			var buf bytes.Buffer
+			set = save(savedCollection, exec.SaveReplace, "00000")
+			if err := exec.Stream(context.Background(), tests.Context, db, &set, map[string]string{}, &buf); err != nil {
+				t.Fatalf("\t%s\tShould be able to stream the set : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to stream the set.", tests.Success)
+
+			if n := count(); n != 0 {
+				t.Fatalf("\t%s\tShould empty the saved documents : %d", tests.Failed, n)
+			}
+			t.Logf("\t%s\tShould empty the saved documents.", tests.Success)
+		}
+
+		t.Log("\tWhen an earlier query fails")
+		{
+			set := save(savedCollection, exec.SaveReplace, "42021")
+			fail := query.Query{
+				Name:       "Fail",
+				Type:       query.TypePipeline,
+				Collection: tstdata.CollectionExecTest,
+				Commands: []map[string]interface{}{
+					{"$limit": "#number:missing"},
+				},
+			}
+			set.Queries = append([]query.Query{fail}, set.Queries...)
+
+			if result := exec.Exec(tests.Context, db, &set, map[string]string{}); result.Err == nil {
+				t.Fatalf("\t%s\tShould not be able to execute the set.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not be able to execute the set.", tests.Success)
+
+			if n := count(); n != 0 {
+				t.Fatalf("\t%s\tShould not save the documents : %d", tests.Failed, n)
+			}
+			t.Logf("\t%s\tShould not save the documents.", tests.Success)
+		}
+
+		t.Log("\tWhen saving to a collection outside the save namespace")
+		{
+			set := save(tstdata.CollectionExecTest, exec.SaveReplace, "42021")
+
+			result := exec.Exec(tests.Context, db, &set, map[string]string{})
+			if result.Err == nil {
+				t.Fatalf("\t%s\tShould not be able to save to the collection.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not be able to save to the collection.", tests.Success)
+
+			e, ok := result.Err.(*exec.Error)
+			if !ok || e.Code != exec.CodeSaveError {
+				t.Fatalf("\t%s\tShould get a save error : %v", tests.Failed, result.Err)
+			}
+			t.Logf("\t%s\tShould get a save error.", tests.Success)
+		}
+	}
+}
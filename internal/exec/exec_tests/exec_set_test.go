@@ -0,0 +1,134 @@
+package exec_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/internal/query/qfix"
+	"github.com/coralproject/xenia/tstdata"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestExecNestedSet tests a query can execute another stored set.
+func TestExecNestedSet(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	db, err := db.NewMGO(tests.Context, tests.TestSession)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	t.Log("Given the need to load the test data.")
+	{
+		loadTestData(t, db)
+	}
+
+	// The set the query executes. It also executes the outer set so
+	// it is found when it is executed the other way around.
+	inner := query.Set{
+		Name:    "QTEST_T_nested_inner",
+		Enabled: true,
+		Params:  []query.Param{{Name: "station_id"}},
+		Queries: []query.Query{
+			{
+				Name:       "Station",
+				Type:       query.TypeFind,
+				Collection: tstdata.CollectionExecTest,
+				Return:     true,
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"station_id": "#string:station_id"}},
+					{"$project": map[string]interface{}{"_id": 0, "station_id": 1}},
+				},
+			},
+		},
+	}
+
+	if err := qfix.Add(db, &inner); err != nil {
+		t.Fatalf("\t%s\tShould be able to add the inner set : %v", tests.Failed, err)
+	}
+
+	defer func() {
+		t.Log("Given the need to unload the test data.")
+		{
+			unloadTestData(t, db)
+			qfix.Remove(db, "QTEST_T_nested")
+		}
+	}()
+
+	outer := query.Set{
+		Name:    "QTEST_T_nested_outer",
+		Enabled: true,
+		Queries: []query.Query{
+			{
+				Name: "Inner",
+				Type: query.TypeSet,
+				Set:  inner.Name,
+				Vars: map[string]interface{}{"station_id": "#string:id"},
+				Commands: []map[string]interface{}{
+					{"$save": map[string]interface{}{"$map": "stations"}},
+				},
+			},
+			{
+				Name:       "Count",
+				Type:       query.TypeCount,
+				Collection: tstdata.CollectionExecTest,
+				Return:     true,
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"station_id": map[string]interface{}{"$in": "#data.*:stations.station_id"}}},
+				},
+			},
+		},
+	}
+
+	t.Log("Given the need to execute a stored set from a query.")
+	{
+		t.Log("\tWhen executing the set with a saved result")
+		{
+			result := exec.Exec(tests.Context, db, &outer, map[string]string{"id": "42021"})
+			if result.Err != nil {
+				t.Fatalf("\t%s\tShould be able to execute the set : %v", tests.Failed, result.Err)
+			}
+			t.Logf("\t%s\tShould be able to execute the set.", tests.Success)
+
+			data, err := json.Marshal(result)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to marshal the result : %s", tests.Failed, err)
+			}
+
+			var res struct {
+				Results []docs
+			}
+			if err := json.Unmarshal(data, &res); err != nil || len(res.Results) != 1 || len(res.Results[0].Docs) != 1 || res.Results[0].Docs[0]["count"] != float64(1) {
+				t.Fatalf("\t%s\tShould count the station found by the set : %s", tests.Failed, data)
+			}
+			t.Logf("\t%s\tShould count the station found by the set.", tests.Success)
+		}
+
+		t.Log("\tWhen executing a set that executes itself")
+		{
+			inner.Queries = append(inner.Queries, query.Query{
+				Name: "Outer",
+				Type: query.TypeSet,
+				Set:  outer.Name,
+			})
+
+			if err := qfix.Add(db, &inner); err != nil {
+				t.Fatalf("\t%s\tShould be able to update the inner set : %v", tests.Failed, err)
+			}
+
+			result := exec.Exec(tests.Context, db, &outer, map[string]string{"id": "42021"})
+
+			e, ok := result.Err.(*exec.Error)
+			if !ok || e.Code != exec.CodeSetInvalid {
+				t.Fatalf("\t%s\tShould not be able to execute the set : %v", tests.Failed, result.Err)
+			}
+			t.Logf("\t%s\tShould not be able to execute the set.", tests.Success)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package exec_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/tstdata"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestExecWhen tests queries are only executed when their condition holds.
+func TestExecWhen(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	db, err := db.NewMGO(tests.Context, tests.TestSession)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	t.Log("Given the need to load the test data.")
+	{
+		loadTestData(t, db)
+	}
+
+	defer func() {
+		t.Log("Given the need to unload the test data.")
+		{
+			unloadTestData(t, db)
+		}
+	}()
+
+	mode := func(value string) *query.Condition {
+		return &query.Condition{Var: "mode", Eq: &value}
+	}
+
+	station := func(name string, when *query.Condition) query.Query {
+		return query.Query{
+			Name:       name,
+			Type:       query.TypeCount,
+			Collection: tstdata.CollectionExecTest,
+			Return:     true,
+			When:       when,
+			Commands: []map[string]interface{}{
+				{"$match": map[string]interface{}{"station_id": "#string:station_id"}},
+			},
+		}
+	}
+
+	set := query.Set{
+		Name:    "When",
+		Enabled: true,
+		Params: []query.Param{
+			{Name: "mode", Type: query.ParamEnum, Enum: []string{"user", "asset"}},
+		},
+		Queries: []query.Query{
+			station("ByUser", mode("user")),
+			station("ByAsset", mode("asset")),
+		},
+	}
+
+	t.Log("Given the need to execute queries under a condition.")
+	{
+		t.Log("\tWhen executing the set in user mode")
+		{
+			vars := map[string]string{"mode": "user", "station_id": "42021"}
+
+			result := exec.Exec(tests.Context, db, &set, vars)
+			if result.Err != nil {
+				t.Fatalf("\t%s\tShould be able to execute the set : %v", tests.Failed, result.Err)
+			}
+			t.Logf("\t%s\tShould be able to execute the set.", tests.Success)
+
+			data, err := json.Marshal(result)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to marshal the result : %s", tests.Failed, err)
+			}
+
+			var res struct {
+				Results []docs
+			}
+			if err := json.Unmarshal(data, &res); err != nil || len(res.Results) != 1 || res.Results[0].Name != "ByUser" {
+				t.Fatalf("\t%s\tShould only get back the ByUser results : %s", tests.Failed, data)
+			}
+			t.Logf("\t%s\tShould only get back the ByUser results.", tests.Success)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package exec
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Set of formats the results of a set can be exported in.
+const (
+	FormatCSV = "csv"
+	FormatTSV = "tsv"
+)
+
+// Table contains the documents of a query flattened into rows of columns.
+type Table struct {
+	Name    string
+	Columns []string
+	Rows    [][]string
+}
+
+//==============================================================================
+
+// Tables flattens the documents of each query in the result into a table. The
+// columns declared on a query are used in their order. Otherwise there is a
+// column for the dot path of every field found in the documents, array
+// elements using their index.
+func Tables(set *query.Set, result *query.Result) ([]Table, error) {
+	list, ok := result.Results.([]docs)
+	if !ok {
+		return nil, errors.New("Results can't be exported")
+	}
+
+	columns := make(map[string][]string)
+	for _, q := range set.Queries {
+		columns[q.Name] = q.Columns
+	}
+
+	tables := make([]Table, len(list))
+	for i, d := range list {
+		tables[i] = table(d, columns[d.Name])
+	}
+
+	return tables, nil
+}
+
+// QueryDocs returns the documents of the named query in the result of
+// executing a set. An empty name returns the documents of the first query
+// the set returns.
+func QueryDocs(result *query.Result, name string) ([]bson.M, bool) {
+	list, ok := result.Results.([]docs)
+	if !ok {
+		return nil, false
+	}
+
+	for _, d := range list {
+		if name == "" || d.Name == name {
+			return d.Docs, true
+		}
+	}
+
+	return nil, false
+}
+
+// WriteTable writes the table with a header row in the format.
+func WriteTable(w io.Writer, t Table, format string) error {
+	cw := csv.NewWriter(w)
+	if format == FormatTSV {
+		cw.Comma = '\t'
+	}
+
+	if err := cw.Write(t.Columns); err != nil {
+		return err
+	}
+
+	return cw.WriteAll(t.Rows)
+}
+
+// WriteTables writes a zip archive holding a file for each table named after
+// its query.
+func WriteTables(w io.Writer, tables []Table, format string) error {
+	zw := zip.NewWriter(w)
+
+	for _, t := range tables {
+		f, err := zw.Create(t.Name + "." + format)
+		if err != nil {
+			return err
+		}
+
+		if err := WriteTable(f, t, format); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+//==============================================================================
+
+// table flattens the documents into a table with the columns, or with the
+// columns found in the documents when none are provided.
+func table(d docs, columns []string) Table {
+	t := Table{
+		Name:    d.Name,
+		Columns: columns,
+		Rows:    make([][]string, 0, len(d.Docs)),
+	}
+
+	// Declared columns look up their value in each document.
+	if len(columns) > 0 {
+		for _, doc := range d.Docs {
+			row := make([]string, len(columns))
+			for i, col := range columns {
+				if v, ok := FieldValue(doc, col); ok {
+					row[i] = cell(v)
+				}
+			}
+			t.Rows = append(t.Rows, row)
+		}
+
+		return t
+	}
+
+	// The columns are added in the order they are first found.
+	found := make(map[string]bool)
+	flat := make([]map[string]string, len(d.Docs))
+
+	for i, doc := range d.Docs {
+		var paths []string
+		flat[i] = make(map[string]string)
+		flatten("", doc, flat[i], &paths)
+
+		for _, path := range paths {
+			if !found[path] {
+				found[path] = true
+				t.Columns = append(t.Columns, path)
+			}
+		}
+	}
+
+	for _, row := range flat {
+		cells := make([]string, len(t.Columns))
+		for i, col := range t.Columns {
+			cells[i] = row[col]
+		}
+		t.Rows = append(t.Rows, cells)
+	}
+
+	return t
+}
+
+// flatten adds the value of every field of the value to the row keyed by its
+// dot path and adds the paths in the order they are found. The fields of a
+// document are sorted since their order is not kept. Empty documents and
+// arrays are kept as a single cell.
+func flatten(path string, value interface{}, row map[string]string, paths *[]string) {
+	switch v := value.(type) {
+	case bson.M:
+		flatten(path, map[string]interface{}(v), row, paths)
+		return
+
+	case map[string]interface{}:
+		if len(v) > 0 {
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				flatten(join(path, k), v[k], row, paths)
+			}
+			return
+		}
+
+	case bson.D:
+		if len(v) > 0 {
+			for _, e := range v {
+				flatten(join(path, e.Name), e.Value, row, paths)
+			}
+			return
+		}
+
+	case []interface{}:
+		if len(v) > 0 {
+			for i, item := range v {
+				flatten(join(path, strconv.Itoa(i)), item, row, paths)
+			}
+			return
+		}
+	}
+
+	row[path] = cell(value)
+	*paths = append(*paths, path)
+}
+
+// join adds the field to the dot path.
+func join(path, field string) string {
+	if path == "" {
+		return field
+	}
+
+	return path + "." + field
+}
+
+// FieldValue returns the value at the dot path in the document. Array
+// elements are found by their index.
+func FieldValue(doc interface{}, path string) (interface{}, bool) {
+	value := doc
+
+	for _, field := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case bson.M:
+			var ok bool
+			if value, ok = v[field]; !ok {
+				return nil, false
+			}
+
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[field]; !ok {
+				return nil, false
+			}
+
+		case bson.D:
+			var found bool
+			for _, e := range v {
+				if e.Name == field {
+					value, found = e.Value, true
+					break
+				}
+			}
+			if !found {
+				return nil, false
+			}
+
+		case []interface{}:
+			i, err := strconv.Atoi(field)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// cell returns the value as the text of a cell. Documents and arrays are
+// written as JSON.
+func cell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+
+	case string:
+		return v
+
+	case bson.ObjectId:
+		return v.Hex()
+
+	case time.Time:
+		return v.UTC().Format("2006-01-02T15:04:05.000Z")
+
+	case bson.RegEx:
+		return "/" + v.Pattern + "/" + v.Options
+
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+
+	case bool, int, int32, int64:
+		return fmt.Sprint(v)
+	}
+
+	s, err := EncodeJSON(extJSON(value))
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+
+	return s
+}
@@ -0,0 +1,92 @@
+package exec
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestExportTables tests the documents of each query are flattened into
+// tables and written as CSV, TSV and zip archives.
+func TestExportTables(t *testing.T) {
+	set := query.Set{
+		Name: "export",
+		Queries: []query.Query{
+			{Name: "Flat"},
+			{Name: "Picked", Columns: []string{"name", "tags.1", "author", "missing"}},
+		},
+	}
+
+	d := []bson.M{
+		{"name": "first", "tags": []interface{}{"a", "b"}, "author": bson.M{"id": 1, "ok": true}},
+		{"name": "second", "score": 2.5, "tags": []interface{}{}},
+	}
+
+	result := query.Result{Results: []docs{{"Flat", d}, {"Picked", d}}}
+
+	t.Log("Given the need to export the results of a set.")
+	{
+		tables, err := Tables(&set, &result)
+		if err != nil || len(tables) != 2 {
+			t.Fatalf("\t%s\tShould get a table for each query : %v", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould get a table for each query.", tests.Success)
+
+		t.Log("\tWhen the query does not declare its columns")
+		{
+			columns := []string{"author.id", "author.ok", "name", "tags.0", "tags.1", "score", "tags"}
+			if !reflect.DeepEqual(tables[0].Columns, columns) {
+				t.Fatalf("\t%s\tShould get a column for each dot path : %v", tests.Failed, tables[0].Columns)
+			}
+			t.Logf("\t%s\tShould get a column for each dot path.", tests.Success)
+
+			var buf bytes.Buffer
+			if err := WriteTable(&buf, tables[0], FormatTSV); err != nil {
+				t.Fatalf("\t%s\tShould be able to write the table : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to write the table.", tests.Success)
+
+			tsv := "author.id\tauthor.ok\tname\ttags.0\ttags.1\tscore\ttags\n1\ttrue\tfirst\ta\tb\t\t\n\t\tsecond\t\t\t2.5\t[]\n"
+			if buf.String() != tsv {
+				t.Fatalf("\t%s\tShould get the rows as TSV : %q", tests.Failed, buf.String())
+			}
+			t.Logf("\t%s\tShould get the rows as TSV.", tests.Success)
+		}
+
+		t.Log("\tWhen the query declares its columns")
+		{
+			var buf bytes.Buffer
+			if err := WriteTable(&buf, tables[1], FormatCSV); err != nil {
+				t.Fatalf("\t%s\tShould be able to write the table : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to write the table.", tests.Success)
+
+			csv := "name,tags.1,author,missing\nfirst,b,\"{\"\"id\"\":1,\"\"ok\"\":true}\",\nsecond,,,\n"
+			if buf.String() != csv {
+				t.Fatalf("\t%s\tShould get the rows as CSV : %q", tests.Failed, buf.String())
+			}
+			t.Logf("\t%s\tShould get the rows as CSV.", tests.Success)
+		}
+
+		t.Log("\tWhen writing all the tables")
+		{
+			var buf bytes.Buffer
+			if err := WriteTables(&buf, tables, FormatCSV); err != nil {
+				t.Fatalf("\t%s\tShould be able to write the archive : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to write the archive.", tests.Success)
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil || len(zr.File) != 2 || zr.File[0].Name != "Flat.csv" || zr.File[1].Name != "Picked.csv" {
+				t.Fatalf("\t%s\tShould get a file for each query : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould get a file for each query.", tests.Success)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Set of modes the results can be written in as Mongo Extended JSON.
+const (
+	ExtJSONRelaxed   = "relaxed"   // Numbers as JSON numbers and dates as ISO-8601 strings.
+	ExtJSONCanonical = "canonical" // Every number and date keeps its BSON type.
+)
+
+// extJSONDate is the layout of dates written as relaxed Extended JSON.
+const extJSONDate = "2006-01-02T15:04:05.000Z"
+
+//==============================================================================
+
+// ExtJSON returns a copy of the result with the BSON values in the documents
+// replaced by their Mongo Extended JSON form in the mode, so the results can
+// be read back without losing their types. The result itself is not changed
+// since it may be shared with the cache.
+func ExtJSON(result *query.Result, mode string) *query.Result {
+	canonical := mode == ExtJSONCanonical
+
+	r := *result
+	switch v := result.Results.(type) {
+	case []docs:
+		results := make([]docs, len(v))
+		for i, d := range v {
+			results[i] = docs{Name: d.Name, Docs: make([]bson.M, len(d.Docs))}
+			for j, doc := range d.Docs {
+				results[i].Docs[j] = toExtJSON(doc, canonical).(bson.M)
+			}
+		}
+		r.Results = results
+
+	case bson.M:
+		r.Results = toExtJSON(v, canonical)
+	}
+
+	return &r
+}
+
+// extJSON returns the value with the BSON types replaced by their relaxed Mongo
+// extended JSON form so they can be marshaled without losing their type.
+func extJSON(value interface{}) interface{} {
+	return toExtJSON(value, false)
+}
+
+// toExtJSON returns the value with the BSON types replaced by their canonical
+// or relaxed Mongo Extended JSON form.
+func toExtJSON(value interface{}, canonical bool) interface{} {
+	switch v := value.(type) {
+	case bson.ObjectId:
+		return bson.M{"$oid": v.Hex()}
+
+	case time.Time:
+		ms := v.Unix()*1000 + int64(v.Nanosecond()/int(time.Millisecond))
+
+		// Relaxed dates are only written as strings when the year
+		// can be written in four digits after 1970.
+		if y := v.UTC().Year(); canonical || y < 1970 || y > 9999 {
+			return bson.M{"$date": bson.M{"$numberLong": strconv.FormatInt(ms, 10)}}
+		}
+		return bson.M{"$date": v.UTC().Format(extJSONDate)}
+
+	case bson.RegEx:
+		return bson.M{"$regularExpression": bson.M{"pattern": v.Pattern, "options": v.Options}}
+
+	case int:
+		if !canonical {
+			return v
+		}
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			return bson.M{"$numberLong": strconv.Itoa(v)}
+		}
+		return bson.M{"$numberInt": strconv.Itoa(v)}
+
+	case int32:
+		if !canonical {
+			return v
+		}
+		return bson.M{"$numberInt": strconv.FormatInt(int64(v), 10)}
+
+	case int64:
+		if !canonical {
+			return v
+		}
+		return bson.M{"$numberLong": strconv.FormatInt(v, 10)}
+
+	case float64:
+
+		// JSON has no way to write infinity or NaN as a number.
+		if canonical || math.IsInf(v, 0) || math.IsNaN(v) {
+			return bson.M{"$numberDouble": formatDouble(v)}
+		}
+		return v
+
+	case bson.M:
+		return toExtJSON(map[string]interface{}(v), canonical)
+
+	case map[string]interface{}:
+		doc := make(bson.M, len(v))
+		for k, item := range v {
+			doc[k] = toExtJSON(item, canonical)
+		}
+		return doc
+
+	case bson.D:
+		doc := make(bson.M, len(v))
+		for _, e := range v {
+			doc[e.Name] = toExtJSON(e.Value, canonical)
+		}
+		return doc
+
+	case []bson.M:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = toExtJSON(item, canonical)
+		}
+		return list
+
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = toExtJSON(item, canonical)
+		}
+		return list
+	}
+
+	return value
+}
+
+// formatDouble returns the float as the string of a $numberDouble document.
+// Whole numbers keep a decimal point so they read as doubles.
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+
+	return s
+}
+
+//==============================================================================
+
+// decodeExtJSON replaces the Mongo Extended JSON documents in the commands of
+// each query with the BSON values they stand for. The commands are copied so
+// the set they are shared with is not changed.
+func decodeExtJSON(set *query.Set) error {
+	for i := range set.Queries {
+		q := &set.Queries[i]
+
+		commands := make([]map[string]interface{}, len(q.Commands))
+		for j, command := range q.Commands {
+			v, err := fromExtJSON(command)
+			if err != nil {
+				return queryErr(q.Name, commandErr(CodeCommandInvalid, j, err))
+			}
+
+			commands[j] = v.(map[string]interface{})
+		}
+
+		q.Commands = commands
+	}
+
+	return nil
+}
+
+// fromExtJSON returns a copy of the value with the Mongo Extended JSON
+// documents replaced by the BSON values they stand for.
+func fromExtJSON(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if bv, ok, err := bsonValue(v); ok {
+			return bv, err
+		}
+
+		doc := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			var err error
+			if doc[k], err = fromExtJSON(item); err != nil {
+				return nil, err
+			}
+		}
+		return doc, nil
+
+	case bson.M:
+		doc, err := fromExtJSON(map[string]interface{}(v))
+		if m, ok := doc.(map[string]interface{}); ok {
+			return bson.M(m), err
+		}
+		return doc, err
+
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if list[i], err = fromExtJSON(item); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+
+	return value, nil
+}
+
+// bsonValue returns the BSON value of a document holding a single Mongo
+// Extended JSON key like {"$oid": "..."}. False is returned when the document
+// is not one of them.
+func bsonValue(doc map[string]interface{}) (interface{}, bool, error) {
+	if len(doc) != 1 {
+		return nil, false, nil
+	}
+
+	for key, value := range doc {
+		var v interface{}
+		var err error
+
+		switch key {
+		case "$oid":
+			v, err = oidValue(value)
+		case "$date":
+			v, err = dateValue(value)
+		case "$numberLong":
+			v, err = intValue(value, 64)
+		case "$numberInt":
+			v, err = intValue(value, 32)
+		case "$numberDouble":
+			v, err = doubleValue(value)
+		case "$regularExpression":
+			v, err = regexValue(value)
+		default:
+			return nil, false, nil
+		}
+
+		if err != nil {
+			s, _ := EncodeJSON(value)
+			return nil, true, fmt.Errorf("Invalid %s value %s : %v", key, s, err)
+		}
+
+		return v, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// oidValue returns the ObjectId of a $oid document.
+func oidValue(value interface{}) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok || !bson.IsObjectIdHex(s) {
+		return nil, fmt.Errorf("Expecting a 24 character hex string")
+	}
+
+	return bson.ObjectIdHex(s), nil
+}
+
+// dateValue returns the time of a $date document. The date can be an ISO-8601
+// string, a {"$numberLong": "..."} document or a number of milliseconds since
+// the epoch.
+func dateValue(value interface{}) (interface{}, error) {
+	var ms int64
+
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return nil, fmt.Errorf("Expecting an ISO-8601 date")
+		}
+		return t.UTC(), nil
+
+	case map[string]interface{}:
+		n, ok := v["$numberLong"]
+		if !ok || len(v) != 1 {
+			return nil, fmt.Errorf("Expecting a $numberLong document")
+		}
+
+		i, err := intValue(n, 64)
+		if err != nil {
+			return nil, err
+		}
+		ms = i.(int64)
+
+	default:
+		i, ok := wholeNumber(v)
+		if !ok {
+			return nil, fmt.Errorf("Expecting a string, $numberLong or number")
+		}
+		ms = i
+	}
+
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).UTC(), nil
+}
+
+// intValue returns the integer of a $numberLong or $numberInt document, which
+// is written as a string.
+func intValue(value interface{}, bits int) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("Expecting a string")
+	}
+
+	i, err := strconv.ParseInt(s, 10, bits)
+	if err != nil {
+		return nil, fmt.Errorf("Expecting a %d bit integer", bits)
+	}
+
+	if bits == 32 {
+		return int32(i), nil
+	}
+
+	return i, nil
+}
+
+// doubleValue returns the float of a $numberDouble document, which is written
+// as a string so "Infinity", "-Infinity" and "NaN" can be used.
+func doubleValue(value interface{}) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("Expecting a string")
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Expecting a number")
+	}
+
+	return f, nil
+}
+
+// regexValue returns the regular expression of a $regularExpression document.
+func regexValue(value interface{}) (interface{}, error) {
+	doc, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expecting a document with a pattern and options")
+	}
+
+	pattern, ok := doc["pattern"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Expecting a pattern string")
+	}
+
+	var options string
+	if o, exists := doc["options"]; exists {
+		if options, ok = o.(string); !ok {
+			return nil, fmt.Errorf("Expecting an options string")
+		}
+	}
+
+	return bson.RegEx{Pattern: pattern, Options: options}, nil
+}
+
+// wholeNumber returns the value as an integer when it is a number without a
+// fraction.
+func wholeNumber(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		if v != math.Trunc(v) || math.IsInf(v, 0) {
+			return 0, false
+		}
+		return int64(v), true
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	}
+
+	return 0, false
+}
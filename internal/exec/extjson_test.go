@@ -0,0 +1,176 @@
+package exec
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestDecodeExtJSON tests the Extended JSON in the commands of a set is
+// replaced with BSON values after the set is stored and loaded.
+func TestDecodeExtJSON(t *testing.T) {
+	const body = `{
+		"name": "ext",
+		"queries": [{
+			"name": "Ext",
+			"type": "pipeline",
+			"collection": "comments",
+			"commands": [
+				{"$match": {
+					"_id": {"$oid": "5660bc6e16908cae692e0593"},
+					"date": {"$gte": {"$date": "2016-06-01T10:00:00.000+02:00"}, "$lt": {"$date": {"$numberLong": "1464832800000"}}},
+					"views": {"$gt": {"$numberLong": "9007199254740993"}},
+					"rank": {"$numberInt": "3"},
+					"score": {"$ne": {"$numberDouble": "-Infinity"}},
+					"body": {"$regularExpression": {"pattern": "^hi", "options": "i"}},
+					"tags": {"$in": [{"$oid": "5660bc6e16908cae692e0594"}, "#string:tag"]},
+					"status": {"$regex": "^ok", "$options": "i"}
+				}}
+			]
+		}]
+	}`
+
+	want := map[string]interface{}{
+		"$match": map[string]interface{}{
+			"_id":    bson.ObjectIdHex("5660bc6e16908cae692e0593"),
+			"date":   map[string]interface{}{"$gte": time.Date(2016, 6, 1, 8, 0, 0, 0, time.UTC), "$lt": time.Date(2016, 6, 2, 2, 0, 0, 0, time.UTC)},
+			"views":  map[string]interface{}{"$gt": int64(9007199254740993)},
+			"rank":   int32(3),
+			"score":  map[string]interface{}{"$ne": math.Inf(-1)},
+			"body":   bson.RegEx{Pattern: "^hi", Options: "i"},
+			"tags":   map[string]interface{}{"$in": []interface{}{bson.ObjectIdHex("5660bc6e16908cae692e0594"), "#string:tag"}},
+			"status": map[string]interface{}{"$regex": "^ok", "$options": "i"},
+		},
+	}
+
+	t.Log("Given the need to use Extended JSON in the commands of a set.")
+	{
+		t.Log("\tWhen the set has been stored and loaded")
+		{
+			var set query.Set
+			if err := json.Unmarshal([]byte(body), &set); err != nil {
+				t.Fatalf("\t%s\tShould be able to unmarshal the set : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to unmarshal the set.", tests.Success)
+
+			// The $ keys need to be escaped to store the set.
+			set.PrepareForInsert()
+			match := set.Queries[0].Commands[0]["_$match"].(map[string]interface{})
+			if _, exists := match["_id"].(map[string]interface{})["_$oid"]; !exists {
+				t.Fatalf("\t%s\tShould escape the Extended JSON keys : %v", tests.Failed, match["_id"])
+			}
+			t.Logf("\t%s\tShould escape the Extended JSON keys.", tests.Success)
+
+			set.PrepareForUse()
+			if err := decodeExtJSON(&set); err != nil {
+				t.Fatalf("\t%s\tShould be able to decode the Extended JSON : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to decode the Extended JSON.", tests.Success)
+
+			if got := set.Queries[0].Commands[0]; !reflect.DeepEqual(got, want) {
+				t.Fatalf("\t%s\tShould get the BSON values : %#v", tests.Failed, got)
+			}
+			t.Logf("\t%s\tShould get the BSON values.", tests.Success)
+		}
+
+		t.Log("\tWhen the Extended JSON is not valid")
+		{
+			set := query.Set{
+				Queries: []query.Query{
+					{Name: "Bad", Commands: []map[string]interface{}{{"$match": map[string]interface{}{"_id": map[string]interface{}{"$oid": "123"}}}}},
+				},
+			}
+
+			err := decodeExtJSON(&set)
+			e, ok := err.(*Error)
+			if !ok || e.Code != CodeCommandInvalid || e.Query != "Bad" || e.Command == nil || *e.Command != 0 {
+				t.Fatalf("\t%s\tShould get an invalid command error for the query : %#v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould get an invalid command error for the query.", tests.Success)
+		}
+	}
+}
+
+// TestExtJSON tests the results are written as relaxed and canonical Extended
+// JSON.
+func TestExtJSON(t *testing.T) {
+	doc := bson.M{
+		"_id":   bson.ObjectIdHex("5660bc6e16908cae692e0593"),
+		"date":  time.Date(2016, 6, 1, 8, 0, 0, 0, time.UTC),
+		"old":   time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC),
+		"count": 3,
+		"views": int64(42),
+		"score": 2.0,
+		"nan":   math.NaN(),
+		"body":  bson.RegEx{Pattern: "^hi", Options: "i"},
+	}
+
+	modes := []struct {
+		mode string
+		json string
+	}{
+		{
+			ExtJSONRelaxed,
+			`[{"Name":"Ext","Docs":[{"_id":{"$oid":"5660bc6e16908cae692e0593"},"body":{"$regularExpression":{"options":"i","pattern":"^hi"}},"count":3,"date":{"$date":"2016-06-01T08:00:00.000Z"},"nan":{"$numberDouble":"NaN"},"old":{"$date":{"$numberLong":"-1000"}},"score":2,"views":42}]}]`,
+		},
+		{
+			ExtJSONCanonical,
+			`[{"Name":"Ext","Docs":[{"_id":{"$oid":"5660bc6e16908cae692e0593"},"body":{"$regularExpression":{"options":"i","pattern":"^hi"}},"count":{"$numberInt":"3"},"date":{"$date":{"$numberLong":"1464768000000"}},"nan":{"$numberDouble":"NaN"},"old":{"$date":{"$numberLong":"-1000"}},"score":{"$numberDouble":"2.0"},"views":{"$numberLong":"42"}}]}]`,
+		},
+	}
+
+	t.Log("Given the need to write results as Extended JSON.")
+	{
+		for _, tt := range modes {
+			t.Logf("\tWhen writing %s Extended JSON", tt.mode)
+			{
+				result := query.Result{Results: []docs{{"Ext", []bson.M{doc}}}}
+
+				r := ExtJSON(&result, tt.mode)
+				data, err := json.Marshal(r.Results)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to marshal the results : %v", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to marshal the results.", tests.Success)
+
+				if string(data) != tt.json {
+					t.Fatalf("\t%s\tShould get the values with their types : %s", tests.Failed, data)
+				}
+				t.Logf("\t%s\tShould get the values with their types.", tests.Success)
+
+				if _, ok := result.Results.([]docs)[0].Docs[0]["_id"].(bson.ObjectId); !ok {
+					t.Fatalf("\t%s\tShould not change the result.", tests.Failed)
+				}
+				t.Logf("\t%s\tShould not change the result.", tests.Success)
+			}
+		}
+
+		t.Log("\tWhen reading the canonical Extended JSON back")
+		{
+			r := ExtJSON(&query.Result{Results: []docs{{"Ext", []bson.M{doc}}}}, ExtJSONCanonical)
+			data, _ := json.Marshal(r.Results.([]docs)[0].Docs[0])
+
+			var m map[string]interface{}
+			json.Unmarshal(data, &m)
+
+			v, err := fromExtJSON(m)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to decode the document : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to decode the document.", tests.Success)
+
+			got := v.(map[string]interface{})
+			if got["_id"] != doc["_id"] || !got["date"].(time.Time).Equal(doc["date"].(time.Time)) || got["views"] != int64(42) || got["count"] != int32(3) || got["score"] != 2.0 {
+				t.Fatalf("\t%s\tShould get the values with their types : %#v", tests.Failed, got)
+			}
+			t.Logf("\t%s\tShould get the values with their types.", tests.Success)
+		}
+	}
+}
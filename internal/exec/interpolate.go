@@ -0,0 +1,110 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// placeholder is a {name} or ${name} inside a string value or key.
+type placeholder struct {
+	name   string // Name of the variable.
+	def    string // Value used when the variable is missing.
+	hasDef bool   // A default value was provided, "{name|default}".
+	end    int    // Position just past the closing brace.
+}
+
+//==============================================================================
+
+// interpolate replaces the {name} and ${name} placeholders in the string with
+// the values of the variables. A placeholder can have a default value for a
+// missing variable, "{name|default}". A backslash keeps a placeholder as it is
+// written, "\{name}". Braces that don't hold a variable name, like "{ x: 1 }",
+// are left alone.
+//
+// A variable can't start the string, or a part of a key when key is true, with
+// a $ so it can't turn the value into an operator or field path.
+func interpolate(s string, vars map[string]string, key bool) (string, error) {
+	if !strings.ContainsRune(s, '{') {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); {
+
+		// Keep an escaped placeholder as it is written.
+		if s[i] == '\\' {
+			if p, ok := parsePlaceholder(s, i+1); ok {
+				b.WriteString(s[i+1 : p.end])
+				i = p.end
+				continue
+			}
+		}
+
+		p, ok := parsePlaceholder(s, i)
+		if !ok {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+
+		value, exists := vars[p.name]
+		switch {
+		case exists:
+		case p.hasDef:
+			value = p.def
+		default:
+			return "", newError(CodeParamMissing, fmt.Errorf("Variable %q is missing", p.name))
+		}
+
+		// Is the value placed where an operator or field path starts.
+		if strings.HasPrefix(value, "$") {
+			out := b.String()
+			if out == "" || (key && strings.HasSuffix(out, ".")) {
+				return "", newError(CodeParamInvalid, fmt.Errorf("Variable %q can't start %q with $", p.name, s))
+			}
+		}
+
+		// Does the value add an operator part to the key.
+		if key && strings.Contains(value, ".$") {
+			return "", newError(CodeParamInvalid, fmt.Errorf("Variable %q can't start a part of %q with $", p.name, s))
+		}
+
+		b.WriteString(value)
+		i = p.end
+	}
+
+	return b.String(), nil
+}
+
+// parsePlaceholder parses the {name} or ${name} placeholder starting at the
+// position in the string.
+func parsePlaceholder(s string, i int) (placeholder, bool) {
+	var p placeholder
+
+	// The $ of a ${name} placeholder is part of its syntax.
+	if i < len(s) && s[i] == '$' {
+		i++
+	}
+
+	if i >= len(s) || s[i] != '{' {
+		return p, false
+	}
+
+	end := strings.IndexByte(s[i:], '}')
+	if end == -1 {
+		return p, false
+	}
+
+	p.name = s[i+1 : i+end]
+	p.end = i + end + 1
+
+	if idx := strings.IndexByte(p.name, '|'); idx != -1 {
+		p.name, p.def, p.hasDef = p.name[:idx], p.name[idx+1:], true
+	}
+
+	if !isVarName(p.name) {
+		return p, false
+	}
+
+	return p, true
+}
@@ -0,0 +1,154 @@
+package exec
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestInterpolate tests variables are interpolated inside strings.
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{"asset_id": "1234", "month": "2016_06", "op": "$where", "field": "$secret", "path": "a.$where", "cmp": "x.$gt", "dotted": "a.b"}
+
+	strs := []struct {
+		s     string
+		key   bool
+		after string
+		err   bool
+	}{
+		{"asset-{asset_id}", false, "asset-1234", false},
+		{"asset-${asset_id}", false, "asset-1234", false},
+		{"stats_{month}_{asset_id}", false, "stats_2016_06_1234", false},
+		{"{missing|none}-{asset_id}", false, "none-1234", false},
+		{`\{asset_id} is \${asset_id}`, false, "{asset_id} is ${asset_id}", false},
+		{"function() { return this.a > 1 }", false, "function() { return this.a > 1 }", false},
+		{`^a\{2\}$`, false, `^a\{2\}$`, false},
+		{"price {field}", false, "price $secret", false},
+		{"{field}", false, "", true},
+		{"${op}", false, "", true},
+		{"counts.{op}", true, "", true},
+		{"{path}", true, "", true},
+		{"counts.{cmp}", true, "", true},
+		{"counts-{cmp}", true, "", true},
+		{"counts.{dotted}", true, "counts.a.b", false},
+		{"label {cmp}", false, "label x.$gt", false},
+		{"{missing}", false, "", true},
+	}
+
+	t.Log("Given the need to interpolate variables inside strings.")
+	{
+		for _, tt := range strs {
+			t.Logf("\tWhen interpolating %q", tt.s)
+			{
+				s, err := interpolate(tt.s, vars, tt.key)
+				if tt.err {
+					if err == nil {
+						t.Fatalf("\t%s\tShould not be able to interpolate the string : %q", tests.Failed, s)
+					}
+					t.Logf("\t%s\tShould not be able to interpolate the string : %v", tests.Success, err)
+					continue
+				}
+
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to interpolate the string : %v", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to interpolate the string.", tests.Success)
+
+				if s != tt.after {
+					t.Fatalf("\t%s\tShould get %q : %q", tests.Failed, tt.after, s)
+				}
+				t.Logf("\t%s\tShould get %q.", tests.Success, tt.after)
+			}
+		}
+	}
+}
+
+// TestInterpolateCommands tests variables are interpolated inside the values
+// and keys of commands and the collection of a query.
+func TestInterpolateCommands(t *testing.T) {
+	vars := map[string]string{"asset_id": "1234", "month": "2016_06", "year": "2016"}
+
+	q := query.Query{
+		Name:       "Interpolate",
+		Type:       query.TypePipeline,
+		Collection: "stats_{month}",
+		Commands: []map[string]interface{}{
+			{"$match": map[string]interface{}{
+				"counts.asset-{asset_id}": map[string]interface{}{"$gt": 0},
+				"date":                    map[string]interface{}{"$gte": "#date:{year}-01-01"},
+				"tags":                    map[string]interface{}{"$in": []interface{}{"asset-{asset_id}", "all"}},
+			}},
+			{"$project": map[string]interface{}{"label": map[string]interface{}{"$concat": []interface{}{"asset-${asset_id}: ", "$name"}}}},
+		},
+	}
+
+	want := []map[string]interface{}{
+		{"$match": map[string]interface{}{
+			"counts.asset-1234": map[string]interface{}{"$gt": 0},
+			"date":              map[string]interface{}{"$gte": mustDate("2016-01-01")},
+			"tags":              map[string]interface{}{"$in": []interface{}{"asset-1234", "all"}},
+		}},
+		{"$project": map[string]interface{}{"label": map[string]interface{}{"$concat": []interface{}{"asset-1234: ", "$name"}}}},
+	}
+
+	t.Log("Given the need to interpolate variables inside commands.")
+	{
+		t.Log("\tWhen building a pipeline")
+		{
+			p, err := buildPipeline(tests.Context, &q, vars, nil)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to build the pipeline : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to build the pipeline.", tests.Success)
+
+			if q.Collection != "stats_2016_06" {
+				t.Fatalf("\t%s\tShould interpolate the collection : %q", tests.Failed, q.Collection)
+			}
+			t.Logf("\t%s\tShould interpolate the collection.", tests.Success)
+
+			if !reflect.DeepEqual(p.commands, want) {
+				t.Log(p.commands)
+				t.Log(want)
+				t.Fatalf("\t%s\tShould interpolate the values and keys.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould interpolate the values and keys.", tests.Success)
+		}
+
+		t.Log("\tWhen a variable would start an operator")
+		{
+			doc := map[string]interface{}{"$project": map[string]interface{}{"value": "{field}"}}
+
+			err := ProcessVariables(tests.Context, doc, map[string]string{"field": "$secret"}, nil)
+			if e, ok := err.(*Error); !ok || e.Code != CodeParamInvalid {
+				t.Fatalf("\t%s\tShould get an invalid parameter error : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould get an invalid parameter error.", tests.Success)
+		}
+
+		t.Log("\tWhen a variable would be an operator key")
+		{
+			for _, key := range []string{"{op}", "counts.{op}", "{path}", "counts.{cmp}"} {
+				doc := map[string]interface{}{"$match": map[string]interface{}{key: 1}}
+
+				err := ProcessVariables(tests.Context, doc, map[string]string{"op": "$where", "path": "a.$where", "cmp": "x.$gt"}, nil)
+				if e, ok := err.(*Error); !ok || e.Code != CodeParamInvalid {
+					t.Fatalf("\t%s\tShould get an invalid parameter error for %q : %v", tests.Failed, key, err)
+				}
+				t.Logf("\t%s\tShould get an invalid parameter error for %q.", tests.Success, key)
+			}
+		}
+	}
+}
+
+// mustDate returns the time of the date for the tests.
+func mustDate(value string) interface{} {
+	d, err := isoDate(tests.Context, value)
+	if err != nil {
+		panic(err)
+	}
+
+	return d
+}
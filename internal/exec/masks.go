@@ -15,10 +15,10 @@ import (
 // processMasks reviews the document for fields that are defined to have
 // their values masked.
 func processMasks(context interface{}, db *db.DB, collection string, results []bson.M) error {
-	masks, err := mask.GetByCollection(context, db, collection)
-	if err != nil {
+	masks := loadMasks(context, db, collection)
 
-		// If there are no masks to process then great.
+	// If there are no masks to process then great.
+	if masks == nil {
 		return nil
 	}
 
@@ -31,6 +31,17 @@ func processMasks(context interface{}, db *db.DB, collection string, results []b
 	return nil
 }
 
+// loadMasks retrieves the masks configured for the collection. A nil map is
+// returned when there are no masks to apply.
+func loadMasks(context interface{}, db *db.DB, collection string) map[string]mask.Mask {
+	masks, err := mask.GetByCollection(context, db, collection)
+	if err != nil {
+		return nil
+	}
+
+	return masks
+}
+
 // matchMaskField checks the specificed document against the masks and updated any
 // field values that match based on the configured masking operation.
 func matchMaskField(context interface{}, masks map[string]mask.Mask, doc map[string]interface{}) error {
@@ -32,26 +32,40 @@ func processParams(context interface{}, db *db.DB, set *query.Set, vars map[stri
 	}
 
 	var errs []string
+	code := CodeParamInvalid
 
 	// Validate each known parameter is represented in the variable list.
 	for _, p := range set.Params {
-		if _, exists := vars[p.Name]; !exists {
+		value, exists := vars[p.Name]
+		if !exists {
 
 			// The variable was not provided but we have a
 			// default value for this so use it.
 			if p.Default != "" {
 				log.Dev(context, "validateParameters", "Adding : Name[%s] Default[%s]", p.Name, p.Default)
 				vars[p.Name] = p.Default
+				value = p.Default
+				exists = true
 			} else {
 
 				// We are missing the parameter.
 				errs = append(errs, "Missing["+p.Name+"]")
+				code = CodeParamMissing
+			}
+		}
+
+		// Is the value of the declared type and within its constraints.
+		if exists {
+			v, err := p.Coerce(value)
+			if err != nil {
+				errs = append(errs, "Invalid["+p.Name+":"+value+":"+err.Error()+"]")
+			} else {
+				vars[p.Name] = v
 			}
 		}
 
 		// Is there a regex to validate against?
 		if p.RegexName != "" {
-			value := vars[p.Name]
 			if err := validateRegex(context, db, value, p.RegexName); err != nil {
 				errs = append(errs, "Invalid["+value+":"+p.RegexName+":"+err.Error()+"]")
 			}
@@ -60,7 +74,7 @@ func processParams(context interface{}, db *db.DB, set *query.Set, vars map[stri
 
 	// Were there any errors.
 	if errs != nil {
-		return errors.New(strings.Join(errs, ","))
+		return newError(code, errors.New(strings.Join(errs, ",")))
 	}
 
 	return nil
@@ -87,3 +101,14 @@ func validateRegex(context interface{}, db *db.DB, value string, name string) er
 
 	return nil
 }
+
+// inEnum reports if the value is one of the values of the enum.
+func inEnum(enum []string, value string) bool {
+	for _, v := range enum {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
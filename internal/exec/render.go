@@ -0,0 +1,309 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Rendered contains the final form of a query after the parameters have been
+// processed, the scripts added and the variables substituted.
+type Rendered struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Collection string            `json:"collection,omitempty"`
+	Set        string            `json:"set,omitempty"`        // Set executed by a set query.
+	Vars       map[string]string `json:"vars,omitempty"`       // Variables passed to the set of a set query.
+	Commands   []interface{}     `json:"commands"`             // Commands as Mongo extended JSON.
+	Shell      string            `json:"shell,omitempty"`      // Commands as a Mongo shell statement.
+	Unresolved []string          `json:"unresolved,omitempty"` // #data lookups that need the results of other queries.
+}
+
+// unresolvedKey marks a #data lookup left in the rendered commands.
+const unresolvedKey = "$unresolved"
+
+//==============================================================================
+
+// Render returns the final commands of each query in the set without executing
+// them. The #data lookups are left as {"$unresolved": "#data..."} documents
+// since they need the results of other queries.
+func Render(context interface{}, db *db.DB, set *query.Set, vars map[string]string) *query.Result {
+	log.Dev(context, "Render", "Started : Name[%s]", set.Name)
+
+	// If we have been provided a nil map, make one.
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+
+	// Validate the set and get it ready to be executed.
+	if err := prepare(context, db, set, vars); err != nil {
+		return errResult(context, err, "Preparing set")
+	}
+
+	rendered := make([]Rendered, 0, len(set.Queries))
+
+	for _, q := range set.Queries {
+
+		// Don't change the commands of the set with the substitutions.
+		q.Commands = copyCommands(q.Commands)
+
+		r, err := renderQuery(context, &q, vars)
+		if err != nil {
+			err = queryErr(q.Name, err)
+
+			r := query.Result{
+				Results: bson.M{"error": err.Error(), "commands": q.Commands},
+				Err:     err,
+			}
+
+			log.Error(context, "Render", err, "Completed : Rendering Query[%s]", q.Name)
+			return &r
+		}
+
+		rendered = append(rendered, r)
+	}
+
+	log.Dev(context, "Render", "Completed")
+	return &query.Result{Results: rendered}
+}
+
+// renderQuery substitutes the variables in the commands of the query and
+// returns its final form.
+func renderQuery(context interface{}, q *query.Query, vars map[string]string) (Rendered, error) {
+	r := Rendered{
+		Name: q.Name,
+		Type: q.Type,
+	}
+
+	// Leave the #data lookups in place so the rest can be substituted.
+	unresolved := make(map[string]bool)
+	for _, command := range q.Commands {
+		markUnresolved(command, unresolved)
+	}
+
+	switch strings.ToLower(q.Type) {
+	case query.TypePipeline:
+		p, err := buildPipeline(context, q, vars, nil)
+		if err != nil {
+			return r, err
+		}
+
+		r.Shell = fmt.Sprintf("db.%s.aggregate(%s)", q.Collection, shell(p.stages))
+
+	case query.TypeFind, query.TypeCount, query.TypeDistinct:
+		_, fq, err := buildFind(context, q, vars, nil)
+		if err != nil {
+			return r, err
+		}
+
+		r.Shell = fq.shell(q)
+
+	case query.TypeSet:
+		q.Vars = copyDoc(q.Vars)
+		markUnresolved(q.Vars, unresolved)
+
+		setVars, err := buildSetVars(context, q, vars, nil)
+		if err != nil {
+			return r, asError(CodeCommandInvalid, err)
+		}
+
+		r.Set = q.Set
+		r.Vars = setVars
+	}
+
+	// The collection may have been named with variables.
+	r.Collection = q.Collection
+
+	r.Commands = make([]interface{}, 0, len(q.Commands))
+	for _, command := range q.Commands {
+
+		// Leave out the stages dropped by missing optional variables.
+		if len(command) == 0 {
+			continue
+		}
+
+		r.Commands = append(r.Commands, extJSON(command))
+	}
+
+	for lookup := range unresolved {
+		r.Unresolved = append(r.Unresolved, lookup)
+	}
+	sort.Strings(r.Unresolved)
+
+	return r, nil
+}
+
+// markUnresolved replaces the #data lookups in the document with unresolved
+// documents and adds the lookups to the set of unresolved lookups.
+func markUnresolved(doc map[string]interface{}, unresolved map[string]bool) {
+	for key, value := range doc {
+		doc[key] = unresolvedValue(value, unresolved)
+	}
+}
+
+// unresolvedValue returns the value with any #data lookups replaced.
+func unresolvedValue(value interface{}, unresolved map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		markUnresolved(v, unresolved)
+
+	case []interface{}:
+		for i := range v {
+			v[i] = unresolvedValue(v[i], unresolved)
+		}
+
+	case string:
+		if strings.HasPrefix(v, "#data") {
+			unresolved[v] = true
+
+			// A bson.M is not walked when the variables are substituted.
+			return bson.M{unresolvedKey: v}
+		}
+	}
+
+	return value
+}
+
+//==============================================================================
+
+// shell returns the Mongo shell statement for the find, count or distinct
+// query.
+func (fq *findQuery) shell(q *query.Query) string {
+	filter := fq.filter
+	if filter == nil {
+		filter = bson.M{}
+	}
+
+	switch strings.ToLower(q.Type) {
+	case query.TypeCount:
+		opts := bson.D{}
+		if fq.skip > 0 {
+			opts = append(opts, bson.DocElem{Name: "skip", Value: fq.skip})
+		}
+		if fq.limit > 0 {
+			opts = append(opts, bson.DocElem{Name: "limit", Value: fq.limit})
+		}
+
+		if len(opts) == 0 {
+			return fmt.Sprintf("db.%s.count(%s)", q.Collection, shell(filter))
+		}
+		return fmt.Sprintf("db.%s.count(%s, %s)", q.Collection, shell(filter), shell(opts))
+
+	case query.TypeDistinct:
+		return fmt.Sprintf("db.%s.distinct(%s, %s)", q.Collection, shell(fq.field), shell(filter))
+	}
+
+	s := fmt.Sprintf("db.%s.find(%s", q.Collection, shell(filter))
+	if fq.project != nil {
+		s += ", " + shell(fq.project)
+	}
+	s += ")"
+
+	if fq.sort != nil {
+		order := make(bson.D, len(fq.sort))
+		for i, fld := range fq.sort {
+			order[i] = bson.DocElem{Name: fld, Value: 1}
+			if strings.HasPrefix(fld, "-") {
+				order[i] = bson.DocElem{Name: fld[1:], Value: -1}
+			}
+		}
+		s += ".sort(" + shell(order) + ")"
+	}
+
+	if fq.skip > 0 {
+		s += fmt.Sprintf(".skip(%d)", fq.skip)
+	}
+
+	if fq.limit > 0 {
+		s += fmt.Sprintf(".limit(%d)", fq.limit)
+	}
+
+	return s
+}
+
+// shell returns the value in Mongo shell syntax. The fields of documents are
+// sorted so the same value is always written the same way.
+func shell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+
+	case string:
+		return quote(v)
+
+	case bson.ObjectId:
+		return fmt.Sprintf("ObjectId(%q)", v.Hex())
+
+	case time.Time:
+		return fmt.Sprintf("ISODate(%q)", v.UTC().Format("2006-01-02T15:04:05.000Z"))
+
+	case bson.RegEx:
+		return "/" + strings.Replace(v.Pattern, "/", `\/`, -1) + "/" + v.Options
+
+	case int64:
+		return fmt.Sprintf("NumberLong(%d)", v)
+
+	case bson.M:
+		return shell(map[string]interface{}(v))
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		fields := make([]string, len(keys))
+		for i, k := range keys {
+			fields[i] = quote(k) + ": " + shell(v[k])
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+
+	case bson.D:
+		fields := make([]string, len(v))
+		for i, e := range v {
+			fields[i] = quote(e.Name) + ": " + shell(e.Value)
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+
+	case []bson.M:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = shell(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = shell(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(data)
+}
+
+// quote returns the string as a quoted JSON string.
+func quote(s string) string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return strconv.Quote(s)
+	}
+
+	return string(data)
+}
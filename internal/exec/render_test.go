@@ -0,0 +1,99 @@
+package exec
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestRenderQuery tests the final form of queries is rendered without
+// resolving the #data lookups.
+func TestRenderQuery(t *testing.T) {
+	vars := map[string]string{"id": "5660bc6e16908cae692e0593", "limit": "5"}
+
+	queries := []struct {
+		q          query.Query
+		commands   string
+		shell      string
+		unresolved int
+	}{
+		{
+			query.Query{
+				Name:       "Pipeline",
+				Type:       query.TypePipeline,
+				Collection: "comments",
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"user_id": "#objid:id", "asset_id": map[string]interface{}{"$in": "#data.*:assets.id"}}},
+					{"$limit": "#number:limit"},
+					{"$save": map[string]interface{}{"$map": "comments"}},
+				},
+			},
+			`[{"$match":{"asset_id":{"$in":{"$unresolved":"#data.*:assets.id"}},"user_id":{"$oid":"5660bc6e16908cae692e0593"}}},{"$limit":5},{"$save":{"$map":"comments"}}]`,
+			`db.comments.aggregate([{"$match": {"asset_id": {"$in": {"$unresolved": "#data.*:assets.id"}}, "user_id": ObjectId("5660bc6e16908cae692e0593")}}, {"$limit": 5}])`,
+			1,
+		},
+		{
+			query.Query{
+				Name:       "Find",
+				Type:       query.TypeFind,
+				Collection: "comments",
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"user_id": "#objid:id"}},
+					{"$sort": []interface{}{"-date"}},
+					{"$limit": "#number:limit"},
+				},
+			},
+			`[{"$match":{"user_id":{"$oid":"5660bc6e16908cae692e0593"}}},{"$sort":["-date"]},{"$limit":5}]`,
+			`db.comments.find({"user_id": ObjectId("5660bc6e16908cae692e0593")}).sort({"date": -1}).limit(5)`,
+			0,
+		},
+		{
+			query.Query{
+				Name:       "Optional",
+				Type:       query.TypePipeline,
+				Collection: "comments",
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"user_id": "#objid:id", "status": "#string:status?"}},
+					{"$skip": "#number:skip?"},
+					{"$limit": "#number:size|10"},
+				},
+			},
+			`[{"$match":{"user_id":{"$oid":"5660bc6e16908cae692e0593"}}},{"$limit":10}]`,
+			`db.comments.aggregate([{"$match": {"user_id": ObjectId("5660bc6e16908cae692e0593")}}, {"$limit": 10}])`,
+			0,
+		},
+	}
+
+	t.Log("Given the need to render the final form of queries.")
+	{
+		for _, tt := range queries {
+			t.Logf("\tWhen rendering the %s query", tt.q.Type)
+			{
+				r, err := renderQuery(tests.Context, &tt.q, vars)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to render the query : %v", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to render the query.", tests.Success)
+
+				data, _ := json.Marshal(r.Commands)
+				if string(data) != tt.commands {
+					t.Fatalf("\t%s\tShould get the commands as extended JSON : %s", tests.Failed, data)
+				}
+				t.Logf("\t%s\tShould get the commands as extended JSON.", tests.Success)
+
+				if r.Shell != tt.shell {
+					t.Fatalf("\t%s\tShould get the shell statement : %s", tests.Failed, r.Shell)
+				}
+				t.Logf("\t%s\tShould get the shell statement.", tests.Success)
+
+				if len(r.Unresolved) != tt.unresolved {
+					t.Fatalf("\t%s\tShould report %d unresolved lookups : %v", tests.Failed, tt.unresolved, r.Unresolved)
+				}
+				t.Logf("\t%s\tShould report %d unresolved lookups.", tests.Success, tt.unresolved)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package exec
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/internal/script"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/log"
+)
+
+// maxScriptDepth is the maximum number of scripts that can be included inside
+// each other.
+const maxScriptDepth = 10
+
+// scriptResolver expands the scripts added to the commands of queries.
+type scriptResolver struct {
+	context interface{}
+	db      *db.DB
+	scripts map[string][]map[string]interface{} // Commands of the scripts already loaded.
+}
+
+//==============================================================================
+
+// loadScripts updates the commands of each query with the pre/post scripts of
+// the set and the query and expands any {"$include": "name"} commands.
+func loadScripts(context interface{}, db *db.DB, set *query.Set) error {
+	r := scriptResolver{
+		context: context,
+		db:      db,
+		scripts: make(map[string][]map[string]interface{}),
+	}
+
+	for i := range set.Queries {
+		q := &set.Queries[i]
+
+		// Set queries don't have commands of their own to add to.
+		if q.Type == query.TypeSet {
+			continue
+		}
+
+		// The set scripts wrap around the query scripts, which wrap
+		// around the commands of the query.
+		var commands []map[string]interface{}
+		for _, name := range []string{set.PreScript, q.PreScript} {
+			if name != "" {
+				commands = append(commands, map[string]interface{}{"$include": name})
+			}
+		}
+
+		commands = append(commands, q.Commands...)
+
+		for _, name := range []string{q.PstScript, set.PstScript} {
+			if name != "" {
+				commands = append(commands, map[string]interface{}{"$include": name})
+			}
+		}
+
+		expanded, err := r.expand(commands, nil)
+		if err != nil {
+			log.Error(context, "loadScripts", err, "Completed : Query[%s]", q.Name)
+			return err
+		}
+
+		q.Commands = expanded
+
+		// The scripts may have added commands the query does not accept.
+		if err := q.Validate(); err != nil {
+			return newError(CodeSetInvalid, fmt.Errorf("Query %q after adding scripts : %v", q.Name, err))
+		}
+	}
+
+	return nil
+}
+
+// expand returns the commands with every {"$include": "name"} command replaced
+// by the commands of the named script. The chain holds the names of the scripts
+// being expanded.
+func (r *scriptResolver) expand(commands []map[string]interface{}, chain []string) ([]map[string]interface{}, error) {
+	expanded := make([]map[string]interface{}, 0, len(commands))
+
+	for _, command := range commands {
+		name, err := includeName(command)
+		if err != nil {
+			return nil, newError(CodeSetInvalid, err)
+		}
+
+		if name == "" {
+			expanded = append(expanded, command)
+			continue
+		}
+
+		cmds, err := r.script(name, chain)
+		if err != nil {
+			return nil, err
+		}
+
+		expanded = append(expanded, cmds...)
+	}
+
+	return expanded, nil
+}
+
+// script returns the expanded commands of the named script.
+func (r *scriptResolver) script(name string, chain []string) ([]map[string]interface{}, error) {
+
+	// Don't allow a script to include itself or scripts to nest without end.
+	for _, n := range chain {
+		if n == name {
+			err := fmt.Errorf("Script %q includes itself : %s", name, strings.Join(append(chain, name), " -> "))
+			return nil, newError(CodeSetInvalid, err)
+		}
+	}
+
+	if len(chain) >= maxScriptDepth {
+		err := fmt.Errorf("Script %q is included more than %d scripts deep", name, maxScriptDepth)
+		return nil, newError(CodeSetInvalid, err)
+	}
+
+	commands, exists := r.scripts[name]
+	if !exists {
+		scr, err := script.GetByName(r.context, r.db, name)
+		if err != nil {
+			code := CodeMongoError
+			if err == script.ErrNotFound {
+				code = CodeSetInvalid
+			}
+
+			return nil, newError(code, fmt.Errorf("Script %q : %v", name, err))
+		}
+
+		commands = scr.Commands
+		r.scripts[name] = commands
+	}
+
+	// Copy the chain so the scripts included side by side don't share it.
+	next := make([]string, len(chain), len(chain)+1)
+	copy(next, chain)
+
+	return r.expand(commands, append(next, name))
+}
+
+// includeName returns the name of the script the command includes or an empty
+// string when the command is not an {"$include": "name"} command.
+func includeName(command map[string]interface{}) (string, error) {
+	v, exists := command["$include"]
+	if !exists {
+		return "", nil
+	}
+
+	name, ok := v.(string)
+	if !ok || name == "" || len(command) != 1 {
+		return "", errors.New("Invalid $include command, it must be {\"$include\": \"name\"}")
+	}
+
+	return name, nil
+}
@@ -0,0 +1,81 @@
+package exec
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestExpandScripts tests included scripts are expanded in place and can't
+// include themselves.
+func TestExpandScripts(t *testing.T) {
+	cmd := func(op string, v interface{}) map[string]interface{} {
+		return map[string]interface{}{op: v}
+	}
+
+	r := scriptResolver{
+		context: tests.Context,
+		scripts: map[string][]map[string]interface{}{
+			"match":  {cmd("$match", map[string]interface{}{"deleted": false})},
+			"recent": {cmd("$include", "match"), cmd("$sort", map[string]interface{}{"date": -1})},
+			"loop":   {cmd("$include", "around")},
+			"around": {cmd("$include", "loop")},
+		},
+	}
+
+	t.Log("Given the need to expand included scripts.")
+	{
+		t.Log("\tWhen including a script that includes another script")
+		{
+			commands := []map[string]interface{}{
+				cmd("$include", "recent"),
+				cmd("$limit", 10),
+				cmd("$include", "match"),
+			}
+
+			exp := []map[string]interface{}{
+				cmd("$match", map[string]interface{}{"deleted": false}),
+				cmd("$sort", map[string]interface{}{"date": -1}),
+				cmd("$limit", 10),
+				cmd("$match", map[string]interface{}{"deleted": false}),
+			}
+
+			expanded, err := r.expand(commands, nil)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to expand the scripts : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to expand the scripts.", tests.Success)
+
+			if !reflect.DeepEqual(expanded, exp) {
+				t.Fatalf("\t%s\tShould get the expected commands : %v", tests.Failed, expanded)
+			}
+			t.Logf("\t%s\tShould get the expected commands.", tests.Success)
+
+			if len(r.scripts["recent"]) != 2 {
+				t.Fatalf("\t%s\tShould not change the loaded scripts : %v", tests.Failed, r.scripts["recent"])
+			}
+			t.Logf("\t%s\tShould not change the loaded scripts.", tests.Success)
+		}
+
+		t.Log("\tWhen including a script that includes itself")
+		{
+			_, err := r.expand([]map[string]interface{}{cmd("$include", "loop")}, nil)
+
+			if e, ok := err.(*Error); !ok || e.Code != CodeSetInvalid {
+				t.Fatalf("\t%s\tShould not be able to expand the scripts : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould not be able to expand the scripts : %v", tests.Success, err)
+		}
+
+		t.Log("\tWhen using an invalid include")
+		{
+			bad := map[string]interface{}{"$include": "match", "$limit": 10}
+
+			if _, err := r.expand([]map[string]interface{}{bad}, nil); err == nil {
+				t.Fatalf("\t%s\tShould not be able to expand the scripts.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not be able to expand the scripts.", tests.Success)
+		}
+	}
+}
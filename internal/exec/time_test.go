@@ -0,0 +1,129 @@
+package exec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestTimeAt tests times are offset and rounded down to the start of calendar
+// units in a timezone.
+func TestTimeAt(t *testing.T) {
+
+	// This is 11:30pm on Monday the 14th in New York, the day after
+	// daylight saving time started.
+	now := time.Date(2016, 3, 15, 3, 30, 0, 0, time.UTC)
+
+	times := []struct {
+		value string
+		after time.Time
+	}{
+		{"0", now},
+		{"-3600", time.Date(2016, 3, 15, 2, 30, 0, 0, time.UTC)},
+		{"3m", time.Date(2016, 3, 15, 3, 33, 0, 0, time.UTC)},
+		{"-2d", time.Date(2016, 3, 13, 3, 30, 0, 0, time.UTC)},
+		{"@hour", time.Date(2016, 3, 15, 3, 0, 0, 0, time.UTC)},
+		{"startOfDay", time.Date(2016, 3, 15, 0, 0, 0, 0, time.UTC)},
+		{"startOfWeek", time.Date(2016, 3, 14, 0, 0, 0, 0, time.UTC)},
+		{"startOfMonth", time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"-1mo@month", time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"startOfDay,America/New_York", time.Date(2016, 3, 14, 4, 0, 0, 0, time.UTC)},
+		{"-7d@day,America/New_York", time.Date(2016, 3, 7, 5, 0, 0, 0, time.UTC)},
+		{"startOfWeek,America/New_York", time.Date(2016, 3, 14, 4, 0, 0, 0, time.UTC)},
+	}
+
+	t.Log("Given the need to adjust the current time.")
+	{
+		for _, tt := range times {
+			t.Logf("\tWhen using %q", tt.value)
+			{
+				v, err := timeAt(tt.value, now)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to adjust the time : %v", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to adjust the time.", tests.Success)
+
+				if !v.Equal(tt.after) || v.Location() != time.UTC {
+					t.Fatalf("\t%s\tShould get %v : %v", tests.Failed, tt.after, v)
+				}
+				t.Logf("\t%s\tShould get %v.", tests.Success, tt.after)
+			}
+		}
+
+		for _, value := range []string{"startOfDay,Mars/Olympus", "-7x", "1@decade", "startOfDecade"} {
+			t.Logf("\tWhen using %q", value)
+			{
+				if _, err := timeAt(value, now); err == nil {
+					t.Fatalf("\t%s\tShould not be able to adjust the time.", tests.Failed)
+				}
+				t.Logf("\t%s\tShould not be able to adjust the time.", tests.Success)
+			}
+		}
+
+		t.Log("\tWhen using an anchor as a command")
+		{
+			doc := map[string]interface{}{"date": map[string]interface{}{"$gte": "#time:startOfDay,{tz}"}}
+			if err := ProcessVariables(tests.Context, doc, map[string]string{"tz": "America/New_York"}, nil); err != nil {
+				t.Fatalf("\t%s\tShould be able to process the variables : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to process the variables.", tests.Success)
+
+			v, ok := doc["date"].(map[string]interface{})["$gte"].(time.Time)
+			if !ok {
+				t.Fatalf("\t%s\tShould get a time : %#v", tests.Failed, doc)
+			}
+
+			ny, _ := time.LoadLocation("America/New_York")
+			if v = v.In(ny); v.Hour() != 0 || v.Minute() != 0 {
+				t.Fatalf("\t%s\tShould get midnight in New York : %v", tests.Failed, v)
+			}
+			t.Logf("\t%s\tShould get midnight in New York.", tests.Success)
+		}
+	}
+}
+
+// TestISODate tests the formats dates can be written in.
+func TestISODate(t *testing.T) {
+	dates := []struct {
+		value string
+		after time.Time
+	}{
+		{"2016-06-01", time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"2016-06-01T08:00:00.500", time.Date(2016, 6, 1, 8, 0, 0, 500000000, time.UTC)},
+		{"2016-06-01T08:00:00.500Z", time.Date(2016, 6, 1, 8, 0, 0, 500000000, time.UTC)},
+		{"2016-06-01T10:00:00+02:00", time.Date(2016, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{"2016-06-01T04:00:00.25-04:00", time.Date(2016, 6, 1, 8, 0, 0, 250000000, time.UTC)},
+		{"1464768000", time.Date(2016, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{"1464768000250", time.Date(2016, 6, 1, 8, 0, 0, 250000000, time.UTC)},
+	}
+
+	t.Log("Given the need to parse dates.")
+	{
+		for _, tt := range dates {
+			t.Logf("\tWhen using %q", tt.value)
+			{
+				v, err := isoDate(tests.Context, tt.value)
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to parse the date : %v", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould be able to parse the date.", tests.Success)
+
+				if !v.Equal(tt.after) || v.Location() != time.UTC {
+					t.Fatalf("\t%s\tShould get %v : %v", tests.Failed, tt.after, v)
+				}
+				t.Logf("\t%s\tShould get %v.", tests.Success, tt.after)
+			}
+		}
+
+		for _, value := range []string{"2000-1-1", "2016-06-01T10:00", "yesterday"} {
+			t.Logf("\tWhen using %q", value)
+			{
+				if _, err := isoDate(tests.Context, value); err == nil {
+					t.Fatalf("\t%s\tShould not be able to parse the date.", tests.Failed)
+				}
+				t.Logf("\t%s\tShould not be able to parse the date.", tests.Success)
+			}
+		}
+	}
+}
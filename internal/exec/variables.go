@@ -1,20 +1,39 @@
 package exec
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/coralproject/xenia/internal/query"
+
 	"github.com/ardanlabs/kit/log"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
+// errDropped is returned when an optional variable is missing so the field
+// holding it is dropped from the command.
+var errDropped = errors.New("Optional variable is missing")
+
 // ProcessVariables walks the document performing variable substitutions.
-// This function is exported because it is accessed by the tstdata package.
+// Fields holding a missing optional variable are dropped, along with the
+// documents they leave empty. This function is exported because it is
+// accessed by the tstdata package.
 func ProcessVariables(context interface{}, commands map[string]interface{}, vars map[string]string, results map[string]interface{}) error {
+	_, err := processVars(context, "", commands, vars, results)
+	return err
+}
+
+// processVars walks the document at the path in the command performing
+// variable substitutions. True is returned when fields were dropped and the
+// document was left empty, so the field holding it needs to be dropped too.
+func processVars(context interface{}, path string, commands map[string]interface{}, vars map[string]string, results map[string]interface{}) (bool, error) {
 
 	// commands: Contains the mongodb pipeline with any extenstions.
 	// vars    : Key/Value pairs passed into the set execution for variable substituion.
@@ -23,13 +42,22 @@ func ProcessVariables(context interface{}, commands map[string]interface{}, vars
 	// A map of keys that may need to be replaced.
 	keyReplace := make(map[string]string)
 
+	// Were fields dropped for missing optional variables.
+	var dropped bool
+
 	for key, value := range commands {
 
+		// The path of the field for errors.
+		fld := key
+		if path != "" {
+			fld = path + "." + key
+		}
+
 		// Does the key have a variable syntax.
 		idx := strings.IndexByte(key, '{')
 		if idx != -1 {
 			if err := fldSub(context, key, vars, keyReplace); err != nil {
-				return err
+				return false, atPath(err, fld)
 			}
 		}
 
@@ -38,39 +66,102 @@ func ProcessVariables(context interface{}, commands map[string]interface{}, vars
 
 		// We have another document.
 		case map[string]interface{}:
-			if err := ProcessVariables(context, doc, vars, results); err != nil {
-				return err
+			empty, err := processVars(context, fld, doc, vars, results)
+			if err != nil {
+				return false, err
+			}
+
+			if empty {
+				delete(commands, key)
+				dropped = true
 			}
 
 		// We have a string value so check it.
 		case string:
 			if doc != "" && doc[0] == '#' {
 				if err := valSub(context, key, doc, commands, vars, results); err != nil {
-					return err
+					if err != errDropped {
+						return false, atPath(err, fld)
+					}
+
+					delete(commands, key)
+					dropped = true
 				}
+				continue
+			}
+
+			// Replace any variables inside the string.
+			v, err := interpolate(doc, vars, false)
+			if err != nil {
+				log.Error(context, "ProcessVariables", err, "Interpolating %q", doc)
+				return false, atPath(err, fld)
 			}
+			commands[key] = v
 
 		// We have an array of values.
 		case []interface{}:
 
+			// The documents of the array that have not been dropped.
+			list := make([]interface{}, 0, len(doc))
+			var replaced bool
+
 			// Iterate over the array of values.
-			for _, subDoc := range doc {
+		items:
+			for i, subDoc := range doc {
 
 				// What type of subDoc is this array made of.
 				switch arrDoc := subDoc.(type) {
 
 				// We have another document.
 				case map[string]interface{}:
-					if err := ProcessVariables(context, arrDoc, vars, results); err != nil {
-						return err
+					empty, err := processVars(context, fld+"."+strconv.Itoa(i), arrDoc, vars, results)
+					if err != nil {
+						return false, err
+					}
+
+					if empty {
+						continue
 					}
 
-				// We have a string value so check it.
+				// We have a string value so check it. The value of
+				// the variable replaces the array.
 				case string:
 					if arrDoc != "" && arrDoc[0] == '#' {
 						if err := valSub(context, key, arrDoc, commands, vars, results); err != nil {
-							return err
+							if err != errDropped {
+								return false, atPath(err, fld+"."+strconv.Itoa(i))
+							}
+
+							delete(commands, key)
+							dropped = true
+							break items
 						}
+						replaced = true
+						break
+					}
+
+					// Replace any variables inside the string.
+					v, err := interpolate(arrDoc, vars, false)
+					if err != nil {
+						log.Error(context, "ProcessVariables", err, "Interpolating %q", arrDoc)
+						return false, atPath(err, fld+"."+strconv.Itoa(i))
+					}
+					doc[i] = v
+					subDoc = v
+				}
+
+				list = append(list, subDoc)
+			}
+
+			// Remove the documents that were dropped from the array,
+			// an empty array is dropped with them.
+			if len(list) < len(doc) && !replaced {
+				if _, exists := commands[key]; exists {
+					if len(list) == 0 {
+						delete(commands, key)
+						dropped = true
+					} else {
+						commands[key] = list
 					}
 				}
 			}
@@ -81,15 +172,31 @@ func ProcessVariables(context interface{}, commands map[string]interface{}, vars
 	if len(keyReplace) > 0 {
 		for k, v := range keyReplace {
 
+			// The field may have been dropped.
+			value, exists := commands[k]
+			if !exists {
+				continue
+			}
+
 			// Add a new key with this data.
-			commands[v] = commands[k]
+			commands[v] = value
 
 			// Remove the old key.
 			delete(commands, k)
 		}
 	}
 
-	return nil
+	return dropped && len(commands) == 0, nil
+}
+
+// atPath adds the path in the command to the error for a missing variable.
+func atPath(err error, path string) error {
+	if e, ok := err.(*Error); ok && e.Code == CodeParamMissing && e.Path == "" {
+		e.Path = path
+		e.Message += " at " + path
+	}
+
+	return err
 }
 
 // fldSub appends to the replace map the fields that need to change and what the
@@ -99,16 +206,31 @@ func fldSub(context interface{}, key string, vars map[string]string, replace map
 	// Before: statstics.comments.{dimension}.{commentStatus}.{value}
 	// After:  statstics.comments.dim.cstat.v
 
+	// Before: counts.asset-{asset_id}
+	// After:  counts.asset-1234
+
 	parts := strings.Split(key, ".")
 	for i, p := range parts {
 
 		// If there is not variable, move to the next part.
-		if p[0] != '{' {
+		if !strings.ContainsRune(p, '{') {
 			continue
 		}
 
 		l := len(p) - 1
 
+		// Variables inside the part are interpolated.
+		if p[0] != '{' || p[l] != '}' || strings.Count(p, "{") > 1 || strings.ContainsRune(p, '|') {
+			v, err := interpolate(p, vars, true)
+			if err != nil {
+				log.Error(context, "fldSub", err, "interpolating field variables")
+				return err
+			}
+
+			parts[i] = v
+			continue
+		}
+
 		if l < 3 {
 			err := fmt.Errorf("Invalid field variable : %q", p)
 			log.Error(context, "fldSub", err, "validating field variable length")
@@ -130,6 +252,13 @@ func fldSub(context interface{}, key string, vars map[string]string, replace map
 			return err
 		}
 
+		// A variable can't turn the field, or a part of it, into an operator.
+		if strings.HasPrefix(nFld, "$") || strings.Contains(nFld, ".$") {
+			err := newError(CodeParamInvalid, fmt.Errorf("Variable %q can't start %q with $", fld, p))
+			log.Error(context, "fldSub", err, "field variable value")
+			return err
+		}
+
 		parts[i] = nFld
 	}
 
@@ -158,15 +287,16 @@ func valSub(context interface{}, key, variable string, commands map[string]inter
 	cmd := value[0:idx]
 	vari := value[idx+1:]
 
-	switch key {
-	case "$in":
-		if len(cmd) != 6 || cmd[0:4] != "data" {
+	switch {
+	case key == "$in" && !multiValue(cmd):
+		op, ok := dataOp(cmd)
+		if !ok {
 			err := fmt.Errorf("Invalid $in command %q, missing \"data\" keyword or malformed", cmd)
 			log.Error(context, "varSub", err, "$in command processing")
 			return err
 		}
 
-		v, err := dataLookup(context, cmd[5:6], vari, results)
+		v, err := dataLookup(context, op, vari, results)
 		if err != nil {
 			return err
 		}
@@ -185,6 +315,45 @@ func valSub(context interface{}, key, variable string, commands map[string]inter
 	}
 }
 
+// varCmds are the commands that substitute the value of a variable, apart from
+// the #data lookups.
+var varCmds = map[string]bool{
+	"number":   true,
+	"int64":    true,
+	"float":    true,
+	"bool":     true,
+	"null":     true,
+	"string":   true,
+	"date":     true,
+	"objid":    true,
+	"regex":    true,
+	"time":     true,
+	"duration": true,
+	"strings":  true,
+	"numbers":  true,
+	"objids":   true,
+}
+
+// dataOp returns the operator of a #data command, "0" for "data.0". False is
+// returned when the command is not a #data command with an operator.
+func dataOp(cmd string) (string, bool) {
+	if !strings.HasPrefix(cmd, "data.") || len(cmd) == len("data.") {
+		return "", false
+	}
+
+	return cmd[len("data."):], true
+}
+
+// multiValue reports if the command expands a variable into an array.
+func multiValue(cmd string) bool {
+	switch cmd {
+	case "strings", "numbers", "objids":
+		return true
+	}
+
+	return false
+}
+
 // varLookup looks up variables and returns their values as the specified type.
 func varLookup(context interface{}, cmd, variable string, vars map[string]string, results map[string]interface{}) (interface{}, error) {
 
@@ -194,50 +363,107 @@ func varLookup(context interface{}, cmd, variable string, vars map[string]string
 	// Before: {"field": "#date:variable_name"}    		After: {"field": time.Time}
 	// Before: {"field": "#objid:variable_name"}   		After: {"field": mgo.ObjectId}
 	// Before: {"field": "#regex:/pattern/<options>"}   After: {"field": bson.RegEx}
-	// Before: {"field": "#since:3600"}   				After: {"field": time.Time}
+	// Before: {"field": "#time:3600"}   				After: {"field": time.Time}
+	// Before: {"field": "#time:-7d@day,America/New_York"}	After: {"field": time.Time}
 	// Before: {"field": "#data.0:doc.station_id"}   	After: {"field": "23453"}
+	// Before: {"field": "#data.0:doc.tags.0"}   		After: {"field": "news"}
+	// Before: {"field": "#data.0:doc.score|0"}   		After: {"field": 0} when score is missing.
+	// Before: {"field": "#strings:variable_name"}  	After: {"field": ["a", "b"]}
+	// Before: {"field": "#numbers:variable_name"}  	After: {"field": [1, 2]}
+	// Before: {"field": "#objids:variable_name"}   	After: {"field": [mgo.ObjectId]}
+	// Before: {"field": "#float:variable_name"}  		After: {"field": 0.75}
+	// Before: {"field": "#int64:variable_name"}  		After: {"field": int64(1234)}
+	// Before: {"field": "#bool:variable_name"}  		After: {"field": true}
+	// Before: {"field": "#duration:variable_name"}  	After: {"field": int64(5400000)} for "1h30m"
+	// Before: {"field": "#null:"}  					After: {"field": null}
+
+	// Before: {"field": "#number:limit|25"}  			After: {"field": 25} when limit is missing.
+	// Before: {"field": "#string:status?"}  			After: {} when status is missing.
+
+	// Is this a command we know about.
+	isData := cmd == "data" || strings.HasPrefix(cmd, "data.")
+	if !varCmds[cmd] && !isData {
+		err := fmt.Errorf("Unknown command %q", cmd)
+		log.Error(context, "varLookup", err, "Checking cmd")
+		return nil, err
+	}
 
-	// If the variable does not exist, use the variable straight up.
-	param, exists := vars[variable]
-	if !exists {
-		param = variable
+	// A null has no variable to look up.
+	if cmd == "null" {
+		return nil, nil
 	}
 
-	// Do we have a command that is not known.
-	if len(cmd) < 4 {
-		err := fmt.Errorf("Unknown command %q", cmd)
-		log.Error(context, "varLookup", err, "Checking cmd is proper length")
+	param, err := varValue(cmd, variable, vars)
+	if err != nil {
+		if err != errDropped {
+			log.Error(context, "varLookup", err, "Finding variable")
+		}
+		return nil, err
+	}
+
+	// Data lookups can select the document to use, "data.0", "data.*" or
+	// "data.distinct".
+	if isData {
+		if op, ok := dataOp(cmd); ok {
+			return dataLookup(context, op, param, results)
+		}
+
+		err := errors.New("Data command is missing the operator")
+		log.Error(context, "varLookup", err, "Checking cmd is data")
 		return nil, err
 	}
 
 	// Let's perform the right action per command.
-	switch cmd[0:4] {
-	case "numb":
-		return number(context, param)
+	switch cmd {
+	case "strings":
+		return stringList(param), nil
+
+	case "numbers":
+		v, err := numberList(context, param)
+		return v, paramErr(err)
+
+	case "objids":
+		v, err := objIDList(context, param)
+		return v, paramErr(err)
+
+	case "number":
+		v, err := number(context, param)
+		return v, paramErr(err)
+
+	case "int64":
+		v, err := int64Value(context, param)
+		return v, paramErr(err)
+
+	case "float":
+		v, err := float(context, param)
+		return v, paramErr(err)
+
+	case "bool":
+		v, err := boolean(context, param)
+		return v, paramErr(err)
 
-	case "stri":
+	case "string":
 		return param, nil
 
 	case "date":
-		return isoDate(context, param)
+		v, err := isoDate(context, param)
+		return v, paramErr(err)
 
-	case "obji":
-		return objID(context, param)
+	case "objid":
+		v, err := objID(context, param)
+		return v, paramErr(err)
 
-	case "rege":
-		return regExp(context, param)
+	case "regex":
+		v, err := regExp(context, param)
+		return v, paramErr(err)
 
 	case "time":
-		return adjTime(context, param)
+		v, err := adjTime(context, param)
+		return v, paramErr(err)
 
-	case "data":
-		if len(cmd) == 6 {
-			return dataLookup(context, cmd[5:6], param, results)
-		}
-
-		err := errors.New("Data command is missing the operator")
-		log.Error(context, "varLookup", err, "Checking cmd is data")
-		return nil, err
+	case "duration":
+		v, err := durationMS(context, param)
+		return v, paramErr(err)
 
 	default:
 		err := fmt.Errorf("Unknown command %q", cmd)
@@ -246,6 +472,75 @@ func varLookup(context interface{}, cmd, variable string, vars map[string]string
 	}
 }
 
+// varValue returns the value of the variable. A variable can have a default
+// value, "limit|25", or be optional, "status?", in which case errDropped is
+// returned when it is missing. Values that can't be variable names, like
+// "2015-12-09" or "/east/i", are used as written once any {name} placeholders
+// are interpolated. Any other missing variable is an error.
+func varValue(cmd, variable string, vars map[string]string) (string, error) {
+
+	// The #data lookups name the saved results to look in.
+	if strings.HasPrefix(cmd, "data") {
+		if param, exists := vars[variable]; exists {
+			return param, nil
+		}
+		return variable, nil
+	}
+
+	name := variable
+	var def string
+	var hasDef, optional bool
+
+	// The default or optional marker only applies to variable names so
+	// values like "/a|b/" are left alone.
+	if idx := strings.IndexByte(variable, '|'); idx != -1 && isVarName(variable[:idx]) {
+		name, def, hasDef = variable[:idx], variable[idx+1:], true
+	} else if l := len(variable) - 1; l > 0 && variable[l] == '?' && isVarName(variable[:l]) {
+		name, optional = variable[:l], true
+	}
+
+	if param, exists := vars[name]; exists {
+		return param, nil
+	}
+
+	switch {
+	case hasDef:
+		return def, nil
+
+	case optional:
+		return "", errDropped
+
+	// Time anchors are written like names, "#time:startOfDay".
+	case cmd == "time" && timeAnchors[name] != "":
+		return name, nil
+
+	// Values can be built from variables, "#date:{year}-01-01".
+	case !isVarName(name):
+		return interpolate(name, vars, false)
+	}
+
+	return "", newError(CodeParamMissing, fmt.Errorf("Variable %q is missing", name))
+}
+
+// isVarName reports if the value can be the name of a variable. Names start
+// with a letter or underscore. Object ids are never names.
+func isVarName(value string) bool {
+	if value == "" || bson.IsObjectIdHex(value) {
+		return false
+	}
+
+	for i, r := range value {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && (r == '-' || r >= '0' && r <= '9'):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
 // dataLookup looks up data from the saved results based on the data operation
 // and the lookup value.
 func dataLookup(context interface{}, dataOp, lookup string, results map[string]interface{}) (interface{}, error) {
@@ -257,12 +552,26 @@ func dataLookup(context interface{}, dataOp, lookup string, results map[string]i
 	//  	lookup : "list.station_id"							    //  	lookup : "list.station_id"
 	//  	results: {"list": [{"station_id":"42021"}]}				//  	results: {"list": [{"station_id":"42021"}, {"station_id":"23567"}]}
 
+	// Arrays in the documents can be indexed or fanned out into the array
+	// and the distinct operator leaves out the repeated values.
+	// Before: {"field" : {"$in": "#data.distinct:list.comments.*.user_id"}}}
+	// After : {"field" : {"$in": ["a", "b"]}}
+	//  	results: {"list": [{"comments": [{"user_id": "a"}, {"user_id": "b"}]}, {"comments": [{"user_id": "a"}]}]}
+
+	// A default value can be used for missing fields, "list.score|0".
+	f := dataField{}
+	if idx := strings.IndexByte(lookup, '|'); idx != -1 {
+		lookup, f.def, f.hasDef = lookup[:idx], literal(lookup[idx+1:]), true
+	}
+
 	// Find the result data based on the lookup and the field lookup.
 	data, field, err := findResultData(context, lookup, results)
 	if err != nil {
 		return "", err
 	}
 
+	f.parts = strings.Split(field, ".")
+
 	// How many documents do we have.
 	l := len(data)
 
@@ -274,20 +583,25 @@ func dataLookup(context interface{}, dataOp, lookup string, results map[string]i
 	}
 
 	// Do we need to return an array.
-	if dataOp == "*" {
+	if dataOp == "*" || dataOp == "distinct" {
 
-		// We need to create an array of the values.
+		// We need to create an array of the values, which are flattened
+		// when the field fans out into an array.
 		var array []interface{}
 		for _, doc := range data {
-
-			// Find the value for the specified field.
-			fldValue, err := docFieldLookup(context, doc, field)
-			if err != nil {
+			if array, err = f.values(doc, 0, array); err != nil {
+				log.Error(context, "dataLookup", err, "Document field lookup")
 				return "", err
 			}
+		}
+
+		if dataOp == "distinct" {
+			array = distinct(array)
+		}
 
-			// Append the value to the array.
-			array = append(array, fldValue)
+		// An $in needs an array even when nothing was found.
+		if array == nil {
+			array = []interface{}{}
 		}
 
 		return array, nil
@@ -295,7 +609,7 @@ func dataLookup(context interface{}, dataOp, lookup string, results map[string]i
 
 	// Convert the index position to an int.
 	index, err := strconv.Atoi(dataOp)
-	if err != nil {
+	if err != nil || index < 0 {
 		err = fmt.Errorf("Invalid operator command operator %q", dataOp)
 		log.Error(context, "dataLookup", err, "Index conversion")
 		return "", err
@@ -309,7 +623,7 @@ func dataLookup(context interface{}, dataOp, lookup string, results map[string]i
 	}
 
 	// Find the value for the specified field.
-	fldValue, err := docFieldLookup(context, data[index], field)
+	fldValue, err := f.value(context, data[index])
 	if err != nil {
 		return "", err
 	}
@@ -356,50 +670,150 @@ func findResultData(context interface{}, lookup string, results map[string]inter
 	return values, field, nil
 }
 
-// docFieldLookup recurses the document for the specified field and returns its value.
+// docFieldLookup walks the document for the specified field and returns its
+// value. Array elements can be selected by index, "tags.0", and a wildcard
+// returns the values of every element, "comments.*.user_id".
 func docFieldLookup(context interface{}, doc map[string]interface{}, field string) (interface{}, error) {
+	f := dataField{parts: strings.Split(field, ".")}
+	return f.value(context, doc)
+}
 
-	// condition.location.type
-
-	// Extract the first field for lookup and the remaining fields
-	// if we need to recurse deeper into the result document.
-	var nextFld string
-	idx := strings.IndexByte(field, '.')
-	if idx > 0 {
-		nextFld = field[idx+1:]
-		field = field[0:idx]
-	}
+// dataField is the field of the result documents a lookup reads.
+type dataField struct {
+	parts  []string    // The path to the field, "condition.location.type".
+	def    interface{} // The value used when the field is missing.
+	hasDef bool        // A default value was provided, "list.score|0".
+}
 
-	// Look up the first field.
-	fldValue, exists := doc[field]
-	if !exists {
-		err := fmt.Errorf("Field %q not found", field)
+// value returns the value of the field in the document. The values are
+// returned as an array when the field has a wildcard.
+func (f *dataField) value(context interface{}, doc map[string]interface{}) (interface{}, error) {
+	vs, err := f.values(doc, 0, nil)
+	if err != nil {
 		log.Error(context, "docFieldLookup", err, "Document field lookup")
 		return nil, err
 	}
 
+	for _, part := range f.parts {
+		if part == "*" {
+			if vs == nil {
+				vs = []interface{}{}
+			}
+			return vs, nil
+		}
+	}
+
+	return vs[0], nil
+}
+
+// values walks the value for the parts of the field from the position and
+// appends the values it finds.
+func (f *dataField) values(value interface{}, i int, out []interface{}) ([]interface{}, error) {
+
 	// When we have found the last field, we have the data.
-	if idx == -1 {
-		return fldValue, nil
+	if i == len(f.parts) {
+		return append(out, value), nil
 	}
 
-	// We need to recuse the result for the next field.
+	part := f.parts[i]
 
-	// The field data we found needs to be a document.
-	fldDoc, ok := fldValue.(bson.M)
-	if !ok {
-		err := fmt.Errorf("Field value is a %T and not a bson document", fldValue)
-		log.Error(context, "docFieldLookup", err, "Type assert for document")
-		return nil, err
+	switch v := value.(type) {
+	case bson.M:
+		return f.values(map[string]interface{}(v), i, out)
+
+	case map[string]interface{}:
+		fldValue, exists := v[part]
+		if !exists {
+			return f.missing(part, out)
+		}
+		return f.values(fldValue, i+1, out)
+
+	case []interface{}:
+
+		// Fan out into every element of the array.
+		if part == "*" {
+			for _, item := range v {
+				var err error
+				if out, err = f.values(item, i+1, out); err != nil {
+					return nil, err
+				}
+			}
+			return out, nil
+		}
+
+		idx, err := strconv.Atoi(part)
+		if err != nil || idx < 0 {
+			return nil, fmt.Errorf("Field %q is not an array index", part)
+		}
+
+		if idx >= len(v) {
+			return f.missing(part, out)
+		}
+		return f.values(v[idx], i+1, out)
+
+	case nil:
+		return f.missing(part, out)
 	}
 
-	// Find the next field and its value.
-	fldValue, err := docFieldLookup(context, fldDoc, nextFld)
-	if err != nil {
-		return nil, err
+	return nil, fmt.Errorf("Field value is a %T and not a bson document or array", value)
+}
+
+// missing appends the default value for a missing field, or returns an error
+// when there is no default.
+func (f *dataField) missing(part string, out []interface{}) ([]interface{}, error) {
+	if !f.hasDef {
+		return nil, fmt.Errorf("Field %q not found", part)
 	}
 
-	return fldValue, nil
+	return append(out, f.def), nil
+}
+
+// distinct returns the values without the repeated ones, keeping the order
+// they were first found in.
+func distinct(list []interface{}) []interface{} {
+	seen := make(map[interface{}]bool, len(list))
+
+	var out []interface{}
+	for _, v := range list {
+
+		// Documents and arrays can't be map keys.
+		key := v
+		if v != nil && !reflect.TypeOf(v).Comparable() {
+			key = fmt.Sprintf("%T%#v", v, v)
+		}
+
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		out = append(out, v)
+	}
+
+	return out
+}
+
+// literal returns the value of a default written in a lookup. Numbers, bools
+// and null keep their type and anything else is a string.
+func literal(value string) interface{} {
+	if i, err := strconv.Atoi(value); err == nil {
+		return i
+	}
+
+	if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f
+	}
+
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+
+	return value
 }
 
 //==============================================================================
@@ -415,25 +829,173 @@ func number(context interface{}, value string) (int, error) {
 	return i, nil
 }
 
-// isoDate is a helper function to convert the internal extension for dates
-// into a BSON date. We convert the following string
-func isoDate(context interface{}, value string) (time.Time, error) {
-	var parse string
-
-	switch len(value) {
-	case 10:
-		parse = "2006-01-02"
-	case 24:
-		parse = "2006-01-02T15:04:05.999Z"
-	case 23:
-		parse = "2006-01-02T15:04:05.999"
-	default:
-		err := fmt.Errorf("Invalid date value %q", value)
-		log.Error(context, "isoDate", err, "Selecting date parse string")
-		return time.Time{}, err
+// int64Value is a helper function to convert the value to a 64 bit integer.
+func int64Value(context interface{}, value string) (int64, error) {
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("Parameter %q is not a 64 bit integer", value)
+		log.Error(context, "varLookup", err, "Int64 conversion")
+		return 0, err
 	}
+	return i, nil
+}
 
-	dateTime, err := time.Parse(parse, value)
+// float is a helper function to convert the value to a float.
+func float(context interface{}, value string) (float64, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		err = fmt.Errorf("Parameter %q is not a float", value)
+		log.Error(context, "varLookup", err, "Float conversion")
+		return 0, err
+	}
+	return f, nil
+}
+
+// boolean is a helper function to convert the value to a bool.
+func boolean(context interface{}, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		err = fmt.Errorf("Parameter %q is not a bool", value)
+		log.Error(context, "varLookup", err, "Bool conversion")
+		return false, err
+	}
+	return b, nil
+}
+
+// durationMS is a helper function to convert a duration, like "1h30m", into
+// milliseconds. A plain integer is already milliseconds.
+func durationMS(context interface{}, value string) (int64, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ms, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		err = fmt.Errorf("Parameter %q is not a duration", value)
+		log.Error(context, "varLookup", err, "Duration conversion")
+		return 0, err
+	}
+	return int64(d / time.Millisecond), nil
+}
+
+// EncodeValues returns the form of the values stored in the variables. A single
+// value is stored as is and multiple values are stored as a JSON array so they
+// can be expanded by the #strings:, #numbers: and #objids: commands.
+func EncodeValues(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		return ""
+	}
+
+	return string(data)
+}
+
+// EncodeJSON returns the form of a JSON value stored in the variables. Strings
+// are stored as is, numbers and bools in their JSON form and arrays and objects
+// as JSON so arrays can be expanded like multiple values.
+func EncodeJSON(v interface{}) (string, error) {
+	switch jv := v.(type) {
+	case string:
+		return jv, nil
+
+	case json.Number:
+		return jv.String(), nil
+
+	case bool:
+		return strconv.FormatBool(jv), nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// values returns the values stored in the variable. A JSON array holds
+// multiple values, anything else is a single value. Arrays and objects inside
+// the array are kept as JSON.
+func values(param string) []string {
+	if strings.HasPrefix(param, "[") {
+		var vs []interface{}
+
+		// Keep numbers as they were written.
+		dec := json.NewDecoder(strings.NewReader(param))
+		dec.UseNumber()
+
+		if err := dec.Decode(&vs); err == nil {
+			list := make([]string, len(vs))
+			for i, v := range vs {
+				s, err := EncodeJSON(v)
+				if err != nil {
+					return []string{param}
+				}
+				list[i] = s
+			}
+			return list
+		}
+	}
+
+	return []string{param}
+}
+
+// stringList is a helper function to expand the values of a variable into an
+// array of strings.
+func stringList(param string) []interface{} {
+	vs := values(param)
+
+	list := make([]interface{}, len(vs))
+	for i, v := range vs {
+		list[i] = v
+	}
+
+	return list
+}
+
+// numberList is a helper function to expand the values of a variable into an
+// array of numbers.
+func numberList(context interface{}, param string) ([]interface{}, error) {
+	vs := values(param)
+
+	list := make([]interface{}, len(vs))
+	for i, v := range vs {
+		n, err := number(context, v)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = n
+	}
+
+	return list, nil
+}
+
+// objIDList is a helper function to expand the values of a variable into an
+// array of Mongo Object Ids.
+func objIDList(context interface{}, param string) ([]interface{}, error) {
+	vs := values(param)
+
+	list := make([]interface{}, len(vs))
+	for i, v := range vs {
+		id, err := objID(context, v)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = id
+	}
+
+	return list, nil
+}
+
+// isoDate is a helper function to convert the internal extension for dates
+// into a BSON date. Dates can be written as "2006-01-02", as RFC3339 with or
+// without an offset, or as seconds or milliseconds since the epoch.
+func isoDate(context interface{}, value string) (time.Time, error) {
+	dateTime, err := query.ParseDate(value)
 	if err != nil {
 		log.Error(context, "isoDate", err, "Parsing date string")
 		return time.Time{}, err
@@ -456,6 +1018,12 @@ func objID(context interface{}, value string) (bson.ObjectId, error) {
 
 // regExp is a helper function to process regex commands.
 func regExp(context interface{}, value string) (bson.RegEx, error) {
+	if len(value) < 2 {
+		err := fmt.Errorf("Parameter %q is not a regular expression", value)
+		log.Error(context, "varLookup", err, "Regex length")
+		return bson.RegEx{}, err
+	}
+
 	idx := strings.IndexByte(value[1:], '/')
 	if value[0] != '/' || idx == -1 {
 		err := fmt.Errorf("Parameter %q is not a regular expression", value)
@@ -474,104 +1042,139 @@ func regExp(context interface{}, value string) (bson.RegEx, error) {
 	return bson.RegEx{Pattern: pattern, Options: options}, nil
 }
 
+// timeAnchors maps the anchors that can be used with #time to the unit the
+// time is rounded down to.
+var timeAnchors = map[string]string{
+	"startOfHour":  "hour",
+	"startOfDay":   "day",
+	"startOfWeek":  "week",
+	"startOfMonth": "month",
+	"startOfYear":  "year",
+}
+
 // adjTime is a helper function to take the current time and adjust it based
 // on the provided value.
 func adjTime(context interface{}, value string) (time.Time, error) {
+	return timeAt(value, time.Now())
+}
+
+// timeAt adjusts the time based on the provided value. The time can be offset,
+// rounded down to the start of a calendar unit and both are done in the
+// timezone given after a comma, UTC by default.
+func timeAt(value string, now time.Time) (time.Time, error) {
 
 	// The default value is in seconds unless overridden.
 	// #time:0      Current date/time
 	// #time:-3600  3600 seconds in the past
 	// #time:3m		3 minutes in the future.
+	// #time:-7d	7 days in the past.
 
 	// Possible duration types.
-	// "ns": int64(Nanosecond),
-	// "us": int64(Microsecond),
-	// "ms": int64(Millisecond),
-	// "s":  int64(Second),
-	// "m":  int64(Minute),
-	// "h":  int64(Hour),
-
-	// Do we have a single value?
-	if len(value) == 1 {
-		val, err := strconv.Atoi(value[0:1])
+	// "ns", "us", "ms", "s", "m", "h" for fixed durations.
+	// "d", "w", "mo", "y" for calendar days, weeks, months and years.
+
+	// The time can be rounded down to the start of the hour, day, week,
+	// month or year. Weeks start on Monday.
+	// #time:startOfDay						Midnight today.
+	// #time:-7d@day						Midnight 7 days ago.
+	// #time:-1mo@month						The start of last month.
+	// #time:startOfDay,America/New_York	Midnight today in New York.
+
+	loc := time.UTC
+	if idx := strings.IndexByte(value, ','); idx != -1 {
+		l, err := time.LoadLocation(value[idx+1:])
 		if err != nil {
-			return time.Time{}.UTC(), fmt.Errorf("Invalid duration : %q", value[0:1])
+			return time.Time{}, fmt.Errorf("Invalid timezone : %q", value[idx+1:])
 		}
+		value, loc = value[:idx], l
+	}
 
-		if val == 0 {
-			return time.Now().UTC(), nil
+	offset, unit := value, ""
+	if u, exists := timeAnchors[value]; exists {
+		offset, unit = "0", u
+	} else if idx := strings.IndexByte(value, '@'); idx != -1 {
+		offset, unit = value[:idx], value[idx+1:]
+		if offset == "" {
+			offset = "0"
 		}
-
-		return time.Now().Add(time.Duration(val) * time.Second).UTC(), nil
 	}
 
-	// Do we have a duration type and where does the
-	// actual duration value end
-	var typ string
-	var end int
-
-	// The end byte position for the last character in the string.
-	ePos := len(value) - 1
-
-	// Look at the very last character.
-	t := value[ePos:]
-	switch t {
-
-	// Is this a minute or hour? [3m]
-	case "m", "h":
-		typ = t
-		end = ePos // Position of last chr in value.
-
-	// Is this a second or other duration? [3s or 3us]
-	case "s":
-		typ = t    // s for 3s
-		end = ePos // 3 for 3s
+	t, err := offsetTime(now.In(loc), offset)
+	if err != nil {
+		return time.Time{}, err
+	}
 
-		// Is this smaller than a second? [ns, us, ms]
-		if len(value) > 2 {
-			t := value[ePos-1 : ePos]
-			switch t {
-			case "n", "u", "m":
-				typ = value[ePos-1:] // us for 3us
-				end = ePos - 1       // 3 for 3us
-			}
+	if unit != "" {
+		if t, err = startOf(t, unit); err != nil {
+			return time.Time{}, err
 		}
-
-	default:
-		typ = "s"      // s for 3600
-		end = ePos + 1 // 0 for 3600
 	}
 
-	// Check if we are to negative the value.
-	var start int
-	if value[0] == '-' {
-		start = 1
-	}
+	return t.UTC(), nil
+}
 
-	// Check the remaining bytes is an integer value.
-	val, err := strconv.Atoi(value[start:end])
-	if err != nil {
-		return time.Time{}.UTC(), fmt.Errorf("Invalid duration : %q", value[start:end])
+// offsetTime adds the offset, like "-3600", "3m" or "-7d", to the time. Days
+// and longer are calendar units so they keep the time of day across daylight
+// saving changes.
+func offsetTime(t time.Time, offset string) (time.Time, error) {
+
+	// Find where the number ends and the duration type starts.
+	end := len(offset)
+	for i, r := range offset {
+		if (r < '0' || r > '9') && !(i == 0 && (r == '-' || r == '+')) {
+			end = i
+			break
+		}
 	}
 
-	// Do we have to negate the value?
-	if start == 1 {
-		val *= -1
+	val, err := strconv.Atoi(offset[:end])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid duration : %q", offset)
 	}
 
-	// Calcuate the time value.
-	switch typ {
+	switch offset[end:] {
 	case "ns":
-		return time.Now().Add(time.Duration(val) * time.Nanosecond).UTC(), nil
+		return t.Add(time.Duration(val) * time.Nanosecond), nil
 	case "us":
-		return time.Now().Add(time.Duration(val) * time.Microsecond).UTC(), nil
+		return t.Add(time.Duration(val) * time.Microsecond), nil
 	case "ms":
-		return time.Now().Add(time.Duration(val) * time.Millisecond).UTC(), nil
+		return t.Add(time.Duration(val) * time.Millisecond), nil
+	case "", "s":
+		return t.Add(time.Duration(val) * time.Second), nil
 	case "m":
-		return time.Now().Add(time.Duration(val) * time.Minute).UTC(), nil
+		return t.Add(time.Duration(val) * time.Minute), nil
 	case "h":
-		return time.Now().Add(time.Duration(val) * time.Hour).UTC(), nil
-	default:
-		return time.Now().Add(time.Duration(val) * time.Second).UTC(), nil
+		return t.Add(time.Duration(val) * time.Hour), nil
+	case "d":
+		return t.AddDate(0, 0, val), nil
+	case "w":
+		return t.AddDate(0, 0, val*7), nil
+	case "mo":
+		return t.AddDate(0, val, 0), nil
+	case "y":
+		return t.AddDate(val, 0, 0), nil
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid duration : %q", offset)
+}
+
+// startOf rounds the time down to the start of the calendar unit in the
+// timezone of the time.
+func startOf(t time.Time, unit string) (time.Time, error) {
+	y, m, d := t.Date()
+
+	switch unit {
+	case "hour":
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location()), nil
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location()), nil
+	case "week":
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location()), nil
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location()), nil
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, t.Location()), nil
 	}
+
+	return time.Time{}, fmt.Errorf("Invalid time unit : %q", unit)
 }
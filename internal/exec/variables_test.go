@@ -1,6 +1,7 @@
 package exec_test
 
 import (
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -187,6 +188,338 @@ func TestPreProcessing(t *testing.T) {
 	}
 }
 
+// TestMultiValues tests the expansion of variables with multiple values.
+func TestMultiValues(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	commands := []struct {
+		doc   map[string]interface{}
+		vars  map[string]string
+		after map[string]interface{}
+	}{
+		{
+			map[string]interface{}{"field_name": map[string]interface{}{"$in": "#strings:value"}},
+			map[string]string{"value": exec.EncodeValues([]string{"a", "b"})},
+			map[string]interface{}{"field_name": map[string]interface{}{"$in": []interface{}{"a", "b"}}},
+		},
+		{
+			map[string]interface{}{"field_name": "#strings:value"},
+			map[string]string{"value": exec.EncodeValues([]string{"a"})},
+			map[string]interface{}{"field_name": []interface{}{"a"}},
+		},
+		{
+			map[string]interface{}{"field_name": map[string]interface{}{"$in": "#numbers:value"}},
+			map[string]string{"value": `[10,"20"]`},
+			map[string]interface{}{"field_name": map[string]interface{}{"$in": []interface{}{10, 20}}},
+		},
+		{
+			map[string]interface{}{"field_name": map[string]interface{}{"$in": "#strings:value"}},
+			map[string]string{"value": `[{"id":1},["b","c"],"d",true]`},
+			map[string]interface{}{"field_name": map[string]interface{}{"$in": []interface{}{`{"id":1}`, `["b","c"]`, "d", "true"}}},
+		},
+		{
+			map[string]interface{}{"field_name": map[string]interface{}{"$nin": "#objids:value"}},
+			map[string]string{"value": exec.EncodeValues([]string{"5660bc6e16908cae692e0593", "5660bc6e16908cae692e0594"})},
+			map[string]interface{}{"field_name": map[string]interface{}{"$nin": []interface{}{bson.ObjectIdHex("5660bc6e16908cae692e0593"), bson.ObjectIdHex("5660bc6e16908cae692e0594")}}},
+		},
+	}
+
+	t.Logf("Given the need to expand variables with multiple values.")
+	{
+		for _, cmd := range commands {
+			t.Logf("\tWhen using %+v with %+v", cmd.doc, cmd.vars)
+			{
+				if err := exec.ProcessVariables("", cmd.doc, cmd.vars, nil); err != nil {
+					t.Errorf("\t%s\tShould be able to process the variables : %v", tests.Failed, err)
+					continue
+				}
+				t.Logf("\t%s\tShould be able to process the variables.", tests.Success)
+
+				if !reflect.DeepEqual(cmd.doc, cmd.after) {
+					t.Log(cmd.doc)
+					t.Log(cmd.after)
+					t.Errorf("\t%s\tShould get back the expected document.", tests.Failed)
+					continue
+				}
+				t.Logf("\t%s\tShould get back the expected document.", tests.Success)
+			}
+		}
+	}
+
+	t.Logf("Given the need to reject invalid values.")
+	{
+		doc := map[string]interface{}{"field_name": map[string]interface{}{"$in": "#numbers:value"}}
+		vars := map[string]string{"value": exec.EncodeValues([]string{"10", "abc"})}
+
+		t.Logf("\tWhen using %+v with %+v", doc, vars)
+		{
+			if err := exec.ProcessVariables("", doc, vars, nil); err == nil {
+				t.Errorf("\t%s\tShould not be able to process the variables.", tests.Failed)
+			} else {
+				t.Logf("\t%s\tShould not be able to process the variables.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestInlineDefaults tests variables with default values and optional
+// variables that drop the fields holding them when they are missing.
+func TestInlineDefaults(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	commands := []struct {
+		doc   map[string]interface{}
+		vars  map[string]string
+		after map[string]interface{}
+	}{
+		{
+			map[string]interface{}{"$limit": "#number:limit|25"},
+			map[string]string{},
+			map[string]interface{}{"$limit": 25},
+		},
+		{
+			map[string]interface{}{"$limit": "#number:limit|25"},
+			map[string]string{"limit": "5"},
+			map[string]interface{}{"$limit": 5},
+		},
+		{
+			map[string]interface{}{"name": "#regex:pattern|/a|b/i"},
+			map[string]string{},
+			map[string]interface{}{"name": bson.RegEx{Pattern: "a|b", Options: "i"}},
+		},
+		{
+			map[string]interface{}{"name": "#regex:/a|b/"},
+			map[string]string{},
+			map[string]interface{}{"name": bson.RegEx{Pattern: "a|b"}},
+		},
+		{
+			map[string]interface{}{"$match": map[string]interface{}{"status": "#string:status?", "station_id": "#string:station_id"}},
+			map[string]string{"station_id": "42021"},
+			map[string]interface{}{"$match": map[string]interface{}{"station_id": "42021"}},
+		},
+		{
+			map[string]interface{}{"$match": map[string]interface{}{"status": "#string:status?", "station_id": "#string:station_id"}},
+			map[string]string{"station_id": "42021", "status": "ok"},
+			map[string]interface{}{"$match": map[string]interface{}{"status": "ok", "station_id": "42021"}},
+		},
+		{
+			map[string]interface{}{"$match": map[string]interface{}{"date": map[string]interface{}{"$gte": "#date:start?"}}},
+			map[string]string{},
+			map[string]interface{}{},
+		},
+		{
+			map[string]interface{}{"$match": map[string]interface{}{"$or": []interface{}{map[string]interface{}{"a": "#string:a?"}, map[string]interface{}{"b": "#string:b"}}}},
+			map[string]string{"b": "x"},
+			map[string]interface{}{"$match": map[string]interface{}{"$or": []interface{}{map[string]interface{}{"b": "x"}}}},
+		},
+		{
+			map[string]interface{}{"$match": map[string]interface{}{"{field}": "#string:value?"}},
+			map[string]string{"field": "status"},
+			map[string]interface{}{},
+		},
+	}
+
+	t.Logf("Given the need to use default values and optional variables.")
+	{
+		for _, cmd := range commands {
+			t.Logf("\tWhen using %+v with %+v", cmd.doc, cmd.vars)
+			{
+				if err := exec.ProcessVariables("", cmd.doc, cmd.vars, nil); err != nil {
+					t.Errorf("\t%s\tShould be able to process the variables : %v", tests.Failed, err)
+					continue
+				}
+				t.Logf("\t%s\tShould be able to process the variables.", tests.Success)
+
+				if !reflect.DeepEqual(cmd.doc, cmd.after) {
+					t.Log(cmd.doc)
+					t.Log(cmd.after)
+					t.Errorf("\t%s\tShould get back the expected document.", tests.Failed)
+					continue
+				}
+				t.Logf("\t%s\tShould get back the expected document.", tests.Success)
+			}
+		}
+	}
+
+	t.Logf("Given the need to report empty regular expressions.")
+	{
+		for _, vars := range []map[string]string{{"p": ""}, {"p": "/"}} {
+			doc := map[string]interface{}{"name": "#regex:p"}
+
+			t.Logf("\tWhen using %+v with %+v", doc, vars)
+			{
+				err := exec.ProcessVariables("", doc, vars, nil)
+				if e, ok := err.(*exec.Error); !ok || e.Code != exec.CodeParamInvalid {
+					t.Fatalf("\t%s\tShould get an invalid parameter error : %#v", tests.Failed, err)
+				}
+				t.Logf("\t%s\tShould get an invalid parameter error.", tests.Success)
+			}
+		}
+	}
+
+	t.Logf("Given the need to report missing variables.")
+	{
+		doc := map[string]interface{}{"$match": map[string]interface{}{"tags": []interface{}{"#string:tag"}}}
+
+		t.Logf("\tWhen using %+v without variables", doc)
+		{
+			err := exec.ProcessVariables("", doc, map[string]string{}, nil)
+
+			e, ok := err.(*exec.Error)
+			if !ok || e.Code != exec.CodeParamMissing || e.Path != "$match.tags.0" {
+				t.Fatalf("\t%s\tShould get a missing variable error with the path : %#v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould get a missing variable error with the path.", tests.Success)
+
+			if msg := `Variable "tag" is missing at $match.tags.0`; e.Error() != msg {
+				t.Fatalf("\t%s\tShould get the error %q : %q", tests.Failed, msg, e.Error())
+			}
+			t.Logf("\t%s\tShould get the error naming the variable and path.", tests.Success)
+		}
+	}
+}
+
+// TestTypedCommands tests the float, int64, bool, null and duration commands
+// and that unknown commands are reported.
+func TestTypedCommands(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	vars := map[string]string{"score": "0.75", "flag": "true", "views": "9007199254740993", "window": "1h30m", "ms": "250"}
+
+	commands := []struct {
+		doc   map[string]interface{}
+		after map[string]interface{}
+	}{
+		{map[string]interface{}{"score": map[string]interface{}{"$gte": "#float:score"}}, map[string]interface{}{"score": map[string]interface{}{"$gte": 0.75}}},
+		{map[string]interface{}{"flagged": "#bool:flag"}, map[string]interface{}{"flagged": true}},
+		{map[string]interface{}{"flagged": "#bool:missing|false"}, map[string]interface{}{"flagged": false}},
+		{map[string]interface{}{"deleted": "#null:"}, map[string]interface{}{"deleted": nil}},
+		{map[string]interface{}{"views": "#int64:views"}, map[string]interface{}{"views": int64(9007199254740993)}},
+		{map[string]interface{}{"window": "#duration:window"}, map[string]interface{}{"window": int64(5400000)}},
+		{map[string]interface{}{"window": "#duration:ms"}, map[string]interface{}{"window": int64(250)}},
+	}
+
+	t.Logf("Given the need to substitute typed values.")
+	{
+		for _, cmd := range commands {
+			t.Logf("\tWhen using %+v", cmd.doc)
+			{
+				if err := exec.ProcessVariables("", cmd.doc, vars, nil); err != nil {
+					t.Errorf("\t%s\tShould be able to process the variables : %v", tests.Failed, err)
+					continue
+				}
+				t.Logf("\t%s\tShould be able to process the variables.", tests.Success)
+
+				if !reflect.DeepEqual(cmd.doc, cmd.after) {
+					t.Log(cmd.doc)
+					t.Log(cmd.after)
+					t.Errorf("\t%s\tShould get back the expected document.", tests.Failed)
+					continue
+				}
+				t.Logf("\t%s\tShould get back the expected document.", tests.Success)
+			}
+		}
+	}
+
+	invalid := []map[string]interface{}{
+		{"score": "#float:flag"},
+		{"flagged": "#bool:score"},
+		{"window": "#duration:flag"},
+		{"count": "#numbers:score"},
+		{"name": "#stringify:flag"},
+	}
+
+	t.Logf("Given the need to validate typed values and commands.")
+	{
+		for _, doc := range invalid {
+			t.Logf("\tWhen using %+v", doc)
+			{
+				if err := exec.ProcessVariables("", doc, vars, nil); err == nil {
+					t.Errorf("\t%s\tShould not be able to process the variables.", tests.Failed)
+					continue
+				}
+				t.Logf("\t%s\tShould not be able to process the variables.", tests.Success)
+			}
+		}
+	}
+}
+
+// TestDataLookups tests the #data lookups can index into arrays, fan out with
+// wildcards, use default values and leave out repeated values.
+func TestDataLookups(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	results := map[string]interface{}{
+		"list": []bson.M{
+			{"id": "1", "tags": []interface{}{"news", "sport"}, "comments": []interface{}{bson.M{"user_id": "a"}, bson.M{"user_id": "b"}}},
+			{"id": "2", "tags": []interface{}{"local"}, "score": 3, "comments": []interface{}{bson.M{"user_id": "a"}, bson.M{"name": "c"}}},
+		},
+	}
+
+	commands := []struct {
+		doc   map[string]interface{}
+		after map[string]interface{}
+	}{
+		{map[string]interface{}{"tag": "#data.0:list.tags.1"}, map[string]interface{}{"tag": "sport"}},
+		{map[string]interface{}{"user": "#data.1:list.comments.0.user_id"}, map[string]interface{}{"user": "a"}},
+		{map[string]interface{}{"users": "#data.0:list.comments.*.user_id"}, map[string]interface{}{"users": []interface{}{"a", "b"}}},
+		{map[string]interface{}{"tags": map[string]interface{}{"$in": "#data.*:list.tags.*"}}, map[string]interface{}{"tags": map[string]interface{}{"$in": []interface{}{"news", "sport", "local"}}}},
+		{map[string]interface{}{"score": map[string]interface{}{"$in": "#data.*:list.score|0"}}, map[string]interface{}{"score": map[string]interface{}{"$in": []interface{}{0, 3}}}},
+		{map[string]interface{}{"tag": "#data.1:list.tags.4|none"}, map[string]interface{}{"tag": "none"}},
+		{map[string]interface{}{"user_id": map[string]interface{}{"$in": "#data.*:list.comments.*.user_id|anonymous"}}, map[string]interface{}{"user_id": map[string]interface{}{"$in": []interface{}{"a", "b", "a", "anonymous"}}}},
+		{map[string]interface{}{"user_id": map[string]interface{}{"$in": "#data.distinct:list.comments.*.user_id|anonymous"}}, map[string]interface{}{"user_id": map[string]interface{}{"$in": []interface{}{"a", "b", "anonymous"}}}},
+		{map[string]interface{}{"$or": []interface{}{map[string]interface{}{"tags": map[string]interface{}{"$in": "#data.distinct:list.tags"}}}}, map[string]interface{}{"$or": []interface{}{map[string]interface{}{"tags": map[string]interface{}{"$in": []interface{}{[]interface{}{"news", "sport"}, []interface{}{"local"}}}}}}},
+	}
+
+	t.Logf("Given the need to look up fields in the saved results.")
+	{
+		for _, cmd := range commands {
+			t.Logf("\tWhen using %+v", cmd.doc)
+			{
+				if err := exec.ProcessVariables("", cmd.doc, nil, results); err != nil {
+					t.Errorf("\t%s\tShould be able to process the variables : %v", tests.Failed, err)
+					continue
+				}
+				t.Logf("\t%s\tShould be able to process the variables.", tests.Success)
+
+				if !reflect.DeepEqual(cmd.doc, cmd.after) {
+					t.Log(cmd.doc)
+					t.Log(cmd.after)
+					t.Errorf("\t%s\tShould get back the expected document.", tests.Failed)
+					continue
+				}
+				t.Logf("\t%s\tShould get back the expected document.", tests.Success)
+			}
+		}
+	}
+
+	invalid := []map[string]interface{}{
+		{"score": "#data.0:list.score"},
+		{"tag": "#data.0:list.tags.4"},
+		{"tag": "#data.0:list.tags.first"},
+		{"user_id": map[string]interface{}{"$in": "#data.*:list.comments.*.user_id"}},
+		{"id": "#data.-1:list.id"},
+	}
+
+	t.Logf("Given the need to report missing fields in the saved results.")
+	{
+		for _, doc := range invalid {
+			t.Logf("\tWhen using %+v", doc)
+			{
+				if err := exec.ProcessVariables("", doc, nil, results); err == nil {
+					t.Errorf("\t%s\tShould not be able to process the variables.", tests.Failed)
+					continue
+				}
+				t.Logf("\t%s\tShould not be able to process the variables.", tests.Success)
+			}
+		}
+	}
+}
+
 // compareTime compares two bson maps for equivalence. This is based
 // on a percent of difference since we are dealing with time.
 func compareTime(t1 time.Time, t2 time.Time) bool {
@@ -0,0 +1,76 @@
+package exec
+
+import (
+	"reflect"
+
+	"github.com/coralproject/xenia/internal/query"
+)
+
+// shouldExec reports if the query is executed based on its when condition.
+// A query without a condition is always executed.
+func shouldExec(q *query.Query, vars map[string]string, data map[string]interface{}) bool {
+	if q.When == nil {
+		return true
+	}
+
+	return holds(q.When, vars, data)
+}
+
+// holds evaluates the condition against the variables and the data saved by
+// the earlier queries.
+func holds(c *query.Condition, vars map[string]string, data map[string]interface{}) bool {
+	switch {
+	case c.Var != "":
+		value, exists := vars[c.Var]
+
+		switch {
+		case c.Exists != nil:
+			return exists == *c.Exists
+		case c.Eq != nil:
+			return exists && value == *c.Eq
+		case c.Ne != nil:
+			return !exists || value != *c.Ne
+		default:
+			return exists && inEnum(c.In, value)
+		}
+
+	case c.Saved != "":
+		want := c.Exists == nil || *c.Exists
+		return hasDocs(data[c.Saved]) == want
+
+	case c.Not != nil:
+		return !holds(c.Not, vars, data)
+
+	case c.All != nil:
+		for i := range c.All {
+			if !holds(&c.All[i], vars, data) {
+				return false
+			}
+		}
+		return true
+
+	case c.Any != nil:
+		for i := range c.Any {
+			if holds(&c.Any[i], vars, data) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return false
+}
+
+// hasDocs reports if the saved data holds any documents.
+func hasDocs(saved interface{}) bool {
+	if saved == nil {
+		return false
+	}
+
+	v := reflect.ValueOf(saved)
+	if v.Kind() == reflect.Slice {
+		return v.Len() > 0
+	}
+
+	return true
+}
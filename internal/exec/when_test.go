@@ -0,0 +1,115 @@
+package exec
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestWhen tests the when condition of a query decides if it is executed.
+func TestWhen(t *testing.T) {
+	vars := map[string]string{"mode": "user", "user_id": "123"}
+	data := map[string]interface{}{"users": []bson.M{{"name": "bill"}}, "none": []bson.M{}}
+
+	conds := []struct {
+		when string
+		exp  bool
+	}{
+		{`{"var": "user_id", "exists": true}`, true},
+		{`{"var": "asset_id", "exists": true}`, false},
+		{`{"var": "asset_id", "exists": false}`, true},
+		{`{"var": "mode", "eq": "user"}`, true},
+		{`{"var": "mode", "eq": "asset"}`, false},
+		{`{"var": "mode", "ne": "asset"}`, true},
+		{`{"var": "asset_id", "ne": "asset"}`, true},
+		{`{"var": "mode", "in": ["author", "user"]}`, true},
+		{`{"saved": "users"}`, true},
+		{`{"saved": "none"}`, false},
+		{`{"saved": "missing", "exists": false}`, true},
+		{`{"all": [{"var": "mode", "eq": "user"}, {"saved": "none"}]}`, false},
+		{`{"any": [{"var": "mode", "eq": "asset"}, {"saved": "users"}]}`, true},
+		{`{"not": {"var": "mode", "eq": "user"}}`, false},
+	}
+
+	t.Log("Given the need to execute queries under a condition.")
+	{
+		for _, c := range conds {
+			t.Logf("\tWhen using the condition %s", c.when)
+			{
+				q := query.Query{Name: "When"}
+				if err := json.Unmarshal([]byte(c.when), &q.When); err != nil {
+					t.Fatalf("\t%s\tShould be able to unmarshal the condition : %v", tests.Failed, err)
+				}
+
+				if err := q.When.Validate(); err != nil {
+					t.Fatalf("\t%s\tShould be able to validate the condition : %v", tests.Failed, err)
+				}
+
+				if got := shouldExec(&q, vars, data); got != c.exp {
+					t.Errorf("\t%s\tShould get %v for executing the query : %v", tests.Failed, c.exp, got)
+					continue
+				}
+				t.Logf("\t%s\tShould get %v for executing the query.", tests.Success, c.exp)
+			}
+		}
+
+		invalid := []string{
+			`{}`,
+			`{"var": "mode"}`,
+			`{"var": "mode", "eq": "user", "ne": "asset"}`,
+			`{"var": "mode", "saved": "users", "exists": true}`,
+			`{"saved": "users", "eq": "x"}`,
+			`{"all": []}`,
+			`{"any": [{"var": "mode"}]}`,
+		}
+
+		for _, when := range invalid {
+			t.Logf("\tWhen using the invalid condition %s", when)
+			{
+				var c query.Condition
+				if err := json.Unmarshal([]byte(when), &c); err != nil {
+					t.Fatalf("\t%s\tShould be able to unmarshal the condition : %v", tests.Failed, err)
+				}
+
+				if err := c.Validate(); err == nil {
+					t.Errorf("\t%s\tShould not be able to validate the condition.", tests.Failed)
+					continue
+				}
+				t.Logf("\t%s\tShould not be able to validate the condition.", tests.Success)
+			}
+		}
+
+		t.Log("\tWhen a param with a default is not supplied")
+		{
+			set := query.Set{
+				Name: "When",
+				Params: []query.Param{
+					{Name: "mode", Default: "user"},
+					{Name: "user_id"},
+				},
+			}
+
+			vars := map[string]string{"user_id": "123"}
+			if err := processParams(tests.Context, nil, &set, vars); err != nil {
+				t.Fatalf("\t%s\tShould be able to process the params : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to process the params.", tests.Success)
+
+			for _, when := range []string{`{"var": "mode", "exists": true}`, `{"var": "mode", "eq": "user"}`} {
+				q := query.Query{Name: "When"}
+				if err := json.Unmarshal([]byte(when), &q.When); err != nil {
+					t.Fatalf("\t%s\tShould be able to unmarshal the condition : %v", tests.Failed, err)
+				}
+
+				if !shouldExec(&q, vars, nil) {
+					t.Fatalf("\t%s\tShould see the default with %s.", tests.Failed, when)
+				}
+				t.Logf("\t%s\tShould see the default with %s.", tests.Success, when)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package query_test
+
+import (
+	"testing"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestCacheTTL tests the cache ttl of sets is positive and sets that save to
+// collections can't cache their results.
+func TestCacheTTL(t *testing.T) {
+	save := func(save map[string]interface{}) query.Set {
+		return query.Set{
+			Name:     "CacheTTL",
+			CacheTTL: "1m",
+			Queries: []query.Query{
+				{
+					Name:       "Save",
+					Type:       query.TypePipeline,
+					Collection: "comments",
+					Commands: []map[string]interface{}{
+						{"$match": map[string]interface{}{"status": "ok"}},
+						{"$save": save},
+					},
+				},
+			},
+		}
+	}
+
+	sets := []struct {
+		save  map[string]interface{}
+		valid bool
+	}{
+		{map[string]interface{}{"$map": "comments"}, true},
+		{map[string]interface{}{"$collection": "saved_comments"}, false},
+		{map[string]interface{}{"$collection": "saved_comments", "mode": "append"}, false},
+	}
+
+	t.Log("Given the need to cache the results of sets.")
+	{
+		for _, tt := range sets {
+			t.Logf("\tWhen the set saves with %v", tt.save)
+			{
+				s := save(tt.save)
+				if err := s.Validate(); (err == nil) != tt.valid {
+					t.Fatalf("\t%s\tShould validate the set as valid[%v] : %v", tests.Failed, tt.valid, err)
+				}
+				t.Logf("\t%s\tShould validate the set as valid[%v].", tests.Success, tt.valid)
+			}
+		}
+
+		ttls := []struct {
+			ttl   string
+			valid bool
+		}{
+			{"30s", true},
+			{"0s", false},
+			{"-1m", false},
+			{"soon", false},
+		}
+
+		for _, tt := range ttls {
+			t.Logf("\tWhen the set has a cache_ttl of %q", tt.ttl)
+			{
+				s := save(map[string]interface{}{"$map": "comments"})
+				s.CacheTTL = tt.ttl
+
+				if err := s.Validate(); (err == nil) != tt.valid {
+					t.Fatalf("\t%s\tShould validate the set as valid[%v] : %v", tests.Failed, tt.valid, err)
+				}
+				t.Logf("\t%s\tShould validate the set as valid[%v].", tests.Success, tt.valid)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package query
+
+import "errors"
+
+// Condition decides if a query is executed. A condition tests a variable, the
+// data saved by an earlier query or combines other conditions. Variables are
+// tested after the defaults of the params are applied, so a param with a
+// default always exists. Leave out the default to test if a value was supplied.
+//
+//	{"var": "user_id", "exists": true}
+//	{"var": "mode", "eq": "asset"}
+//	{"var": "mode", "in": ["user", "author"]}
+//	{"saved": "comments"}
+//	{"any": [{"var": "user_id", "exists": true}, {"not": {"saved": "users"}}]}
+type Condition struct {
+	Var    string      `bson:"var,omitempty" json:"var,omitempty"`       // Name of the variable to test.
+	Saved  string      `bson:"saved,omitempty" json:"saved,omitempty"`   // Name a $save {"$map": name} command saved documents under.
+	Exists *bool       `bson:"exists,omitempty" json:"exists,omitempty"` // The variable has a value or the saved data has documents.
+	Eq     *string     `bson:"eq,omitempty" json:"eq,omitempty"`         // The variable is supplied with this value.
+	Ne     *string     `bson:"ne,omitempty" json:"ne,omitempty"`         // The variable is not supplied with this value.
+	In     []string    `bson:"in,omitempty" json:"in,omitempty"`         // The variable is supplied with one of these values.
+	All    []Condition `bson:"all,omitempty" json:"all,omitempty"`       // Every one of the conditions holds.
+	Any    []Condition `bson:"any,omitempty" json:"any,omitempty"`       // At least one of the conditions holds.
+	Not    *Condition  `bson:"not,omitempty" json:"not,omitempty"`       // The condition does not hold.
+}
+
+// Validate checks the condition value for consistency.
+func (c *Condition) Validate() error {
+	var kinds int
+	for _, set := range []bool{c.Var != "", c.Saved != "", c.All != nil, c.Any != nil, c.Not != nil} {
+		if set {
+			kinds++
+		}
+	}
+
+	if kinds != 1 {
+		return errors.New("Condition must have one of var, saved, all, any or not")
+	}
+
+	switch {
+	case c.Var != "":
+		var tests int
+		for _, set := range []bool{c.Exists != nil, c.Eq != nil, c.Ne != nil, c.In != nil} {
+			if set {
+				tests++
+			}
+		}
+
+		if tests != 1 {
+			return errors.New("Condition on a variable must have one of exists, eq, ne or in")
+		}
+
+	case c.Saved != "":
+		if c.Eq != nil || c.Ne != nil || c.In != nil {
+			return errors.New("Condition on saved data only supports exists")
+		}
+
+	case c.Not != nil:
+		return c.Not.Validate()
+
+	default:
+		if len(c.All)+len(c.Any) == 0 {
+			return errors.New("Condition has no conditions to combine")
+		}
+
+		for _, conds := range [][]Condition{c.All, c.Any} {
+			for i := range conds {
+				if err := conds[i].Validate(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// SavedNames adds the names of the saved data the condition tests to names.
+func (c *Condition) SavedNames(names map[string]bool) {
+	if c.Saved != "" {
+		names[c.Saved] = true
+	}
+
+	if c.Not != nil {
+		c.Not.SavedNames(names)
+	}
+
+	for i := range c.All {
+		c.All[i].SavedNames(names)
+	}
+
+	for i := range c.Any {
+		c.Any[i].SavedNames(names)
+	}
+}
@@ -2,6 +2,9 @@ package query
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"gopkg.in/bluesuncorp/validator.v8"
 )
@@ -9,6 +12,38 @@ import (
 // Set of query types we expect to receive.
 const (
 	TypePipeline = "pipeline"
+	TypeFind     = "find"
+	TypeCount    = "count"
+	TypeDistinct = "distinct"
+	TypeSet      = "set"
+)
+
+// findCommands lists the commands each of the non pipeline query types accept.
+// Any of them can also end with a $save command.
+var findCommands = map[string][]string{
+	TypeFind:     {"$match", "$project", "$sort", "$skip", "$limit"},
+	TypeCount:    {"$match", "$skip", "$limit"},
+	TypeDistinct: {"$match", "$distinct"},
+}
+
+// Set of parameter types we expect to receive. A parameter without a type is
+// a string.
+const (
+	ParamString   = "string"
+	ParamInt      = "int"
+	ParamFloat    = "float"
+	ParamBool     = "bool"
+	ParamDate     = "date"
+	ParamObjectID = "objectid"
+	ParamEnum     = "enum"
+	ParamList     = "list"
+	ParamDuration = "duration"
+)
+
+// Set of values reporting if a result came from the cache.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
 )
 
 //==============================================================================
@@ -27,6 +62,9 @@ func init() {
 // can't change this out without breaking the API.
 type Result struct {
 	Results interface{} `json:"results"`
+	Next    string      `json:"next,omitempty"`  // Cursor for the next page of paginated queries.
+	Cache   string      `json:"cache,omitempty"` // CacheHit or CacheMiss when the set caches its results.
+	Err     error       `json:"-"`               // Why the execution failed, Results holds the error for the client.
 }
 
 //==============================================================================
@@ -46,28 +84,64 @@ type Index struct {
 type Query struct {
 	Name        string                   `bson:"name" json:"name" validate:"required,min=3"`                                 // Unique name per query document.
 	Description string                   `bson:"desc,omitempty" json:"desc,omitempty"`                                       // Description of this specific query.
-	Type        string                   `bson:"type" json:"type" validate:"required,min=8"`                                 // TypePipeline, TypeTemplate
+	Type        string                   `bson:"type" json:"type" validate:"required,min=3"`                                 // TypePipeline, TypeFind, TypeCount, TypeDistinct, TypeSet
 	Collection  string                   `bson:"collection,omitempty" json:"collection,omitempty" validate:"required,min=3"` // Name of the collection to use for processing the query.
 	Timeout     string                   `bson:"timeout,omitempty" json:"timeout,omitempty"`                                 // Provides a timeout for the query if it does not return.
 	Commands    []map[string]interface{} `bson:"commands" json:"commands"`                                                   // Commands to process for the query.
 	Indexes     []Index                  `bson:"indexes" json:"indexes"`                                                     // Set of indexes required to optimize the execution of the query.
 	Continue    bool                     `bson:"continue,omitempty" json:"continue,omitempty"`                               // Indicates that on failure to process the next query.
 	Return      bool                     `bson:"return" json:"return"`                                                       // Return the results back to the user with Name as the key.
+	Paginate    bool                     `bson:"paginate,omitempty" json:"paginate,omitempty"`                               // Page through the results using the last $sort and $limit commands.
+	When        *Condition               `bson:"when,omitempty" json:"when,omitempty"`                                       // Only execute the query when the condition holds.
+	Set         string                   `bson:"set,omitempty" json:"set,omitempty"`                                         // Name of the stored set a TypeSet query executes.
+	Vars        map[string]interface{}   `bson:"vars,omitempty" json:"vars,omitempty"`                                       // Variables passed to the set, values can use the variable commands.
+	PreScript   string                   `bson:"pre_script,omitempty" json:"pre_script,omitempty"`                           // Name of a script document to prepend to this query.
+	PstScript   string                   `bson:"pst_script,omitempty" json:"pst_script,omitempty"`                           // Name of a script document to append to this query.
+	Columns     []string                 `bson:"columns,omitempty" json:"columns,omitempty"`                                 // Dot paths of the fields exported as columns, in order.
 }
 
 // Validate checks the query value for consistency.
 func (q *Query) Validate() error {
-	if err := validate.Struct(q); err != nil {
+
+	// Set queries execute a set instead of using a collection.
+	validateStruct := validate.Struct
+	if q.Type == TypeSet {
+		validateStruct = func(v interface{}) error {
+			return validate.StructExcept(v, "Collection")
+		}
+	}
+
+	if err := validateStruct(q); err != nil {
 		return err
 	}
 
+	if q.When != nil {
+		if err := q.When.Validate(); err != nil {
+			return fmt.Errorf("Invalid when for query %q : %v", q.Name, err)
+		}
+	}
+
+	if err := q.validateColumns(); err != nil {
+		return err
+	}
+
+	if q.Type == TypeSet {
+		return q.validateSet()
+	}
+
 	if len(q.Commands) == 0 {
 		return errors.New("No commands exist")
 	}
 
 	switch q.Type {
 	case TypePipeline:
-		// Currently this is the only type we have at the moment.
+
+	case TypeFind, TypeCount, TypeDistinct:
+		if q.Paginate {
+			return errors.New("Pagination is only supported for pipeline queries")
+		}
+
+		return q.validateCommands()
 
 	default:
 		return errors.New("Invalid query type")
@@ -76,40 +150,213 @@ func (q *Query) Validate() error {
 	return nil
 }
 
+// SavesToCollection reports if the query ends with a
+// {"$save": {"$collection": "name"}} command.
+func (q *Query) SavesToCollection() bool {
+	l := len(q.Commands) - 1
+	if l < 0 {
+		return false
+	}
+
+	save, ok := q.Commands[l]["$save"].(map[string]interface{})
+	return ok && save["$collection"] != nil
+}
+
+// validateColumns checks the exported columns are dot paths named once.
+func (q *Query) validateColumns() error {
+	seen := make(map[string]bool)
+	for _, col := range q.Columns {
+		if col == "" || strings.HasPrefix(col, ".") || strings.HasSuffix(col, ".") || strings.Contains(col, "..") {
+			return fmt.Errorf("Invalid column %q for query %q", col, q.Name)
+		}
+
+		if seen[col] {
+			return fmt.Errorf("Column %q is listed more than once for query %q", col, q.Name)
+		}
+		seen[col] = true
+	}
+
+	return nil
+}
+
+// validateSet checks a query executing a set names the set and at most has a
+// $save command.
+func (q *Query) validateSet() error {
+	if q.Set == "" {
+		return fmt.Errorf("Query %q does not name a set to execute", q.Name)
+	}
+
+	if q.Paginate {
+		return errors.New("Pagination is only supported for pipeline queries")
+	}
+
+	switch len(q.Commands) {
+	case 0:
+
+	case 1:
+		if _, exists := q.Commands[0]["$save"]; !exists || len(q.Commands[0]) != 1 {
+			return errors.New("Set queries only support a $save command")
+		}
+
+	default:
+		return errors.New("Set queries only support a $save command")
+	}
+
+	return nil
+}
+
+// validateCommands checks the commands of a find, count or distinct query are
+// the ones its type accepts and each is only used once.
+func (q *Query) validateCommands() error {
+	allowed := make(map[string]bool)
+	for _, cmd := range findCommands[q.Type] {
+		allowed[cmd] = true
+	}
+
+	used := make(map[string]bool)
+	last := len(q.Commands) - 1
+
+	for i, command := range q.Commands {
+		if len(command) != 1 {
+			return fmt.Errorf("Command %d must have a single operation", i)
+		}
+
+		for op := range command {
+			if op == "$save" && i == last {
+				continue
+			}
+
+			// Included scripts are checked once they are expanded.
+			if op == "$include" {
+				continue
+			}
+
+			if !allowed[op] {
+				return fmt.Errorf("Invalid %s command %q", q.Type, op)
+			}
+
+			if used[op] {
+				return fmt.Errorf("Command %q is used more than once", op)
+			}
+			used[op] = true
+		}
+	}
+
+	if q.Type == TypeDistinct && !used["$distinct"] {
+		return errors.New("Missing $distinct command")
+	}
+
+	return nil
+}
+
 //==============================================================================
 
 // Param contains meta-data about a required parameter for the query.
 type Param struct {
-	Name      string `bson:"name" json:"name"`             // Name of the parameter.
-	Desc      string `bson:"desc" json:"desc"`             // Description about the parameter.
-	Default   string `bson:"default" json:"default"`       // Default value for the parameter.
-	RegexName string `bson:"regex_name" json:"regex_name"` // Regular expression name.
+	Name      string   `bson:"name" json:"name"`                     // Name of the parameter.
+	Desc      string   `bson:"desc" json:"desc"`                     // Description about the parameter.
+	Default   string   `bson:"default" json:"default"`               // Default value for the parameter.
+	RegexName string   `bson:"regex_name" json:"regex_name"`         // Regular expression name.
+	Type      string   `bson:"type,omitempty" json:"type,omitempty"` // Type of the value, string if not provided.
+	Min       *float64 `bson:"min,omitempty" json:"min,omitempty"`   // Smallest number, number of list items or seconds of a duration.
+	Max       *float64 `bson:"max,omitempty" json:"max,omitempty"`   // Largest number, number of list items or seconds of a duration.
+	Enum      []string `bson:"enum,omitempty" json:"enum,omitempty"` // Values allowed for an enum or the items of a list.
+}
+
+// Validate checks the param value for consistency.
+func (p *Param) Validate() error {
+	switch p.Type {
+	case "", ParamString, ParamInt, ParamFloat, ParamBool, ParamDate, ParamObjectID, ParamList, ParamDuration:
+
+	case ParamEnum:
+		if len(p.Enum) == 0 {
+			return fmt.Errorf("Param %q is an enum without values", p.Name)
+		}
+
+	default:
+		return fmt.Errorf("Param %q has an invalid type %q", p.Name, p.Type)
+	}
+
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return fmt.Errorf("Param %q has a min larger than its max", p.Name)
+	}
+
+	// The default is used when the variable is missing so it must be a
+	// valid value.
+	if p.Default != "" {
+		if _, err := p.Coerce(p.Default); err != nil {
+			return fmt.Errorf("Param %q has an invalid default %q : %v", p.Name, p.Default, err)
+		}
+	}
+
+	return nil
 }
 
 //==============================================================================
 
 // Set contains the configuration details for a rule set.
 type Set struct {
-	Name        string  `bson:"name" json:"name" validate:"required,min=3"` // Name of the query set.
-	Description string  `bson:"desc" json:"desc"`                           // Description of the query set.
-	PreScript   string  `bson:"pre_script" json:"pre_script"`               // Name of a script document to prepend.
-	PstScript   string  `bson:"pst_script" json:"pst_script"`               // Name of a script document to append.
-	Params      []Param `bson:"params" json:"params"`                       // Collection of parameters.
-	Queries     []Query `bson:"queries" json:"queries"`                     // Collection of queries.
-	Enabled     bool    `bson:"enabled" json:"enabled"`                     // If the query set is enabled to run.
-	Explain     bool    `bson:"explain" json:"explain"`                     // If we want the explain output.
+	Name        string    `bson:"name" json:"name" validate:"required,min=3"`     // Name of the query set.
+	Description string    `bson:"desc" json:"desc"`                               // Description of the query set.
+	PreScript   string    `bson:"pre_script" json:"pre_script"`                   // Name of a script document to prepend.
+	PstScript   string    `bson:"pst_script" json:"pst_script"`                   // Name of a script document to append.
+	Params      []Param   `bson:"params" json:"params"`                           // Collection of parameters.
+	Queries     []Query   `bson:"queries" json:"queries"`                         // Collection of queries.
+	Enabled     bool      `bson:"enabled" json:"enabled"`                         // If the query set is enabled to run.
+	Explain     bool      `bson:"explain" json:"explain"`                         // If we want the explain output.
+	CacheTTL    string    `bson:"cache_ttl,omitempty" json:"cache_ttl,omitempty"` // How long to cache the results, "5m" or "30s". The set can't save to collections.
+	Timeout     string    `bson:"timeout,omitempty" json:"timeout,omitempty"`     // Deadline for executing all the queries, "30s".
+	Schedule    *Schedule `bson:"schedule,omitempty" json:"schedule,omitempty"`   // Executes the set on a schedule storing snapshots of the results.
 }
 
-// Validate checks the set value for consistency.
+// Validate checks the set value for consistency. A set with a cache_ttl can't
+// save to a collection. Saves added by scripts or made by the sets of set
+// queries are checked when the set is executed.
 func (s *Set) Validate() error {
 	if err := validate.Struct(s); err != nil {
 		return err
 	}
 
+	if s.CacheTTL != "" {
+		if ttl, err := time.ParseDuration(s.CacheTTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("Invalid cache_ttl %q", s.CacheTTL)
+		}
+
+		// A cached result is returned without executing the queries, so
+		// the collections they save to would not be updated.
+		for _, q := range s.Queries {
+			if q.SavesToCollection() {
+				return fmt.Errorf("Query %q saves to a collection, the set can't have a cache_ttl", q.Name)
+			}
+		}
+	}
+
+	if s.Timeout != "" {
+		if _, err := time.ParseDuration(s.Timeout); err != nil {
+			return fmt.Errorf("Invalid timeout %q", s.Timeout)
+		}
+	}
+
+	if s.Schedule != nil {
+		if err := s.Schedule.Validate(); err != nil {
+			return fmt.Errorf("Invalid schedule : %v", err)
+		}
+	}
+
+	for _, p := range s.Params {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+
 	for _, q := range s.Queries {
 		if err := q.Validate(); err != nil {
 			return err
 		}
+
+		if q.Type == TypeSet && q.Set == s.Name {
+			return fmt.Errorf("Query %q executes its own set", q.Name)
+		}
 	}
 
 	return nil
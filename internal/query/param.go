@@ -0,0 +1,184 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Coerce checks the value is of the type declared by the parameter and
+// within its constraints. The value is returned in the form the commands
+// expect, the items of a list are returned as a JSON array.
+func (p *Param) Coerce(value string) (string, error) {
+	switch p.Type {
+	case ParamInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", errors.New("Value is not an int")
+		}
+
+		if err := p.checkRange(float64(n)); err != nil {
+			return "", err
+		}
+
+		return strconv.FormatInt(n, 10), nil
+
+	case ParamFloat:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", errors.New("Value is not a float")
+		}
+
+		if err := p.checkRange(f); err != nil {
+			return "", err
+		}
+
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+
+	case ParamBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", errors.New("Value is not a bool")
+		}
+
+		return strconv.FormatBool(b), nil
+
+	case ParamDate:
+		if _, err := ParseDate(value); err != nil {
+			return "", errors.New("Value is not a date")
+		}
+
+		return value, nil
+
+	case ParamObjectID:
+		if !bson.IsObjectIdHex(value) {
+			return "", errors.New("Value is not an objectid")
+		}
+
+		return strings.ToLower(value), nil
+
+	case ParamEnum:
+		if !inEnum(p.Enum, value) {
+			return "", fmt.Errorf("Value is not one of %s", strings.Join(p.Enum, "|"))
+		}
+
+		return value, nil
+
+	case ParamList:
+		items, err := listItems(value)
+		if err != nil {
+			return "", err
+		}
+
+		for _, item := range items {
+			if p.Enum != nil && !inEnum(p.Enum, item) {
+				return "", fmt.Errorf("Item %q is not one of %s", item, strings.Join(p.Enum, "|"))
+			}
+		}
+
+		if err := p.checkRange(float64(len(items))); err != nil {
+			return "", err
+		}
+
+		data, err := json.Marshal(items)
+		if err != nil {
+			return "", err
+		}
+
+		return string(data), nil
+
+	case ParamDuration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return "", errors.New("Value is not a duration")
+		}
+
+		if err := p.checkRange(d.Seconds()); err != nil {
+			return "", err
+		}
+
+		return value, nil
+	}
+
+	return value, nil
+}
+
+// checkRange checks the value is within the min and max of the parameter.
+func (p *Param) checkRange(v float64) error {
+	if p.Min != nil && v < *p.Min {
+		return fmt.Errorf("Value is less than %v", *p.Min)
+	}
+
+	if p.Max != nil && v > *p.Max {
+		return fmt.Errorf("Value is greater than %v", *p.Max)
+	}
+
+	return nil
+}
+
+// ParseDate parses a date written as seconds or milliseconds since the epoch,
+// "2006-01-02", RFC3339 or "2006-01-02T15:04:05.999" in UTC. The date is
+// returned in UTC.
+func ParseDate(value string) (time.Time, error) {
+
+	// Numbers large enough to be past the year 5000 in seconds are taken
+	// to be milliseconds.
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n >= 1e11 || n <= -1e11 {
+			return time.Unix(n/1000, n%1000*int64(time.Millisecond)).UTC(), nil
+		}
+		return time.Unix(n, 0).UTC(), nil
+	}
+
+	layouts := []string{
+		"2006-01-02",
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05.999",
+	}
+
+	for _, layout := range layouts {
+		if dateTime, err := time.Parse(layout, value); err == nil {
+			return dateTime.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid date value %q", value)
+}
+
+// listItems splits the value of a list parameter into its items. The value is
+// either a JSON array of strings or a comma separated list.
+func listItems(value string) ([]string, error) {
+	items := []string{}
+
+	if strings.HasPrefix(value, "[") {
+		if err := json.Unmarshal([]byte(value), &items); err != nil {
+			return nil, errors.New("Value is not a list")
+		}
+
+		return items, nil
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items, nil
+}
+
+// inEnum reports if the value is one of the values of the enum.
+func inEnum(enum []string, value string) bool {
+	for _, v := range enum {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
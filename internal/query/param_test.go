@@ -0,0 +1,63 @@
+package query_test
+
+import (
+	"testing"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestCoerce tests parameter values are checked against their declared
+// type and converted to the form the commands expect.
+func TestCoerce(t *testing.T) {
+	min, max := 1.0, 2.0
+
+	params := []struct {
+		param query.Param
+		value string
+		exp   string
+		valid bool
+	}{
+		{query.Param{Name: "s"}, "abc", "abc", true},
+		{query.Param{Name: "i", Type: query.ParamInt}, "007", "7", true},
+		{query.Param{Name: "i", Type: query.ParamInt}, "7.5", "", false},
+		{query.Param{Name: "i", Type: query.ParamInt, Max: &max}, "3", "", false},
+		{query.Param{Name: "f", Type: query.ParamFloat}, "1.50", "1.5", true},
+		{query.Param{Name: "b", Type: query.ParamBool}, "1", "true", true},
+		{query.Param{Name: "b", Type: query.ParamBool}, "yes", "", false},
+		{query.Param{Name: "d", Type: query.ParamDate}, "2013-01-16", "2013-01-16", true},
+		{query.Param{Name: "d", Type: query.ParamDate}, "2013-01-16T08:00:00Z", "2013-01-16T08:00:00Z", true},
+		{query.Param{Name: "d", Type: query.ParamDate}, "1358323200", "1358323200", true},
+		{query.Param{Name: "d", Type: query.ParamDate}, "2013-1-16", "", false},
+		{query.Param{Name: "o", Type: query.ParamObjectID}, "5660BC6E16908CAE692E0593", "5660bc6e16908cae692e0593", true},
+		{query.Param{Name: "o", Type: query.ParamObjectID}, "5660bc6e", "", false},
+		{query.Param{Name: "e", Type: query.ParamEnum, Enum: []string{"a", "b"}}, "b", "b", true},
+		{query.Param{Name: "e", Type: query.ParamEnum, Enum: []string{"a", "b"}}, "c", "", false},
+		{query.Param{Name: "l", Type: query.ParamList}, "a, b", `["a","b"]`, true},
+		{query.Param{Name: "l", Type: query.ParamList}, `["a","b"]`, `["a","b"]`, true},
+		{query.Param{Name: "l", Type: query.ParamList, Enum: []string{"a"}}, "a,b", "", false},
+		{query.Param{Name: "l", Type: query.ParamList, Min: &min, Max: &min}, "a,b", "", false},
+		{query.Param{Name: "t", Type: query.ParamDuration, Max: &max}, "1500ms", "1500ms", true},
+		{query.Param{Name: "t", Type: query.ParamDuration, Max: &max}, "1m", "", false},
+	}
+
+	t.Log("Given the need to check and convert parameter values.")
+	{
+		for _, p := range params {
+			t.Logf("\tWhen using type %q and value %q", p.param.Type, p.value)
+			{
+				v, err := p.param.Coerce(p.value)
+				if (err == nil) != p.valid {
+					t.Fatalf("\t%s\tShould get back a valid of %v : %v", tests.Failed, p.valid, err)
+				}
+				t.Logf("\t%s\tShould get back a valid of %v.", tests.Success, p.valid)
+
+				if p.valid && v != p.exp {
+					t.Fatalf("\t%s\tShould get back %q : %q", tests.Failed, p.exp, v)
+				}
+				t.Logf("\t%s\tShould get back %q.", tests.Success, p.exp)
+			}
+		}
+	}
+}
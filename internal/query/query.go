@@ -132,6 +132,7 @@ func Upsert(context interface{}, db *db.DB, set *Set) error {
 
 	// Flush the cache to invalidate everything.
 	cache.Flush()
+	flushResults(set.Name)
 
 	// Add a history record if this query set is new.
 	if new {
@@ -376,6 +377,7 @@ func Delete(context interface{}, db *db.DB, name string) error {
 	}
 
 	cache.Flush()
+	flushResults(set.Name)
 
 	log.Dev(context, "Delete", "Completed")
 	return nil
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/coralproject/xenia/internal/query"
 	"github.com/coralproject/xenia/internal/query/qfix"
@@ -411,6 +412,68 @@ func TestDeleteSet(t *testing.T) {
 	}
 }
 
+// TestCachedResults validates cached results are flushed when the set changes.
+func TestCachedResults(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	const fixture = "basic.json"
+	set1, err := qfix.Get(fixture)
+	if err != nil {
+		t.Fatalf("\t%s\tShould load query record from file : %v", tests.Failed, err)
+	}
+	t.Logf("\t%s\tShould load query record from file.", tests.Success)
+
+	db, err := db.NewMGO(tests.Context, tests.TestSession)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	defer func() {
+		if err := qfix.Remove(db, prefix); err != nil {
+			t.Fatalf("\t%s\tShould be able to remove the query set : %v", tests.Failed, err)
+		}
+		t.Logf("\t%s\tShould be able to remove the query set.", tests.Success)
+	}()
+
+	t.Log("Given the need to invalidate cached results for a query set.")
+	{
+		t.Log("\tWhen using fixture", fixture)
+		{
+			result := query.Result{Results: []string{"cached"}}
+
+			query.CacheResult(set1.Name, "key", &result, time.Minute)
+			if _, found := query.CachedResult(set1.Name, "key"); !found {
+				t.Fatalf("\t%s\tShould be able to retrieve the cached result.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould be able to retrieve the cached result.", tests.Success)
+
+			if err := query.Upsert(tests.Context, db, set1); err != nil {
+				t.Fatalf("\t%s\tShould be able to create a query set : %s", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to create a query set.", tests.Success)
+
+			if _, found := query.CachedResult(set1.Name, "key"); found {
+				t.Fatalf("\t%s\tShould not find the cached result after an upsert.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not find the cached result after an upsert.", tests.Success)
+
+			query.CacheResult(set1.Name, "key", &result, time.Minute)
+
+			if err := query.Delete(tests.Context, db, set1.Name); err != nil {
+				t.Fatalf("\t%s\tShould be able to delete the query set : %s", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to delete the query set.", tests.Success)
+
+			if _, found := query.CachedResult(set1.Name, "key"); found {
+				t.Fatalf("\t%s\tShould not find the cached result after a delete.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not find the cached result after a delete.", tests.Success)
+		}
+	}
+}
+
 // TestUnknownName validates the behaviour of the query API when using a invalid/
 // unknown query name.
 func TestUnknownName(t *testing.T) {
@@ -0,0 +1,47 @@
+package query
+
+import (
+	"strings"
+	"time"
+
+	gc "github.com/patrickmn/go-cache"
+)
+
+// results contains a cache of the results of executed sets. Each result
+// expires based on the cache_ttl of the set that produced it. Results are
+// flushed for a set when it is upserted or deleted.
+var results = gc.New(gc.NoExpiration, cleanup)
+
+// =============================================================================
+
+// CacheResult stores the result of executing the named set under the key for
+// the specified amount of time.
+func CacheResult(name string, key string, result *Result, ttl time.Duration) {
+	results.Set(resultKey(name, key), *result, ttl)
+}
+
+// CachedResult retrieves the result stored for the named set under the key.
+func CachedResult(name string, key string) (*Result, bool) {
+	v, found := results.Get(resultKey(name, key))
+	if !found {
+		return nil, false
+	}
+
+	result := v.(Result)
+	return &result, true
+}
+
+// flushResults removes all the cached results for the named set.
+func flushResults(name string) {
+	prefix := resultKey(name, "")
+	for k := range results.Items() {
+		if strings.HasPrefix(k, prefix) {
+			results.Delete(k)
+		}
+	}
+}
+
+// resultKey builds the key for the cached result of the named set.
+func resultKey(name string, key string) string {
+	return name + ":" + key
+}
@@ -0,0 +1,232 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultKeep is the number of snapshots kept for a scheduled set that does
+// not say how many to keep.
+const DefaultKeep = 30
+
+// cronMacros are the schedules that can be named instead of written out.
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// cronFields are the fields of a cron schedule with the values they take.
+// Sunday can be written as 0 or 7 in the day of week field.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+//==============================================================================
+
+// Schedule executes a set on a cron schedule with fixed variables. The
+// results of each execution are stored as a snapshot.
+type Schedule struct {
+	Cron   string            `bson:"cron" json:"cron" validate:"required"`       // "minute hour day-of-month month day-of-week" in UTC or @hourly, @daily, @weekly, @monthly.
+	Vars   map[string]string `bson:"vars,omitempty" json:"vars,omitempty"`       // Variables to execute the set with.
+	Keep   int               `bson:"keep,omitempty" json:"keep,omitempty"`       // Number of snapshots to keep, DefaultKeep when not set.
+	MaxAge string            `bson:"max_age,omitempty" json:"max_age,omitempty"` // Snapshots older than this are removed, "720h".
+}
+
+// Validate checks the schedule value for consistency.
+func (s *Schedule) Validate() error {
+	if err := validate.Struct(s); err != nil {
+		return err
+	}
+
+	if err := ValidateCron(s.Cron); err != nil {
+		return err
+	}
+
+	if s.Keep < 0 {
+		return fmt.Errorf("Invalid keep %d", s.Keep)
+	}
+
+	if s.MaxAge != "" {
+		if d, err := time.ParseDuration(s.MaxAge); err != nil || d <= 0 {
+			return fmt.Errorf("Invalid max_age %q", s.MaxAge)
+		}
+	}
+
+	return nil
+}
+
+// Matches reports if the set is scheduled to execute in the minute of the
+// specified time.
+func (s *Schedule) Matches(t time.Time) bool {
+	return CronMatches(s.Cron, t)
+}
+
+// Retention returns the number of snapshots to keep and how old they can get.
+// A zero age means snapshots are only removed by number.
+func (s *Schedule) Retention() (int, time.Duration) {
+	keep := s.Keep
+	if keep == 0 {
+		keep = DefaultKeep
+	}
+
+	// The age was checked when the schedule was validated.
+	age, _ := time.ParseDuration(s.MaxAge)
+
+	return keep, age
+}
+
+//==============================================================================
+
+// ValidateCron checks the cron schedule can be parsed.
+func ValidateCron(spec string) error {
+	_, err := parseCron(spec)
+	return err
+}
+
+// CronMatches reports if the minute of the specified time is in the cron
+// schedule. An invalid schedule matches no time.
+func CronMatches(spec string, t time.Time) bool {
+	cs, err := parseCron(spec)
+	if err != nil {
+		return false
+	}
+
+	return cs.matches(t)
+}
+
+//==============================================================================
+
+// cronSpec holds the values each field of a cron schedule matches as bits.
+type cronSpec struct {
+	fields  [5]uint64
+	domStar bool // The day of month field is "*".
+	dowStar bool // The day of week field is "*".
+}
+
+// parseCron parses the five fields of a cron schedule or one of the macros.
+func parseCron(spec string) (cronSpec, error) {
+	var cs cronSpec
+
+	if macro, exists := cronMacros[spec]; exists {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return cs, fmt.Errorf("Invalid cron %q, it needs %d fields", spec, len(cronFields))
+	}
+
+	for i, field := range fields {
+		bits, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return cs, fmt.Errorf("Invalid cron %q, %s field : %v", spec, cronFields[i].name, err)
+		}
+		cs.fields[i] = bits
+	}
+
+	// Sunday is day 0.
+	if cs.fields[4]&(1<<7) != 0 {
+		cs.fields[4] |= 1
+	}
+
+	cs.domStar = fields[2] == "*"
+	cs.dowStar = fields[4] == "*"
+
+	return cs, nil
+}
+
+// parseCronField parses a list of values, ranges and steps like "1,5-10,*/15"
+// into the bits of the values it matches.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("Invalid step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+
+		var lo, hi int
+		switch i := strings.IndexByte(part, '-'); {
+		case part == "*":
+			lo, hi = min, max
+
+		case i != -1:
+			var err error
+			if lo, err = strconv.Atoi(part[:i]); err != nil {
+				return 0, fmt.Errorf("Invalid value in %q", part)
+			}
+			if hi, err = strconv.Atoi(part[i+1:]); err != nil {
+				return 0, fmt.Errorf("Invalid value in %q", part)
+			}
+
+		default:
+			var err error
+			if lo, err = strconv.Atoi(part); err != nil {
+				return 0, fmt.Errorf("Invalid value %q", part)
+			}
+
+			// A single value with a step runs to the last value.
+			hi = lo
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("Value %q is outside %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	if bits == 0 {
+		return 0, errors.New("No values")
+	}
+
+	return bits, nil
+}
+
+// matches reports if the minute of the time in UTC is in the schedule. Like
+// cron, when both day fields are restricted either of them can match.
+func (cs cronSpec) matches(t time.Time) bool {
+	t = t.UTC()
+
+	has := func(field int, v int) bool {
+		return cs.fields[field]&(1<<uint(v)) != 0
+	}
+
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+
+	dom := has(2, t.Day())
+	dow := has(4, int(t.Weekday()))
+
+	if cs.domStar || cs.dowStar {
+		return dom && dow
+	}
+
+	return dom || dow
+}
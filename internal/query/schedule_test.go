@@ -0,0 +1,66 @@
+package query_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestSchedule tests cron schedules are validated and matched against times.
+func TestSchedule(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	at := func(s string) time.Time {
+		tm, _ := time.Parse(time.RFC3339, s)
+		return tm
+	}
+
+	// 2016-06-01 is a Wednesday.
+	schedules := []struct {
+		cron    string
+		valid   bool
+		match   []time.Time
+		nomatch []time.Time
+	}{
+		{"@daily", true, []time.Time{at("2016-06-01T00:00:00Z")}, []time.Time{at("2016-06-01T00:01:00Z")}},
+		{"*/15 9-17 * * 1-5", true, []time.Time{at("2016-06-01T09:45:00Z")}, []time.Time{at("2016-06-01T09:50:00Z"), at("2016-06-04T09:45:00Z")}},
+		{"30 6 1 * 7", true, []time.Time{at("2016-06-01T06:30:00Z"), at("2016-06-05T06:30:00Z")}, []time.Time{at("2016-06-02T06:30:00Z")}},
+		{"0 0 * *", false, nil, nil},
+		{"60 * * * *", false, nil, nil},
+		{"5-1 * * * *", false, nil, nil},
+		{"*/0 * * * *", false, nil, nil},
+	}
+
+	t.Log("Given the need to execute sets on a schedule.")
+	{
+		for _, sc := range schedules {
+			t.Logf("\tWhen using the cron %q", sc.cron)
+			{
+				s := query.Schedule{Cron: sc.cron}
+
+				if err := s.Validate(); (err == nil) != sc.valid {
+					t.Fatalf("\t%s\tShould be valid[%v] : %v", tests.Failed, sc.valid, err)
+				}
+				t.Logf("\t%s\tShould be valid[%v].", tests.Success, sc.valid)
+
+				for _, tm := range sc.match {
+					if !s.Matches(tm) {
+						t.Fatalf("\t%s\tShould match %v.", tests.Failed, tm)
+					}
+					t.Logf("\t%s\tShould match %v.", tests.Success, tm)
+				}
+
+				for _, tm := range sc.nomatch {
+					if s.Matches(tm) {
+						t.Fatalf("\t%s\tShould not match %v.", tests.Failed, tm)
+					}
+					t.Logf("\t%s\tShould not match %v.", tests.Success, tm)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package query
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Schema is a JSON Schema describing the parameters of a set.
+type Schema struct {
+	Schema      string                     `json:"$schema"`
+	Title       string                     `json:"title"`
+	Description string                     `json:"description,omitempty"`
+	Type        string                     `json:"type"`
+	Properties  map[string]*SchemaProperty `json:"properties"`
+	Required    []string                   `json:"required,omitempty"`
+}
+
+// SchemaProperty describes a single parameter of a set.
+type SchemaProperty struct {
+	Type        string          `json:"type"`
+	Description string          `json:"description,omitempty"`
+	Default     interface{}     `json:"default,omitempty"`
+	Enum        []string        `json:"enum,omitempty"`
+	Pattern     string          `json:"pattern,omitempty"`
+	Minimum     *float64        `json:"minimum,omitempty"`
+	Maximum     *float64        `json:"maximum,omitempty"`
+	MinItems    *int            `json:"minItems,omitempty"`
+	MaxItems    *int            `json:"maxItems,omitempty"`
+	Items       *SchemaProperty `json:"items,omitempty"`
+	RegexName   string          `json:"x-regex-name,omitempty"`
+}
+
+// Patterns of the values of parameters whose forms JSON Schema has no format
+// for. Dates are seconds or milliseconds since the epoch, "2006-01-02" or
+// RFC3339 with an optional offset. Durations are Go durations like "1h30m".
+const (
+	objectIDPattern = "^[0-9a-fA-F]{24}$"
+	datePattern     = `^(-?[0-9]+|[0-9]{4}-[0-9]{2}-[0-9]{2}(T[0-9]{2}:[0-9]{2}:[0-9]{2}(\.[0-9]+)?(Z|[+-][0-9]{2}:[0-9]{2})?)?)$`
+	durationPattern = `^[-+]?(0|([0-9]*(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`
+)
+
+//==============================================================================
+
+// ParamSchema returns a JSON Schema describing the parameters of the set. The
+// parameters without a default value are required.
+func (s *Set) ParamSchema() *Schema {
+	sch := Schema{
+		Schema:      "http://json-schema.org/draft-04/schema#",
+		Title:       s.Name,
+		Description: s.Description,
+		Type:        "object",
+		Properties:  make(map[string]*SchemaProperty),
+	}
+
+	for _, p := range s.Params {
+		sch.Properties[p.Name] = p.schema()
+
+		if p.Default == "" {
+			sch.Required = append(sch.Required, p.Name)
+		}
+	}
+
+	return &sch
+}
+
+// schema returns the schema property describing the parameter.
+func (p *Param) schema() *SchemaProperty {
+	prop := SchemaProperty{
+		Type:        "string",
+		Description: p.Desc,
+		RegexName:   p.RegexName,
+	}
+
+	switch p.Type {
+	case ParamInt:
+		prop.Type = "integer"
+		prop.Minimum, prop.Maximum = p.Min, p.Max
+
+	case ParamFloat:
+		prop.Type = "number"
+		prop.Minimum, prop.Maximum = p.Min, p.Max
+
+	case ParamBool:
+		prop.Type = "boolean"
+
+	case ParamDate:
+		prop.Pattern = datePattern
+
+	case ParamObjectID:
+		prop.Pattern = objectIDPattern
+
+	case ParamEnum:
+		prop.Enum = p.Enum
+
+	case ParamList:
+		prop.Type = "array"
+		prop.Items = &SchemaProperty{Type: "string", Enum: p.Enum}
+		prop.MinItems, prop.MaxItems = count(p.Min), count(p.Max)
+
+	case ParamDuration:
+		prop.Pattern = durationPattern
+	}
+
+	if p.Default != "" {
+		prop.Default = p.defaultValue()
+	}
+
+	return &prop
+}
+
+// defaultValue returns the default value of the parameter as its type. The
+// default is returned as is if it can't be converted.
+func (p *Param) defaultValue() interface{} {
+	switch p.Type {
+	case ParamInt:
+		if n, err := strconv.ParseInt(p.Default, 10, 64); err == nil {
+			return n
+		}
+
+	case ParamFloat:
+		if f, err := strconv.ParseFloat(p.Default, 64); err == nil {
+			return f
+		}
+
+	case ParamBool:
+		if b, err := strconv.ParseBool(p.Default); err == nil {
+			return b
+		}
+
+	case ParamList:
+		var items []string
+		if err := json.Unmarshal([]byte(p.Default), &items); err == nil {
+			return items
+		}
+
+		items = nil
+		for _, item := range strings.Split(p.Default, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+
+	return p.Default
+}
+
+// count converts a min or max into a number of items.
+func count(v *float64) *int {
+	if v == nil {
+		return nil
+	}
+
+	n := int(*v)
+	return &n
+}
@@ -0,0 +1,99 @@
+package query_test
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/coralproject/xenia/internal/query"
+
+	"github.com/ardanlabs/kit/tests"
+)
+
+// TestParamSchema tests the JSON Schema describing the parameters of a set.
+func TestParamSchema(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	max := 100.0
+
+	set := query.Set{
+		Name: "QTEST_O_schema",
+		Params: []query.Param{
+			{Name: "limit", Desc: "Number of stations", Type: query.ParamInt, Default: "25", Max: &max},
+			{Name: "kind", Type: query.ParamEnum, Enum: []string{"buoy", "station"}},
+			{Name: "ids", Type: query.ParamList},
+		},
+	}
+
+	exp := `{"$schema":"http://json-schema.org/draft-04/schema#","title":"QTEST_O_schema","type":"object","properties":{"ids":{"type":"array","items":{"type":"string"}},"kind":{"type":"string","enum":["buoy","station"]},"limit":{"type":"integer","description":"Number of stations","default":25,"maximum":100}},"required":["kind","ids"]}`
+
+	t.Log("Given the need to describe the parameters of a set.")
+	{
+		t.Log("\tWhen using a set with typed parameters")
+		{
+			if err := set.Validate(); err != nil {
+				t.Fatalf("\t%s\tShould be able to validate the set : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to validate the set.", tests.Success)
+
+			data, err := json.Marshal(set.ParamSchema())
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to marshal the schema : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to marshal the schema.", tests.Success)
+
+			if string(data) != exp {
+				t.Log(exp)
+				t.Log(string(data))
+				t.Fatalf("\t%s\tShould get back the expected schema.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould get back the expected schema.", tests.Success)
+		}
+
+		t.Log("\tWhen using date and duration parameters")
+		{
+			values := []struct {
+				param query.Param
+				value string
+			}{
+				{query.Param{Name: "from", Type: query.ParamDate}, "2016-06-01"},
+				{query.Param{Name: "from", Type: query.ParamDate}, "2016-06-01T08:00:00.5-04:00"},
+				{query.Param{Name: "from", Type: query.ParamDate}, "1464768000"},
+				{query.Param{Name: "from", Type: query.ParamDate}, "2016-06-01T08:00"},
+				{query.Param{Name: "since", Type: query.ParamDuration}, "1h30m"},
+				{query.Param{Name: "since", Type: query.ParamDuration}, "1.5s"},
+				{query.Param{Name: "since", Type: query.ParamDuration}, "P1D"},
+			}
+
+			for _, v := range values {
+				set.Params = []query.Param{v.param}
+				prop := set.ParamSchema().Properties[v.param.Name]
+
+				_, err := v.param.Coerce(v.value)
+				if matched := regexp.MustCompile(prop.Pattern).MatchString(v.value); matched != (err == nil) {
+					t.Fatalf("\t%s\tShould match %q only when the value is valid : %v", tests.Failed, v.value, err)
+				}
+				t.Logf("\t%s\tShould match %q only when the value is valid.", tests.Success, v.value)
+			}
+		}
+
+		t.Log("\tWhen using a default of the wrong type")
+		{
+			set.Params = []query.Param{{Name: "limit", Type: query.ParamInt, Default: "ten"}}
+			if err := set.Validate(); err == nil {
+				t.Fatalf("\t%s\tShould not be able to validate the set.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not be able to validate the set.", tests.Success)
+		}
+
+		t.Log("\tWhen using an enum without values")
+		{
+			set.Params = []query.Param{{Name: "kind", Type: query.ParamEnum}}
+			if err := set.Validate(); err == nil {
+				t.Fatalf("\t%s\tShould not be able to validate the set.", tests.Failed)
+			}
+			t.Logf("\t%s\tShould not be able to validate the set.", tests.Success)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Package scheduler executes the sets that have a schedule and stores their
+// results as snapshots. It also evaluates the alert rules on their schedule.
+package scheduler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coralproject/xenia/internal/alert"
+	"github.com/coralproject/xenia/internal/exec"
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/internal/snapshot"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/log"
+)
+
+// context is used for the logging of the scheduler.
+const context = "scheduler"
+
+// Scheduler checks every minute for the sets scheduled to execute and the
+// alert rules to evaluate.
+type Scheduler struct {
+	session  string // Name of the master session to copy.
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New creates a scheduler that uses copies of the named master session.
+func New(session string) *Scheduler {
+	return &Scheduler{
+		session:  session,
+		shutdown: make(chan struct{}),
+	}
+}
+
+//==============================================================================
+
+// Start starts checking for the sets to execute in the background.
+func (s *Scheduler) Start() {
+	log.Dev(context, "Start", "Started : Session[%s]", s.session)
+
+	s.wg.Add(1)
+	go s.run()
+
+	log.Dev(context, "Start", "Completed")
+}
+
+// Stop stops checking for sets to execute and waits for the sets executing
+// to finish.
+func (s *Scheduler) Stop() {
+	log.Dev(context, "Stop", "Started")
+
+	close(s.shutdown)
+	s.wg.Wait()
+
+	log.Dev(context, "Stop", "Completed")
+}
+
+// run checks for the sets to execute at the start of every minute.
+func (s *Scheduler) run() {
+	defer s.wg.Done()
+
+	last := time.Now().UTC().Truncate(time.Minute)
+
+	for {
+		timer := time.NewTimer(last.Add(time.Minute).Sub(time.Now()))
+
+		select {
+		case <-s.shutdown:
+			timer.Stop()
+			return
+
+		case <-timer.C:
+		}
+
+		// The timer can fire late so check every minute that has passed.
+		now := time.Now().UTC().Truncate(time.Minute)
+		for t := last.Add(time.Minute); !t.After(now); t = t.Add(time.Minute) {
+			s.check(t)
+		}
+
+		if now.After(last) {
+			last = now
+		}
+	}
+}
+
+// check executes the enabled sets and evaluates the enabled alert rules
+// scheduled for the minute.
+func (s *Scheduler) check(t time.Time) {
+	db, err := db.NewMGO(context, s.session)
+	if err != nil {
+		log.Error(context, "check", err, "Getting Mongo session")
+		return
+	}
+	defer db.CloseMGO(context)
+
+	sets, err := query.GetAll(context, db, nil)
+	if err != nil && err != query.ErrNotFound {
+		log.Error(context, "check", err, "Loading sets")
+	}
+
+	for _, set := range sets {
+		if !set.Enabled || set.Schedule == nil || !set.Schedule.Matches(t) {
+			continue
+		}
+
+		s.wg.Add(1)
+		go func(set query.Set) {
+			defer s.wg.Done()
+			s.exec(&set, t)
+		}(set)
+	}
+
+	rules, err := alert.GetAll(context, db)
+	if err != nil && err != alert.ErrNotFound {
+		log.Error(context, "check", err, "Loading alert rules")
+	}
+
+	for _, rule := range rules {
+		if !rule.Enabled || !query.CronMatches(rule.Cron, t) {
+			continue
+		}
+
+		s.wg.Add(1)
+		go func(rule alert.Rule) {
+			defer s.wg.Done()
+			s.alert(&rule, t)
+		}(rule)
+	}
+}
+
+// exec executes the set with a session of its own.
+func (s *Scheduler) exec(set *query.Set, t time.Time) {
+	db, err := db.NewMGO(context, s.session)
+	if err != nil {
+		log.Error(context, "exec", err, "Getting Mongo session")
+		return
+	}
+	defer db.CloseMGO(context)
+
+	// The errors have been logged and are kept in the snapshot.
+	Run(context, db, set, t)
+}
+
+// alert evaluates the rule with a session of its own.
+func (s *Scheduler) alert(rule *alert.Rule, t time.Time) {
+	db, err := db.NewMGO(context, s.session)
+	if err != nil {
+		log.Error(context, "alert", err, "Getting Mongo session")
+		return
+	}
+	defer db.CloseMGO(context)
+
+	// The errors have been logged and the deliveries are kept in the log.
+	alert.Check(context, db, rule, t, s.shutdown)
+}
+
+//==============================================================================
+
+// Run executes the set scheduled for the minute with the variables of its
+// schedule and stores the results as a snapshot. Then the snapshots past the
+// retention of the schedule are removed. snapshot.ErrClaimed is returned when
+// the set has already been executed for the minute.
+func Run(context interface{}, db *db.DB, set *query.Set, scheduled time.Time) (*snapshot.Snapshot, error) {
+	log.Dev(context, "Run", "Started : Name[%s] Scheduled[%v]", set.Name, scheduled)
+
+	snap, err := snapshot.Claim(context, db, set.Name, scheduled, set.Schedule.Vars)
+	if err != nil {
+		log.Error(context, "Run", err, "Completed : Claiming snapshot")
+		return nil, err
+	}
+
+	// Executing the set adds the default values to the variables.
+	vars := make(map[string]string, len(set.Schedule.Vars))
+	for k, v := range set.Schedule.Vars {
+		vars[k] = v
+	}
+
+	// Snapshots always execute the set rather than store a cached result.
+	result := exec.ExecFresh(context, db, set, vars)
+
+	snap.Ended = time.Now().UTC()
+	snap.Duration = int64(snap.Ended.Sub(snap.Started) / time.Millisecond)
+	snap.Status = snapshot.StatusDone
+	snap.Results = result.Results
+
+	if result.Err != nil {
+		snap.Status = snapshot.StatusFailed
+		snap.Results = nil
+		snap.Error = result.Err.Error()
+	}
+
+	if err := snapshot.Complete(context, db, snap); err != nil {
+
+		// The results may be too big or have fields Mongo can't store,
+		// so at least record the execution failed.
+		snap.Status = snapshot.StatusFailed
+		snap.Results = nil
+		snap.Error = "Storing results : " + err.Error()
+
+		if err := snapshot.Complete(context, db, snap); err != nil {
+			log.Error(context, "Run", err, "Completed : Completing snapshot")
+			return snap, err
+		}
+	}
+
+	keep, age := set.Schedule.Retention()
+	if err := snapshot.Prune(context, db, set.Name, keep, age); err != nil {
+		log.Error(context, "Run", err, "Completed : Pruning snapshots")
+		return snap, err
+	}
+
+	log.Dev(context, "Run", "Completed : Status[%s] Duration[%dms]", snap.Status, snap.Duration)
+	return snap, nil
+}
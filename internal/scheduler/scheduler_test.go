@@ -0,0 +1,136 @@
+package scheduler_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coralproject/xenia/internal/query"
+	"github.com/coralproject/xenia/internal/scheduler"
+	"github.com/coralproject/xenia/internal/snapshot"
+	"github.com/coralproject/xenia/tstdata"
+
+	"github.com/ardanlabs/kit/cfg"
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/db/mongo"
+	"github.com/ardanlabs/kit/tests"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	// Initialize the configuration and logging systems. Plus anything
+	// else the web app layer needs.
+	tests.Init("XENIA")
+
+	// Initialize MongoDB using the `tests.TestSession` as the name of the
+	// master session.
+	cfg := mongo.Config{
+		Host:     cfg.MustString("MONGO_HOST"),
+		AuthDB:   cfg.MustString("MONGO_AUTHDB"),
+		DB:       cfg.MustString("MONGO_DB"),
+		User:     cfg.MustString("MONGO_USER"),
+		Password: cfg.MustString("MONGO_PASS"),
+	}
+	tests.InitMongo(cfg)
+}
+
+//==============================================================================
+
+// TestRun tests a scheduled set is executed once per minute and its snapshots
+// are kept within the retention of the schedule.
+func TestRun(t *testing.T) {
+	tests.ResetLog()
+	defer tests.DisplayLog()
+
+	db, err := db.NewMGO(tests.Context, tests.TestSession)
+	if err != nil {
+		t.Fatalf("\t%s\tShould be able to get a Mongo session : %v", tests.Failed, err)
+	}
+	defer db.CloseMGO(tests.Context)
+
+	if err := tstdata.Generate(db); err != nil {
+		t.Fatalf("\t%s\tShould be able to load the test data : %v", tests.Failed, err)
+	}
+	defer tstdata.Drop(db)
+
+	set := query.Set{
+		Name:    "QTEST_O_scheduled",
+		Enabled: true,
+		Params:  []query.Param{{Name: "station_id"}},
+		Queries: []query.Query{
+			{
+				Name:       "Station",
+				Type:       query.TypePipeline,
+				Collection: tstdata.CollectionExecTest,
+				Return:     true,
+				Commands: []map[string]interface{}{
+					{"$match": map[string]interface{}{"station_id": "#string:station_id"}},
+					{"$project": map[string]interface{}{"_id": 0, "name": 1}},
+				},
+			},
+		},
+		Schedule: &query.Schedule{
+			Cron: "@hourly",
+			Vars: map[string]string{"station_id": "42021"},
+			Keep: 2,
+		},
+	}
+
+	defer func() {
+		f := func(c *mgo.Collection) error {
+			_, err := c.RemoveAll(bson.M{"set": set.Name})
+			return err
+		}
+
+		if err := db.ExecuteMGO(tests.Context, snapshot.Collection, f); err != nil {
+			t.Fatalf("\t%s\tShould be able to remove the snapshots : %v", tests.Failed, err)
+		}
+	}()
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+
+	t.Log("Given the need to execute a set on a schedule.")
+	{
+		t.Log("\tWhen executing the set for three hours")
+		{
+			for i := 0; i < 3; i++ {
+				run := set
+				snap, err := scheduler.Run(tests.Context, db, &run, hour.Add(time.Duration(i)*time.Hour))
+				if err != nil {
+					t.Fatalf("\t%s\tShould be able to execute the set : %v", tests.Failed, err)
+				}
+
+				if snap.Status != snapshot.StatusDone {
+					t.Fatalf("\t%s\tShould complete the snapshot : %s %s", tests.Failed, snap.Status, snap.Error)
+				}
+			}
+			t.Logf("\t%s\tShould be able to execute the set.", tests.Success)
+
+			snaps, err := snapshot.List(tests.Context, db, set.Name)
+			if err != nil || len(snaps) != 2 {
+				t.Fatalf("\t%s\tShould keep two snapshots : %d %v", tests.Failed, len(snaps), err)
+			}
+			t.Logf("\t%s\tShould keep two snapshots.", tests.Success)
+
+			latest, err := snapshot.Latest(tests.Context, db, set.Name)
+			if err != nil {
+				t.Fatalf("\t%s\tShould be able to get the latest snapshot : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould be able to get the latest snapshot.", tests.Success)
+
+			if !latest.Scheduled.Equal(hour.Add(2*time.Hour)) || latest.Results == nil {
+				t.Fatalf("\t%s\tShould get the results of the last hour : %v", tests.Failed, latest.Scheduled)
+			}
+			t.Logf("\t%s\tShould get the results of the last hour.", tests.Success)
+		}
+
+		t.Log("\tWhen executing the set again for the same hour")
+		{
+			run := set
+			if _, err := scheduler.Run(tests.Context, db, &run, hour.Add(2*time.Hour)); err != snapshot.ErrClaimed {
+				t.Fatalf("\t%s\tShould find the snapshot already claimed : %v", tests.Failed, err)
+			}
+			t.Logf("\t%s\tShould find the snapshot already claimed.", tests.Success)
+		}
+	}
+}
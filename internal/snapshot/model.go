@@ -0,0 +1,28 @@
+package snapshot
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Set of snapshot statuses.
+const (
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// Snapshot contains the results of a scheduled execution of a set.
+type Snapshot struct {
+	ID        bson.ObjectId     `bson:"_id" json:"id"`
+	Set       string            `bson:"set" json:"set"`                             // Name of the set executed.
+	Scheduled time.Time         `bson:"scheduled" json:"scheduled"`                 // Minute the execution was scheduled for.
+	Started   time.Time         `bson:"started" json:"started"`                     // When the execution started.
+	Ended     time.Time         `bson:"ended" json:"ended"`                         // When the execution ended.
+	Duration  int64             `bson:"duration_ms" json:"duration_ms"`             // Milliseconds the execution took.
+	Status    string            `bson:"status" json:"status"`                       // StatusRunning, StatusDone or StatusFailed.
+	Vars      map[string]string `bson:"vars,omitempty" json:"vars,omitempty"`       // Variables the set was executed with.
+	Results   interface{}       `bson:"results,omitempty" json:"results,omitempty"` // Results of the queries the set returns.
+	Error     string            `bson:"error,omitempty" json:"error,omitempty"`     // Why the execution failed.
+}
@@ -0,0 +1,236 @@
+// Package snapshot stores the results of the scheduled executions of sets.
+package snapshot
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ardanlabs/kit/db"
+	"github.com/ardanlabs/kit/db/mongo"
+	"github.com/ardanlabs/kit/log"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Contains the name of Mongo collections.
+const (
+	Collection = "query_snapshots"
+)
+
+// Set of error variables.
+var (
+	ErrNotFound  = errors.New("Snapshot Not found")
+	ErrInvalidID = errors.New("Snapshot ID is not valid")
+	ErrClaimed   = errors.New("Snapshot already claimed")
+)
+
+// =============================================================================
+
+// Claim records the execution of the set scheduled for the minute has started.
+// Only one snapshot can be claimed for a set and minute so sets are executed
+// once when there is more than one scheduler. ErrClaimed is returned when the
+// snapshot has already been claimed.
+func Claim(context interface{}, db *db.DB, set string, scheduled time.Time, vars map[string]string) (*Snapshot, error) {
+	log.Dev(context, "Claim", "Started : Set[%s] Scheduled[%v]", set, scheduled)
+
+	snap := Snapshot{
+		ID:        bson.NewObjectId(),
+		Set:       set,
+		Scheduled: scheduled.UTC().Truncate(time.Minute),
+		Started:   time.Now().UTC(),
+		Status:    StatusRunning,
+		Vars:      vars,
+	}
+
+	f := func(c *mgo.Collection) error {
+		idx := mgo.Index{
+			Key:    []string{"set", "-scheduled"},
+			Unique: true,
+		}
+
+		log.Dev(context, "Claim", "MGO : db.%s.ensureindex(%s)", c.Name, mongo.Query(idx))
+		if err := c.EnsureIndex(idx); err != nil {
+			return err
+		}
+
+		log.Dev(context, "Claim", "MGO : db.%s.insert(%s)", c.Name, mongo.Query(snap))
+		return c.Insert(snap)
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		if mgo.IsDup(err) {
+			err = ErrClaimed
+		}
+
+		log.Error(context, "Claim", err, "Completed")
+		return nil, err
+	}
+
+	log.Dev(context, "Claim", "Completed")
+	return &snap, nil
+}
+
+// Complete stores how the execution of a claimed snapshot ended.
+func Complete(context interface{}, db *db.DB, snap *Snapshot) error {
+	log.Dev(context, "Complete", "Started : Set[%s] ID[%s] Status[%s]", snap.Set, snap.ID.Hex(), snap.Status)
+
+	f := func(c *mgo.Collection) error {
+		q := bson.M{"_id": snap.ID}
+		u := bson.M{
+			"$set": bson.M{
+				"ended":       snap.Ended,
+				"duration_ms": snap.Duration,
+				"status":      snap.Status,
+				"results":     snap.Results,
+				"error":       snap.Error,
+			},
+		}
+
+		log.Dev(context, "Complete", "MGO : db.%s.update(%s, %s)", c.Name, mongo.Query(q), mongo.Query(u))
+		return c.Update(q, u)
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			err = ErrNotFound
+		}
+
+		log.Error(context, "Complete", err, "Completed")
+		return err
+	}
+
+	log.Dev(context, "Complete", "Completed")
+	return nil
+}
+
+// Prune removes the snapshots of the set older than the age and all but the
+// latest keep snapshots. A zero age does not remove snapshots by age.
+func Prune(context interface{}, db *db.DB, set string, keep int, age time.Duration) error {
+	log.Dev(context, "Prune", "Started : Set[%s] Keep[%d] Age[%v]", set, keep, age)
+
+	f := func(c *mgo.Collection) error {
+		if age > 0 {
+			q := bson.M{"set": set, "scheduled": bson.M{"$lt": time.Now().UTC().Add(-age)}}
+			log.Dev(context, "Prune", "MGO : db.%s.remove(%s)", c.Name, mongo.Query(q))
+			if _, err := c.RemoveAll(q); err != nil {
+				return err
+			}
+		}
+
+		// Find the snapshots past the ones to keep.
+		var old []struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+
+		q := bson.M{"set": set}
+		log.Dev(context, "Prune", "MGO : db.%s.find(%s).sort({\"scheduled\": -1}).skip(%d)", c.Name, mongo.Query(q), keep)
+		if err := c.Find(q).Select(bson.M{"_id": 1}).Sort("-scheduled").Skip(keep).All(&old); err != nil {
+			return err
+		}
+
+		if len(old) == 0 {
+			return nil
+		}
+
+		ids := make([]bson.ObjectId, len(old))
+		for i := range old {
+			ids[i] = old[i].ID
+		}
+
+		q = bson.M{"_id": bson.M{"$in": ids}}
+		log.Dev(context, "Prune", "MGO : db.%s.remove(%s)", c.Name, mongo.Query(q))
+		_, err := c.RemoveAll(q)
+		return err
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		log.Error(context, "Prune", err, "Completed")
+		return err
+	}
+
+	log.Dev(context, "Prune", "Completed")
+	return nil
+}
+
+// =============================================================================
+
+// List retrieves the snapshots of the set without their results, the latest
+// first.
+func List(context interface{}, db *db.DB, set string) ([]Snapshot, error) {
+	log.Dev(context, "List", "Started : Set[%s]", set)
+
+	var snaps []Snapshot
+	f := func(c *mgo.Collection) error {
+		q := bson.M{"set": set}
+		log.Dev(context, "List", "MGO : db.%s.find(%s, {\"results\": 0}).sort({\"scheduled\": -1})", c.Name, mongo.Query(q))
+		return c.Find(q).Select(bson.M{"results": 0}).Sort("-scheduled").All(&snaps)
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		log.Error(context, "List", err, "Completed")
+		return nil, err
+	}
+
+	if snaps == nil {
+		log.Error(context, "List", ErrNotFound, "Completed")
+		return nil, ErrNotFound
+	}
+
+	log.Dev(context, "List", "Completed : Snapshots[%d]", len(snaps))
+	return snaps, nil
+}
+
+// Latest retrieves the latest snapshot of the set that completed without an
+// error.
+func Latest(context interface{}, db *db.DB, set string) (*Snapshot, error) {
+	log.Dev(context, "Latest", "Started : Set[%s]", set)
+
+	var snap Snapshot
+	f := func(c *mgo.Collection) error {
+		q := bson.M{"set": set, "status": StatusDone}
+		log.Dev(context, "Latest", "MGO : db.%s.find(%s).sort({\"scheduled\": -1}).limit(1)", c.Name, mongo.Query(q))
+		return c.Find(q).Sort("-scheduled").One(&snap)
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			err = ErrNotFound
+		}
+
+		log.Error(context, "Latest", err, "Completed")
+		return nil, err
+	}
+
+	log.Dev(context, "Latest", "Completed")
+	return &snap, nil
+}
+
+// GetByID retrieves the specified snapshot of the set.
+func GetByID(context interface{}, db *db.DB, set string, id string) (*Snapshot, error) {
+	log.Dev(context, "GetByID", "Started : Set[%s] ID[%s]", set, id)
+
+	if !bson.IsObjectIdHex(id) {
+		log.Error(context, "GetByID", ErrInvalidID, "Completed")
+		return nil, ErrInvalidID
+	}
+
+	var snap Snapshot
+	f := func(c *mgo.Collection) error {
+		q := bson.M{"_id": bson.ObjectIdHex(id), "set": set}
+		log.Dev(context, "GetByID", "MGO : db.%s.findOne(%s)", c.Name, mongo.Query(q))
+		return c.Find(q).One(&snap)
+	}
+
+	if err := db.ExecuteMGO(context, Collection, f); err != nil {
+		if err == mgo.ErrNotFound {
+			err = ErrNotFound
+		}
+
+		log.Error(context, "GetByID", err, "Completed")
+		return nil, err
+	}
+
+	log.Dev(context, "GetByID", "Completed")
+	return &snap, nil
+}